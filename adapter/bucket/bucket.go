@@ -1,6 +1,53 @@
 package bucket
 
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// objects are streamed in and out of buckets so their size does not matter
 type Bucket interface {
-	GetObject(key string) ([]byte, error)
-	PutObject(key string, data []byte) error
+	GetObject(ctx context.Context, key string) (io.ReadCloser, error)
+	PutObject(ctx context.Context, key string, r io.Reader) (*Receipt, error)
+	DeleteObject(ctx context.Context, key string) error
+}
+
+// where a stored object ended up and what it looked like so it can be found and verified later
+type Receipt struct {
+	// archive id in vaults, key in S3 buckets and path in folders
+	Location string
+	// hex encoded SHA-256 tree hash of the object as glacier computes it
+	TreeHash string
+	Size     int64
+}
+
+// buckets which can list the keys of their objects
+type Lister interface {
+	ListKeys(ctx context.Context, prefix string) ([]string, error)
 }
+
+// archive of a vault which holds the object of a key
+type Archive struct {
+	Vault     string
+	Key       string
+	ArchiveId string
+	CreatedAt time.Time
+}
+
+// job which makes an archive of a vault available for download, jobs take hours
+// so they are kept to be picked up again by a later process
+type Retrieval struct {
+	Vault       string
+	Key         string
+	ArchiveId   string
+	JobId       string
+	Tier        string
+	RequestedAt time.Time
+	CompletedAt time.Time
+}
+
+// returned by buckets whose objects have to be retrieved before they can be read,
+// the retrieval was started and the object can be read once it completed
+var PendingErr error = errors.New("Object is being retrieved")
@@ -1,7 +1,12 @@
 package folder
 
 import (
+	"context"
+	"io"
 	"os"
+	"path/filepath"
+
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
 )
 
 type folder struct {
@@ -12,10 +17,45 @@ func New(path string) *folder {
 	return &folder{path: path}
 }
 
-func (f *folder) GetObject(key string) ([]byte, error) {
-	return os.ReadFile(f.path + "/" + key)
+func (f *folder) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Open(f.path + "/" + key)
+}
+
+// the object is hashed while it is written
+func (f *folder) PutObject(ctx context.Context, key string, r io.Reader) (*bucket.Receipt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// keys can contain slashes like paths
+	err := os.MkdirAll(filepath.Dir(f.path+"/"+key), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(f.path+"/"+key, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+	if err != nil {
+		return nil, err
+	}
+	hash := bucket.NewTreeHash()
+	_, err = io.Copy(io.MultiWriter(file, hash), r)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	err = file.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &bucket.Receipt{Location: f.path + "/" + key, TreeHash: hash.Sum(), Size: hash.Size()}, nil
 }
 
-func (f *folder) PutObject(key string, data []byte) error {
-	return os.WriteFile(f.path+"/"+key, data, 0777)
+func (f *folder) DeleteObject(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Remove(f.path + "/" + key)
 }
@@ -0,0 +1,221 @@
+// Package glaciertest provides a local stand-in of Glacier for tests.
+//
+// Only the calls the vault adapter makes are served, archives and jobs are kept in memory:
+//
+//	POST /{account}/vaults/{vault}/archives         uploads an archive
+//	POST /{account}/vaults/{vault}/jobs             initiates an archive retrieval job
+//	GET  /{account}/vaults/{vault}/jobs/{id}        describes a job
+//	GET  /{account}/vaults/{vault}/jobs/{id}/output downloads the archive of a completed job
+//
+// Jobs stay in progress until the test completes them, expired jobs are not found anymore
+// just like jobs whose output is older than a day.
+package glaciertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/google/uuid"
+)
+
+type Server struct {
+	*httptest.Server
+	mu       sync.Mutex
+	archives map[string][]byte
+	jobs     map[string]*job
+	truncate int
+}
+
+type job struct {
+	id        string
+	vault     string
+	archiveId string
+	tier      string
+	status    string
+}
+
+// starts a server on a local port which has to be closed by the caller, its URL is the endpoint
+// of the glacier client
+func NewServer() *Server {
+	s := &Server{archives: make(map[string][]byte), jobs: make(map[string]*job), truncate: -1}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// lets all jobs in progress succeed and returns how many there were
+func (s *Server) CompleteJobs() int {
+	return s.setStatus("Succeeded")
+}
+
+// lets all jobs in progress fail and returns how many there were
+func (s *Server) FailJobs() int {
+	return s.setStatus("Failed")
+}
+
+// forgets all jobs like glacier does a day after they completed
+func (s *Server) ExpireJobs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = make(map[string]*job)
+}
+
+// outputs of jobs are cut off after the number of bytes like a broken download, a negative
+// number serves them whole again
+func (s *Server) TruncateOutputs(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.truncate = n
+}
+
+// tiers of all jobs which were initiated and not expired
+func (s *Server) Jobs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tiers := []string{}
+	for _, j := range s.jobs {
+		tiers = append(tiers, j.tier)
+	}
+	return tiers
+}
+
+func (s *Server) setStatus(status string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, j := range s.jobs {
+		if j.status == "InProgress" {
+			j.status = status
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+
+	// {account}/vaults/{vault}/...
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[1] != "vaults" {
+		fail(w, http.StatusBadRequest, "InvalidParameterValueException", "Unknown path")
+		return
+	}
+	vault := parts[2]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[3] == "archives":
+		s.upload(w, r, vault)
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[3] == "jobs":
+		s.initiate(w, r, vault)
+	case r.Method == http.MethodGet && len(parts) == 5 && parts[3] == "jobs":
+		s.describe(w, vault, parts[4])
+	case r.Method == http.MethodGet && len(parts) == 6 && parts[3] == "jobs" && parts[5] == "output":
+		s.output(w, vault, parts[4])
+	default:
+		fail(w, http.StatusBadRequest, "InvalidParameterValueException", "Unknown operation")
+	}
+}
+
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, vault string) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		fail(w, http.StatusBadRequest, "RequestTimeoutException", err.Error())
+		return
+	}
+	id := uuid.New().String()
+	s.archives[vault+"/"+id] = b
+
+	w.Header().Set("Location", fmt.Sprintf("/-/vaults/%s/archives/%s", vault, id))
+	w.Header().Set("x-amz-archive-id", id)
+	w.Header().Set("x-amz-sha256-tree-hash", r.Header.Get("x-amz-sha256-tree-hash"))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) initiate(w http.ResponseWriter, r *http.Request, vault string) {
+	params := struct {
+		Type      string
+		ArchiveId string
+		Tier      string
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil || params.Type != "archive-retrieval" {
+		fail(w, http.StatusBadRequest, "InvalidParameterValueException", "Only archive retrievals are supported")
+		return
+	}
+	if _, ok := s.archives[vault+"/"+params.ArchiveId]; !ok {
+		fail(w, http.StatusNotFound, "ResourceNotFoundException", "Archive not found")
+		return
+	}
+	if len(params.Tier) < 1 {
+		params.Tier = "Standard"
+	}
+
+	j := &job{
+		id:        uuid.New().String(),
+		vault:     vault,
+		archiveId: params.ArchiveId,
+		tier:      params.Tier,
+		status:    "InProgress",
+	}
+	s.jobs[j.id] = j
+
+	w.Header().Set("Location", fmt.Sprintf("/-/vaults/%s/jobs/%s", vault, j.id))
+	w.Header().Set("x-amz-job-id", j.id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) describe(w http.ResponseWriter, vault, id string) {
+	j, ok := s.jobs[id]
+	if !ok || j.vault != vault {
+		fail(w, http.StatusNotFound, "ResourceNotFoundException", "Job not found")
+		return
+	}
+	data := s.archives[vault+"/"+j.archiveId]
+	hash := bucket.NewTreeHash()
+	hash.Write(data)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"JobId":                 j.id,
+		"Action":                "ArchiveRetrieval",
+		"ArchiveId":             j.archiveId,
+		"ArchiveSizeInBytes":    len(data),
+		"ArchiveSHA256TreeHash": hash.Sum(),
+		"Tier":                  j.tier,
+		"StatusCode":            j.status,
+		"Completed":             j.status != "InProgress",
+	})
+}
+
+func (s *Server) output(w http.ResponseWriter, vault, id string) {
+	j, ok := s.jobs[id]
+	if !ok || j.vault != vault {
+		fail(w, http.StatusNotFound, "ResourceNotFoundException", "Job not found")
+		return
+	}
+	if j.status != "Succeeded" {
+		fail(w, http.StatusBadRequest, "InvalidParameterValueException", "The job is not completed")
+		return
+	}
+	data := s.archives[vault+"/"+j.archiveId]
+	if s.truncate >= 0 && s.truncate < len(data) {
+		data = data[:s.truncate]
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// errors are read by the SDK from the code and message of the body
+func fail(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": code, "message": msg, "type": "Client"})
+}
@@ -0,0 +1,302 @@
+package s3bucket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+)
+
+// storage classes by how cheap they keep objects, objects of the deep archive have to be
+// restored before they can be read
+const (
+	Standard    = s3.StorageClassStandard
+	InstantRead = s3.StorageClassGlacierIr
+	DeepArchive = s3.StorageClassDeepArchive
+)
+
+// error codes of S3 which are not declared by the SDK
+const (
+	invalidObjectState       = "InvalidObjectState"
+	restoreAlreadyInProgress = "RestoreAlreadyInProgress"
+)
+
+// what the key template needs to know about the filing of an accession number
+type Accession struct {
+	Cik      string
+	MainFile string // name the main document was filed with like 'aapl-20240928.htm'
+}
+
+type s3Bucket struct {
+	name     string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	timeout  time.Duration
+
+	endpoint    string
+	template    string
+	lookup      func(ctx context.Context, accession string) (*Accession, error)
+	class       func(key string) string
+	encryption  string
+	kmsKeyId    string
+	partSize    int64
+	restoreDays int64
+	restoreTier string
+
+	// accession numbers never change their filing so lookups are only made once
+	mutex      sync.Mutex
+	accessions map[string]*Accession
+}
+
+type Option func(*s3Bucket)
+
+// points the client to another endpoint like a local stand-in, objects are addressed with
+// path style URLs then
+func WithEndpoint(endpoint string) Option {
+	return func(b *s3Bucket) {
+		b.endpoint = endpoint
+	}
+}
+
+// keys of documents look like '{accession}.htm' or '{accession}.txt' for main documents and
+// '{accession}/{file}' for exhibits, the template places them under other keys with the
+// placeholders '{cik}', '{accession}' and '{file}' where the file of a main document is the name
+// it was filed with, the CIK and the name are looked up with the function
+func WithKeyTemplate(template string, lookup func(ctx context.Context, accession string) (*Accession, error)) Option {
+	return func(b *s3Bucket) {
+		b.template = template
+		b.lookup = lookup
+	}
+}
+
+// storage class of every object by its key, objects are stored in the standard class by default
+func WithStorageClass(class func(key string) string) Option {
+	return func(b *s3Bucket) {
+		b.class = class
+	}
+}
+
+// server side encryption like 'AES256' or 'aws:kms', the key id is only used with KMS and the
+// default key of the account is used without it
+func WithEncryption(encryption, kmsKeyId string) Option {
+	return func(b *s3Bucket) {
+		b.encryption = encryption
+		b.kmsKeyId = kmsKeyId
+	}
+}
+
+// objects larger than the part size are uploaded in parts of that size, S3 requires at least 5MB
+func WithPartSize(size int64) Option {
+	return func(b *s3Bucket) {
+		b.partSize = max(size, s3manager.MinUploadPartSize)
+	}
+}
+
+// objects of archive classes are restored for the days with the retrieval tier, one day with
+// the standard tier by default
+func WithRestore(days int64, tier string) Option {
+	return func(b *s3Bucket) {
+		b.restoreDays = days
+		b.restoreTier = tier
+	}
+}
+
+// every upload and download is cancelled after the timeout if it is greater than zero
+func New(awsSession *session.Session, name string, timeout time.Duration, opts ...Option) *s3Bucket {
+	b := &s3Bucket{
+		name:        name,
+		timeout:     timeout,
+		partSize:    s3manager.DefaultUploadPartSize,
+		restoreDays: 1,
+		restoreTier: s3.TierStandard,
+		accessions:  make(map[string]*Accession),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	cfg := aws.NewConfig()
+	if len(b.endpoint) > 0 {
+		cfg = cfg.WithEndpoint(b.endpoint).WithS3ForcePathStyle(true)
+	}
+	b.client = s3.New(awsSession, cfg)
+	b.uploader = s3manager.NewUploaderWithClient(b.client, func(u *s3manager.Uploader) {
+		u.PartSize = b.partSize
+	})
+	return b
+}
+
+// objects of archive classes are restored first, the pending error is returned until the restore
+// completed and S3 keeps track of it so a later call picks it up again
+func (b *s3Bucket) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	key, err := b.objectKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the body is read after we returned so the timeout ends when it is closed
+	cancel := context.CancelFunc(func() {})
+	if b.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+	}
+	out, err := b.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	})
+	if isCode(err, invalidObjectState) {
+		defer cancel()
+		return nil, b.restore(ctx, key)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &body{ReadCloser: out.Body, cancel: cancel}, nil
+}
+
+// the receipt carries the key of the object in the bucket and the tree hash which is computed
+// while the object is uploaded, larger objects are uploaded in parts
+func (b *s3Bucket) PutObject(ctx context.Context, key string, r io.Reader) (*bucket.Receipt, error) {
+	if b.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
+
+	objKey, err := b.objectKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the uploader reads a plain reader once from start to end which lets it be hashed on the way
+	hash := bucket.NewTreeHash()
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(objKey),
+		Body:   io.TeeReader(r, hash),
+	}
+	if b.class != nil {
+		if class := b.class(key); len(class) > 0 {
+			input.StorageClass = aws.String(class)
+		}
+	}
+	if len(b.encryption) > 0 {
+		input.ServerSideEncryption = aws.String(b.encryption)
+		if b.encryption == s3.ServerSideEncryptionAwsKms && len(b.kmsKeyId) > 0 {
+			input.SSEKMSKeyId = aws.String(b.kmsKeyId)
+		}
+	}
+
+	_, err = b.uploader.UploadWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return &bucket.Receipt{Location: objKey, TreeHash: hash.Sum(), Size: hash.Size()}, nil
+}
+
+func (b *s3Bucket) DeleteObject(ctx context.Context, key string) error {
+	if b.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
+
+	key, err := b.objectKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// key of the object in the bucket by the template
+func (b *s3Bucket) objectKey(ctx context.Context, key string) (string, error) {
+	if len(b.template) < 1 {
+		return key, nil
+	}
+
+	accession, file, isExhibit := strings.Cut(key, "/")
+	if !isExhibit {
+		accession, _, _ = strings.Cut(key, ".")
+		file = key
+	}
+
+	cik := ""
+	needsCik := strings.Contains(b.template, "{cik}")
+	needsFile := !isExhibit && strings.Contains(b.template, "{file}")
+	if needsCik || needsFile {
+		acc, err := b.accession(ctx, accession)
+		if err != nil {
+			return "", err
+		}
+		cik = acc.Cik
+		// filings whose main document is not known keep the key of the pipeline
+		if needsFile && len(acc.MainFile) > 0 {
+			file = acc.MainFile
+		}
+	}
+
+	return strings.NewReplacer("{cik}", cik, "{accession}", accession, "{file}", file).Replace(b.template), nil
+}
+
+func (b *s3Bucket) accession(ctx context.Context, accession string) (*Accession, error) {
+	b.mutex.Lock()
+	acc, ok := b.accessions[accession]
+	b.mutex.Unlock()
+	if ok {
+		return acc, nil
+	}
+
+	acc, err := b.lookup(ctx, accession)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mutex.Lock()
+	b.accessions[accession] = acc
+	b.mutex.Unlock()
+	return acc, nil
+}
+
+// starts the restore of an object of an archive class unless it was already started
+func (b *s3Bucket) restore(ctx context.Context, key string) error {
+	_, err := b.client.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(b.restoreDays),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(b.restoreTier)},
+		},
+	})
+	if err != nil && !isCode(err, restoreAlreadyInProgress) {
+		return err
+	}
+	return bucket.PendingErr
+}
+
+type body struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *body) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func isCode(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
@@ -0,0 +1,151 @@
+package s3bucket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/finneas-io/data-pipeline/adapter/bucket/s3test"
+)
+
+func TestPutObject(t *testing.T) {
+
+	server := s3test.NewServer()
+	defer server.Close()
+
+	accessions := map[string]*Accession{"000000000124000001": {Cik: "0000000001", MainFile: "exmp-10k.htm"}}
+	lookups := 0
+	b := New(
+		newSession(),
+		"filings",
+		0,
+		WithEndpoint(server.URL),
+		WithKeyTemplate("{cik}/{accession}/{file}", func(ctx context.Context, accession string) (*Accession, error) {
+			lookups++
+			if acc, ok := accessions[accession]; ok {
+				return acc, nil
+			}
+			return nil, errors.New("Unknown accession number")
+		}),
+		WithStorageClass(func(key string) string {
+			if strings.Contains(key, "/") {
+				return DeepArchive
+			}
+			return InstantRead
+		}),
+		WithEncryption("aws:kms", "key-1"),
+	)
+	ctx := context.Background()
+
+	// the main document is readable right away and kept under the name it was filed with
+	rec, err := b.PutObject(ctx, "000000000124000001.htm", strings.NewReader("<html>10-K</html>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := bucket.NewTreeHash()
+	hash.Write([]byte("<html>10-K</html>"))
+	if rec.Location != "0000000001/000000000124000001/exmp-10k.htm" || rec.TreeHash != hash.Sum() {
+		t.Errorf("Expected the receipt of the main document but got %+v", rec)
+	}
+	obj := server.Object("filings", rec.Location)
+	if obj == nil || obj.StorageClass != InstantRead || obj.Encryption != "aws:kms" || obj.KMSKeyId != "key-1" {
+		t.Fatalf("Expected the main document with its storage class and encryption but got %+v", obj)
+	}
+	assertObject(t, b, "000000000124000001.htm", "<html>10-K</html>")
+
+	// exhibits in the deep archive are pending until their restore completed
+	_, err = b.PutObject(ctx, "000000000124000001/ex13.htm", strings.NewReader("<html>EX-13</html>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj := server.Object("filings", "0000000001/000000000124000001/ex13.htm"); obj == nil || obj.StorageClass != DeepArchive {
+		t.Fatalf("Expected the exhibit in the deep archive but got %+v", obj)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := b.GetObject(ctx, "000000000124000001/ex13.htm"); err != bucket.PendingErr {
+			t.Fatalf("Expected the exhibit to be pending but got %v", err)
+		}
+	}
+	if n := server.CompleteRestores(); n != 1 {
+		t.Fatalf("Expected one restore but got %d", n)
+	}
+	assertObject(t, b, "000000000124000001/ex13.htm", "<html>EX-13</html>")
+
+	err = b.DeleteObject(ctx, "000000000124000001.htm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.Keys("filings"); len(keys) != 1 {
+		t.Errorf("Expected only the exhibit to be left but got %v", keys)
+	}
+	if lookups != 1 {
+		t.Errorf("Expected the filing to be looked up once but got %d lookups", lookups)
+	}
+
+	// keys can't be built for filings whose company is unknown
+	_, err = b.PutObject(ctx, "000000000124000002.htm", strings.NewReader("<html>10-Q</html>"))
+	if err == nil {
+		t.Errorf("Expected an error for an unknown accession number")
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+
+	server := s3test.NewServer()
+	defer server.Close()
+
+	b := New(newSession(), "filings", 0, WithEndpoint(server.URL), WithPartSize(5<<20))
+
+	// a document a bit larger than two parts
+	data := make([]byte, 11<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	rec, err := b.PutObject(context.Background(), "000000000124000001.htm", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := bucket.NewTreeHash()
+	hash.Write(data)
+	if rec.TreeHash != hash.Sum() || rec.Size != int64(len(data)) {
+		t.Errorf("Expected the receipt to cover the whole document but got %+v", rec)
+	}
+
+	obj := server.Object("filings", "000000000124000001.htm")
+	if obj == nil || obj.Parts != 3 || !bytes.Equal(obj.Data, data) {
+		t.Fatalf("Expected the document to be uploaded in 3 parts")
+	}
+	if server.Uploads() != 0 {
+		t.Errorf("Expected no unfinished uploads but got %d", server.Uploads())
+	}
+}
+
+func newSession() *session.Session {
+	return session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("x", "x", ""),
+	}))
+}
+
+func assertObject(t *testing.T, b bucket.Bucket, key, want string) {
+	t.Helper()
+	r, err := b.GetObject(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("Expected '%s' but got '%s'", want, got)
+	}
+}
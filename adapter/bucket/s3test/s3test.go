@@ -0,0 +1,342 @@
+// Package s3test provides a local stand-in of S3 for tests.
+//
+// Only the calls the S3 bucket adapter makes are served with path style URLs, objects are
+// kept in memory:
+//
+//	PUT    /{bucket}/{key}                           puts an object
+//	GET    /{bucket}/{key}                           gets an object
+//	DELETE /{bucket}/{key}                           deletes an object
+//	POST   /{bucket}/{key}?uploads                   creates a multipart upload
+//	PUT    /{bucket}/{key}?partNumber=n&uploadId=id  uploads a part
+//	POST   /{bucket}/{key}?uploadId=id               completes a multipart upload
+//	DELETE /{bucket}/{key}?uploadId=id               aborts a multipart upload
+//	POST   /{bucket}/{key}?restore                   restores an object of an archive class
+//
+// Objects of the GLACIER and DEEP_ARCHIVE storage classes can only be read once their restore
+// was completed by the test.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// stored object with the settings it was uploaded with
+type Object struct {
+	Data         []byte
+	StorageClass string
+	Encryption   string
+	KMSKeyId     string
+	Parts        int // zero for objects which were not uploaded in parts
+
+	restoring bool
+	restored  bool
+}
+
+type upload struct {
+	key    string
+	object *Object
+	parts  map[int][]byte
+}
+
+type Server struct {
+	*httptest.Server
+	mu      sync.Mutex
+	objects map[string]*Object
+	uploads map[string]*upload
+}
+
+// starts a server on a local port which has to be closed by the caller, its URL is the endpoint
+// of the S3 client which has to use path style URLs
+func NewServer() *Server {
+	s := &Server{objects: make(map[string]*Object), uploads: make(map[string]*upload)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// copy of the object stored under the bucket and key or nil if there is none
+func (s *Server) Object(bucket, key string) *Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[bucket+"/"+key]
+	if !ok {
+		return nil
+	}
+	copied := *obj
+	return &copied
+}
+
+// keys of all objects in the bucket in order
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for k := range s.objects {
+		if key, ok := strings.CutPrefix(k, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// multipart uploads which were neither completed nor aborted
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// completes all restores in progress and returns how many there were
+func (s *Server) CompleteRestores() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, obj := range s.objects {
+		if obj.restoring {
+			obj.restoring = false
+			obj.restored = true
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(bucket) < 1 || len(key) < 1 {
+		fail(w, http.StatusBadRequest, "InvalidRequest", "Bucket and key are required")
+		return
+	}
+	name := bucket + "/" + key
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createUpload(w, r, bucket, name)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeUpload(w, r, bucket, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && query.Has("restore"):
+		s.restore(w, name)
+	case r.Method == http.MethodPut:
+		s.put(w, r, name)
+	case r.Method == http.MethodGet:
+		s.get(w, name)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Unknown operation")
+	}
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, name string) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		fail(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	obj, ok := newObject(w, r)
+	if !ok {
+		return
+	}
+	obj.Data = b
+	s.objects[name] = obj
+	w.Header().Set("ETag", etag(b))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) get(w http.ResponseWriter, name string) {
+	obj, ok := s.objects[name]
+	if !ok {
+		fail(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if archived(obj.StorageClass) && !obj.restored {
+		fail(w, http.StatusForbidden, "InvalidObjectState", "The operation is not valid for the object's storage class")
+		return
+	}
+	w.Header().Set("ETag", etag(obj.Data))
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.Data)))
+	w.Header().Set("x-amz-storage-class", obj.StorageClass)
+	w.WriteHeader(http.StatusOK)
+	w.Write(obj.Data)
+}
+
+func (s *Server) restore(w http.ResponseWriter, name string) {
+	obj, ok := s.objects[name]
+	if !ok {
+		fail(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if !archived(obj.StorageClass) {
+		fail(w, http.StatusForbidden, "InvalidObjectState", "Restore is not allowed for the object's storage class")
+		return
+	}
+	if obj.restoring {
+		fail(w, http.StatusConflict, "RestoreAlreadyInProgress", "Object restore is already in progress")
+		return
+	}
+	if obj.restored {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	obj.restoring = true
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	obj, ok := newObject(w, r)
+	if !ok {
+		return
+	}
+	id := uuid.New().String()
+	s.uploads[id] = &upload{key: name, object: obj, parts: make(map[int][]byte)}
+
+	key := strings.TrimPrefix(name, bucket+"/")
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(
+		w,
+		`<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`,
+		escape(bucket),
+		escape(key),
+		id,
+	)
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, id, number string) {
+	up, ok := s.uploads[id]
+	if !ok {
+		fail(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 {
+		fail(w, http.StatusBadRequest, "InvalidArgument", "Part number must be a positive integer")
+		return
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		fail(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	up.parts[n] = b
+	w.Header().Set("ETag", etag(b))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, bucket, id string) {
+	up, ok := s.uploads[id]
+	if !ok {
+		fail(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	req := struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}{}
+	err := xml.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Parts) < 1 {
+		fail(w, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed")
+		return
+	}
+
+	var data bytes.Buffer
+	for i, p := range req.Parts {
+		b, ok := up.parts[p.PartNumber]
+		if !ok || etag(b) != p.ETag {
+			fail(w, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+			return
+		}
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			fail(w, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order.")
+			return
+		}
+		data.Write(b)
+	}
+	up.object.Data = data.Bytes()
+	up.object.Parts = len(req.Parts)
+	s.objects[up.key] = up.object
+	delete(s.uploads, id)
+
+	key := strings.TrimPrefix(up.key, bucket+"/")
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(
+		w,
+		`<CompleteMultipartUploadResult><Location>%s/%s</Location><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`,
+		s.URL,
+		escape(up.key),
+		escape(bucket),
+		escape(key),
+		escape(etag(up.object.Data)),
+	)
+}
+
+// settings of a new object from the headers of its upload
+func newObject(w http.ResponseWriter, r *http.Request) (*Object, bool) {
+	obj := &Object{
+		StorageClass: r.Header.Get("x-amz-storage-class"),
+		Encryption:   r.Header.Get("x-amz-server-side-encryption"),
+		KMSKeyId:     r.Header.Get("x-amz-server-side-encryption-aws-kms-key-id"),
+	}
+	switch obj.StorageClass {
+	case "":
+		obj.StorageClass = "STANDARD"
+	case "STANDARD", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR", "GLACIER", "DEEP_ARCHIVE":
+	default:
+		fail(w, http.StatusBadRequest, "InvalidStorageClass", "The storage class you specified is not valid")
+		return nil, false
+	}
+	switch obj.Encryption {
+	case "", "AES256", "aws:kms":
+	default:
+		fail(w, http.StatusBadRequest, "InvalidArgument", "The encryption method specified is not supported")
+		return nil, false
+	}
+	return obj, true
+}
+
+// objects of these classes have to be restored before they can be read
+func archived(class string) bool {
+	return class == "GLACIER" || class == "DEEP_ARCHIVE"
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func fail(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, escape(msg))
+}
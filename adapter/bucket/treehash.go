@@ -0,0 +1,67 @@
+package bucket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+// glacier hashes objects in chunks of one megabyte
+const chunkSize = 1 << 20
+
+// computes the SHA-256 tree hash of everything written to it the way glacier does, so objects
+// can be hashed while they are streamed instead of being read twice
+type TreeHash struct {
+	chunk  hash.Hash
+	filled int
+	leaves [][]byte
+	size   int64
+}
+
+func NewTreeHash() *TreeHash {
+	return &TreeHash{chunk: sha256.New()}
+}
+
+func (h *TreeHash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		part := min(len(p), chunkSize-h.filled)
+		h.chunk.Write(p[:part])
+		h.filled += part
+		p = p[part:]
+		if h.filled == chunkSize {
+			h.leaves = append(h.leaves, h.chunk.Sum(nil))
+			h.chunk.Reset()
+			h.filled = 0
+		}
+	}
+	h.size += int64(n)
+	return n, nil
+}
+
+// number of bytes written so far
+func (h *TreeHash) Size() int64 {
+	return h.size
+}
+
+// hex encoded root of the tree of chunk hashes, the hashes of neighbouring nodes are combined
+// level by level until only the root is left
+func (h *TreeHash) Sum() string {
+	level := append([][]byte{}, h.leaves...)
+	if h.filled > 0 || len(level) < 1 {
+		level = append(level, h.chunk.Sum(nil))
+	}
+	for len(level) > 1 {
+		next := [][]byte{}
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				break
+			}
+			sum := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
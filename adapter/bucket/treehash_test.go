@@ -0,0 +1,28 @@
+package bucket
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+func TestTreeHash(t *testing.T) {
+	for _, size := range []int{1, chunkSize - 1, chunkSize, 3*chunkSize + 512} {
+		data := bytes.Repeat([]byte("edgar"), size/5+1)[:size]
+
+		// written in odd pieces so chunks are filled across writes
+		h := NewTreeHash()
+		io.CopyBuffer(h, struct{ io.Reader }{bytes.NewReader(data)}, make([]byte, 7777))
+
+		want := hex.EncodeToString(glacier.ComputeHashes(bytes.NewReader(data)).TreeHash)
+		if got := h.Sum(); got != want {
+			t.Errorf("Expected tree hash %s of %d bytes but got %s", want, size, got)
+		}
+		if h.Size() != int64(size) {
+			t.Errorf("Expected size %d but got %d", size, h.Size())
+		}
+	}
+}
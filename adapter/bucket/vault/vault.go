@@ -1,35 +1,328 @@
 package vault
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/finneas-io/data-pipeline/adapter/database"
 )
 
+// tiers of retrieval jobs by how fast and expensive they are, standard jobs take a few hours
+const (
+	Expedited = "Expedited"
+	Standard  = "Standard"
+	Bulk      = "Bulk"
+)
+
+// glacier only knows archives by their ids so the catalog remembers the archive of every key
+// and the retrieval jobs which were started for them
+type Catalog interface {
+	InsertArchive(ctx context.Context, arc *bucket.Archive) error
+	GetArchive(ctx context.Context, vault, key string) (*bucket.Archive, error)
+	GetArchives(ctx context.Context, vault, prefix string) ([]*bucket.Archive, error)
+	UpdateRetrieval(ctx context.Context, ret *bucket.Retrieval) error
+	GetRetrieval(ctx context.Context, vault, key string) (*bucket.Retrieval, error)
+}
+
 type vault struct {
-	name   string
-	client *glacier.Glacier
+	name    string
+	client  *glacier.Glacier
+	timeout time.Duration
+
+	endpoint string
+	catalog  Catalog
+	staging  bucket.Bucket
+	tier     string
+}
+
+type Option func(*vault)
+
+// points the client to another endpoint like a local stand-in
+func WithEndpoint(endpoint string) Option {
+	return func(v *vault) {
+		v.endpoint = endpoint
+	}
+}
+
+// archive ids of uploaded objects and retrieval jobs are kept in the catalog, without it
+// objects can be archived but never be retrieved
+func WithCatalog(c Catalog) Option {
+	return func(v *vault) {
+		v.catalog = c
+	}
 }
 
-func New(awsSession *session.Session, name string) *vault {
-	return &vault{client: glacier.New(awsSession), name: name}
+// retrieved objects are downloaded into the staging bucket and read from there afterwards
+func WithStaging(b bucket.Bucket) Option {
+	return func(v *vault) {
+		v.staging = b
+	}
+}
+
+// tier of the retrieval jobs, standard by default
+func WithTier(tier string) Option {
+	return func(v *vault) {
+		v.tier = tier
+	}
+}
+
+// every upload and download is cancelled after the timeout if it is greater than zero
+func New(awsSession *session.Session, name string, timeout time.Duration, opts ...Option) *vault {
+	v := &vault{name: name, timeout: timeout, tier: Standard}
+	for _, opt := range opts {
+		opt(v)
+	}
+
+	cfg := aws.NewConfig()
+	if len(v.endpoint) > 0 {
+		cfg = cfg.WithEndpoint(v.endpoint)
+	}
+	v.client = glacier.New(awsSession, cfg)
+	return v
+}
+
+// objects have to be retrieved before they can be read, the first call starts a retrieval
+// job and returns the pending error until the job completed, the job is kept in the catalog
+// so a later process picks it up again, once it completed the object is downloaded into
+// the staging bucket and read from there
+func (v *vault) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	if v.catalog == nil || v.staging == nil {
+		return nil, errors.New("Objects of a vault can only be retrieved with a catalog and a staging bucket")
+	}
+	if v.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.timeout)
+		defer cancel()
+	}
+
+	arc, err := v.catalog.GetArchive(ctx, v.name, key)
+	if err == database.NotFoundErr {
+		return nil, fmt.Errorf("No archive of '%s' is known in vault '%s'", key, v.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := v.catalog.GetRetrieval(ctx, v.name, key)
+	if err == database.NotFoundErr {
+		return nil, v.retrieve(ctx, arc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the object was archived again after the job was started so a staged copy is outdated
+	if ret.ArchiveId != arc.ArchiveId {
+		return nil, v.retrieve(ctx, arc)
+	}
+
+	// the retrieval is only completed once the whole archive was staged and verified
+	if !ret.CompletedAt.IsZero() {
+		r, err := v.staging.GetObject(ctx, key)
+		if err == nil {
+			return r, nil
+		}
+	}
+
+	// the output of a job is kept for a day after it completed, after that a new job is needed
+	// which also applies to objects which were staged and removed from the staging bucket since
+	job, err := v.client.DescribeJobWithContext(ctx, &glacier.DescribeJobInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(v.name),
+		JobId:     aws.String(ret.JobId),
+	})
+	if isCode(err, glacier.ErrCodeResourceNotFoundException) {
+		return nil, v.retrieve(ctx, arc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch aws.StringValue(job.StatusCode) {
+	case glacier.StatusCodeInProgress:
+		return nil, bucket.PendingErr
+	case glacier.StatusCodeFailed:
+		return nil, v.retrieve(ctx, arc)
+	}
+
+	err = v.stage(ctx, ret, job)
+	if err != nil {
+		return nil, err
+	}
+	return v.staging.GetObject(ctx, key)
 }
 
-func (v *vault) GetObject(key string) ([]byte, error) {
-	return nil, nil
+// downloads the output of the completed job into the staging bucket, other readers don't
+// serve the staged object while it is written since the retrieval is only completed after it
+// was compared with the archive the job retrieved
+func (v *vault) stage(ctx context.Context, ret *bucket.Retrieval, job *glacier.JobDescription) error {
+
+	if !ret.CompletedAt.IsZero() {
+		ret.CompletedAt = time.Time{}
+		err := v.catalog.UpdateRetrieval(ctx, ret)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := v.client.GetJobOutputWithContext(ctx, &glacier.GetJobOutputInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(v.name),
+		JobId:     aws.String(ret.JobId),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	rec, err := v.staging.PutObject(ctx, ret.Key, out.Body)
+	if err != nil {
+		return err
+	}
+	if rec.Size != aws.Int64Value(job.ArchiveSizeInBytes) || rec.TreeHash != aws.StringValue(job.ArchiveSHA256TreeHash) {
+		v.staging.DeleteObject(ctx, ret.Key)
+		return fmt.Errorf("Staged object '%s' does not match archive '%s'", ret.Key, ret.ArchiveId)
+	}
+
+	ret.CompletedAt = time.Now()
+	return v.catalog.UpdateRetrieval(ctx, ret)
 }
 
-func (v *vault) PutObject(key string, data []byte) error {
+// the receipt carries the archive id and the tree hash which glacier computed of the upload
+func (v *vault) PutObject(ctx context.Context, key string, r io.Reader) (*bucket.Receipt, error) {
+	if v.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.timeout)
+		defer cancel()
+	}
+
+	// glacier needs to seek the body to compute its checksums so streams are spooled first
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		tmp, err := os.CreateTemp("", "vault-*")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		_, err = io.Copy(tmp, r)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		body = tmp
+	}
+
+	// the size is what is left of the body from where it is read
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	end, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	_, err = body.Seek(start, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key is kept as description so archives can still be told apart in an inventory of the vault
 	input := &glacier.UploadArchiveInput{
+		AccountId:          aws.String("-"),
+		VaultName:          aws.String(v.name),
+		ArchiveDescription: aws.String(key),
+		Body:               body,
+	}
+	out, err := v.client.UploadArchiveWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	rec := &bucket.Receipt{
+		Location: aws.StringValue(out.ArchiveId),
+		TreeHash: aws.StringValue(out.Checksum),
+		Size:     end - start,
+	}
+
+	if v.catalog == nil {
+		return rec, nil
+	}
+	err = v.catalog.InsertArchive(ctx, &bucket.Archive{
+		Vault:     v.name,
+		Key:       key,
+		ArchiveId: rec.Location,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// archives in a vault are only addressed by their archive id which we do not know by key
+func (v *vault) DeleteObject(ctx context.Context, key string) error {
+	return errors.New("Objects of a vault can not be deleted by key")
+}
+
+// keys of the archived objects which start with the prefix as far as the catalog knows them
+func (v *vault) ListKeys(ctx context.Context, prefix string) ([]string, error) {
+	if v.catalog == nil {
+		return nil, errors.New("Objects of a vault can only be listed with a catalog")
+	}
+	arcs, err := v.catalog.GetArchives(ctx, v.name, prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, arc := range arcs {
+		keys = append(keys, arc.Key)
+	}
+	return keys, nil
+}
+
+// starts a retrieval job of the archive and keeps it in the catalog
+func (v *vault) retrieve(ctx context.Context, arc *bucket.Archive) error {
+	out, err := v.client.InitiateJobWithContext(ctx, &glacier.InitiateJobInput{
 		AccountId: aws.String("-"),
 		VaultName: aws.String(v.name),
-		Body:      bytes.NewReader(data),
+		JobParameters: &glacier.JobParameters{
+			Type:        aws.String("archive-retrieval"),
+			ArchiveId:   aws.String(arc.ArchiveId),
+			Description: aws.String(arc.Key),
+			Tier:        aws.String(v.tier),
+		},
+	})
+	if err != nil {
+		return err
 	}
-	_, err := v.client.UploadArchive(input)
+
+	err = v.catalog.UpdateRetrieval(ctx, &bucket.Retrieval{
+		Vault:       v.name,
+		Key:         arc.Key,
+		ArchiveId:   arc.ArchiveId,
+		JobId:       aws.StringValue(out.JobId),
+		Tier:        v.tier,
+		RequestedAt: time.Now(),
+	})
 	if err != nil {
 		return err
 	}
-	return nil
+	return bucket.PendingErr
+}
+
+func isCode(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
 }
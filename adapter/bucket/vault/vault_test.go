@@ -0,0 +1,167 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/finneas-io/data-pipeline/adapter/bucket/folder"
+	"github.com/finneas-io/data-pipeline/adapter/bucket/glaciertest"
+	"github.com/finneas-io/data-pipeline/adapter/database/memory"
+)
+
+func TestGetObject(t *testing.T) {
+
+	server := glaciertest.NewServer()
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("x", "x", ""),
+	}))
+	ctx := context.Background()
+	db := memory.New()
+	staging := folder.New(t.TempDir())
+
+	v := New(sess, "filings", 0, WithEndpoint(server.URL), WithCatalog(db), WithStaging(staging), WithTier(Bulk))
+
+	rec, err := v.PutObject(ctx, "0000000001-24-000001.htm", bytes.NewReader([]byte("<html>10-K</html>")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := bucket.NewTreeHash()
+	hash.Write([]byte("<html>10-K</html>"))
+	if len(rec.Location) < 1 || rec.TreeHash != hash.Sum() || rec.Size != hash.Size() {
+		t.Fatalf("Expected the receipt of the upload but got %+v", rec)
+	}
+	keys, err := v.ListKeys(ctx, "0000000001-24-000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "0000000001-24-000001.htm" {
+		t.Fatalf("Expected the archived key to be listed but got %v", keys)
+	}
+
+	// the first read starts the job and every read until it completed waits for it
+	_, err = v.GetObject(ctx, "0000000001-24-000001.htm")
+	if err != bucket.PendingErr {
+		t.Fatalf("Expected the object to be pending but got %v", err)
+	}
+	_, err = v.GetObject(ctx, "0000000001-24-000001.htm")
+	if err != bucket.PendingErr {
+		t.Fatalf("Expected the object to be pending but got %v", err)
+	}
+	if jobs := server.Jobs(); len(jobs) != 1 || jobs[0] != Bulk {
+		t.Fatalf("Expected one bulk job but got %v", jobs)
+	}
+
+	// a new vault resumes the job which was started by the first one
+	v = New(sess, "filings", 0, WithEndpoint(server.URL), WithCatalog(db), WithStaging(staging))
+	server.CompleteJobs()
+	assertObject(t, v, "0000000001-24-000001.htm", "<html>10-K</html>")
+
+	// once staged the object is read without glacier
+	server.ExpireJobs()
+	assertObject(t, v, "0000000001-24-000001.htm", "<html>10-K</html>")
+
+	// objects removed from the staging bucket after their job expired are retrieved again
+	err = staging.DeleteObject(ctx, "0000000001-24-000001.htm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = v.GetObject(ctx, "0000000001-24-000001.htm")
+	if err != bucket.PendingErr {
+		t.Fatalf("Expected the object to be pending but got %v", err)
+	}
+
+	// failed jobs are started again
+	server.FailJobs()
+	_, err = v.GetObject(ctx, "0000000001-24-000001.htm")
+	if err != bucket.PendingErr {
+		t.Fatalf("Expected the object to be pending but got %v", err)
+	}
+	server.CompleteJobs()
+	assertObject(t, v, "0000000001-24-000001.htm", "<html>10-K</html>")
+
+	_, err = v.GetObject(ctx, "0000000001-24-000002.htm")
+	if err == nil || err == bucket.PendingErr {
+		t.Fatalf("Expected an error for an object which was never archived but got %v", err)
+	}
+}
+
+func TestStaging(t *testing.T) {
+
+	server := glaciertest.NewServer()
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("x", "x", ""),
+	}))
+	ctx := context.Background()
+	staging := folder.New(t.TempDir())
+	v := New(sess, "filings", 0, WithEndpoint(server.URL), WithCatalog(memory.New()), WithStaging(staging))
+
+	key := "0000000001-24-000001.htm"
+	_, err := v.PutObject(ctx, key, bytes.NewReader([]byte("<html>10-K</html>")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = v.GetObject(ctx, key)
+	if err != bucket.PendingErr {
+		t.Fatalf("Expected the object to be pending but got %v", err)
+	}
+
+	// a partly written copy is not served before the retrieval completed
+	_, err = staging.PutObject(ctx, key, bytes.NewReader([]byte("<html>")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = v.GetObject(ctx, key)
+	if err != bucket.PendingErr {
+		t.Fatalf("Expected the object to be pending but got %v", err)
+	}
+
+	// broken downloads are not staged
+	server.CompleteJobs()
+	server.TruncateOutputs(6)
+	_, err = v.GetObject(ctx, key)
+	if err == nil || err == bucket.PendingErr {
+		t.Fatalf("Expected an error for the truncated output but got %v", err)
+	}
+	server.TruncateOutputs(-1)
+	assertObject(t, v, key, "<html>10-K</html>")
+
+	// the copy of an archive is outdated once the object is archived again
+	_, err = v.PutObject(ctx, key, bytes.NewReader([]byte("<html>10-K/A</html>")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = v.GetObject(ctx, key)
+	if err != bucket.PendingErr {
+		t.Fatalf("Expected the object to be pending but got %v", err)
+	}
+	server.CompleteJobs()
+	assertObject(t, v, key, "<html>10-K/A</html>")
+}
+
+func assertObject(t *testing.T, b bucket.Bucket, key, want string) {
+	t.Helper()
+	r, err := b.GetObject(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("Expected '%s' but got '%s'", want, got)
+	}
+}
@@ -1,9 +1,40 @@
 package client
 
-import "github.com/finneas-io/data-pipeline/domain/filing"
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/domain/filing"
+)
 
 type Client interface {
-	GetCompany(cik string) (*filing.Company, error)
-	GetFilings(cik string) ([]*filing.Filing, error)
-	GetFile(cik, id, key string) (*filing.File, error)
+	GetCompany(ctx context.Context, cik string) (*filing.Company, error)
+	GetFilings(ctx context.Context, cik string) ([]*filing.Filing, error)
+	GetRecentFilings(ctx context.Context, cik, etag string) (*Submissions, error)
+	GetFile(ctx context.Context, cik, id, key string) (*filing.File, error)
+	OpenFile(ctx context.Context, cik, id, key string) (*filing.File, io.ReadCloser, error)
+	OpenDocument(ctx context.Context, cik, id, key string) (io.ReadCloser, error)
+	GetFiles(ctx context.Context, cik, id string) ([]*filing.File, error)
+	GetLatestFilings(ctx context.Context, form string, since time.Time) ([]*FeedEntry, error)
+	GetTickers(ctx context.Context) (map[string]string, error)
+}
+
+// single entry of the EDGAR latest filings feed
+type FeedEntry struct {
+	Cik     string
+	Id      string
+	Form    string
+	Updated time.Time
 }
+
+// recent filings of a company, newest first, which are listed in the submissions of
+// the company without the older pages
+type Submissions struct {
+	Filings []*filing.Filing
+	ETag    string // version of the submissions for conditional requests
+}
+
+// the submissions did not change since the version of the passed ETag
+var NotModifiedErr error = errors.New("Not modified")
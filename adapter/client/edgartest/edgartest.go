@@ -0,0 +1,151 @@
+// Package edgartest provides a local stand-in of the EDGAR hosts for tests.
+//
+// Responses are served from a fixture tree which mirrors the URL paths of EDGAR:
+//
+//	submissions/CIK0000000001.json                      submissions JSON of a company
+//	submissions/CIK0000000001-submissions-001.json      older page listed in 'files'
+//	files/company_tickers.json                          ticker mapping
+//	Archives/edgar/data/0000000001/{id}/{document}      documents of a filing
+//	Archives/edgar/data/0000000001/{id}/{dashed}-index.htm  filing index page
+//	cgi-bin/browse-edgar/{form}.xml                     first page of the latest filings feed
+//
+// The 'index.json' directory listing of a filing is generated from the files in its
+// folder unless the fixture tree contains one.
+package edgartest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const emptyFeed = `<?xml version="1.0" encoding="ISO-8859-1" ?>
+<feed xmlns="http://www.w3.org/2005/Atom"></feed>`
+
+type Server struct {
+	*httptest.Server
+	dir      string
+	mu       sync.Mutex
+	requests []string
+}
+
+// starts a server on a local port which has to be closed by the caller, its URL is
+// used as both the data and the www base URL of the client
+func NewServer(dir string) *Server {
+	s := &Server{dir: dir}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// paths and queries of all requests received so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+	s.mu.Unlock()
+
+	// EDGAR refuses requests which do not declare who is sending them
+	if len(r.Header.Get("User-Agent")) < 1 {
+		http.Error(w, "Undeclared automated tool", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean(r.URL.Path)
+	if name == "/cgi-bin/browse-edgar" {
+		s.feed(w, r)
+		return
+	}
+
+	file := filepath.Join(s.dir, filepath.FromSlash(name))
+	if path.Base(name) == "index.json" {
+		if _, err := os.Stat(file); err != nil {
+			s.listing(w, filepath.Dir(file))
+			return
+		}
+	}
+
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	// conditional requests are answered with 'not modified' until the fixture changes
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	http.ServeFile(w, r, file)
+}
+
+// only the first page of the feed is part of the fixtures, later pages are empty
+func (s *Server) feed(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/atom+xml")
+
+	start := r.URL.Query().Get("start")
+	form := r.URL.Query().Get("type")
+	if start != "" && start != "0" {
+		w.Write([]byte(emptyFeed))
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "cgi-bin", "browse-edgar", form+".xml"))
+	if err != nil {
+		w.Write([]byte(emptyFeed))
+		return
+	}
+	w.Write(data)
+}
+
+type listing struct {
+	Directory struct {
+		Name string `json:"name"`
+		Item []item `json:"item"`
+	} `json:"directory"`
+}
+
+type item struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	LastModified string `json:"last-modified"`
+}
+
+func (s *Server) listing(w http.ResponseWriter, dir string) {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	res := &listing{}
+	res.Directory.Name = strings.TrimPrefix(filepath.ToSlash(dir), filepath.ToSlash(s.dir))
+	res.Directory.Item = []item{}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() {
+			continue
+		}
+		res.Directory.Item = append(res.Directory.Item, item{
+			Name:         e.Name(),
+			Type:         "text.gif",
+			LastModified: info.ModTime().UTC().Format("2006-01-02 15:04:05"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -1,53 +1,173 @@
 package httpclnt
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/finneas-io/data-pipeline/adapter/client"
 	"github.com/finneas-io/data-pipeline/domain/filing"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
 )
 
+// base URLs of the EDGAR hosts
+const (
+	DataURL = "https://data.sec.gov"
+	WwwURL  = "https://www.sec.gov"
+)
+
+// delay between requests which keeps us below the rate limit of the SEC
+const DefaultDelay = 200 * time.Millisecond
+
 type httpClient struct {
-	client *http.Client
+	client  *http.Client
+	dataURL string
+	wwwURL  string
+	delay   time.Duration
+
+	// earliest time of the next request of all routines sharing the client
+	mutex sync.Mutex
+	next  time.Time
 }
 
-func New() *httpClient {
-	return &httpClient{client: &http.Client{}}
+// the base URLs can point to a stand-in of EDGAR, every request is cancelled
+// after the timeout if it is greater than zero
+func New(dataURL, wwwURL string, delay, timeout time.Duration) *httpClient {
+	return &httpClient{
+		client:  &http.Client{Timeout: timeout},
+		dataURL: strings.TrimSuffix(dataURL, "/"),
+		wwwURL:  strings.TrimSuffix(wwwURL, "/"),
+		delay:   delay,
+	}
 }
 
-func (c *httpClient) GetCompany(cik string) (*filing.Company, error) {
+func (c *httpClient) GetCompany(ctx context.Context, cik string) (*filing.Company, error) {
 
-	data, err := c.get(fmt.Sprintf("https://data.sec.gov/submissions/CIK%s.json", cik))
+	data, err := c.get(ctx, fmt.Sprintf("%s/submissions/CIK%s.json", c.dataURL, cik))
 	if err != nil {
 		return nil, err
 	}
 
-	res := &struct {
-		Name    string   `json:"name"`
-		Tickers []string `json:"tickers"`
-		Exchs   []string `json:"exchanges"`
-	}{}
+	res := &companyResponse{}
 	err = json.Unmarshal(data, res)
 	if err != nil {
 		return nil, err
 	}
 
-	cmp := &filing.Company{Cik: cik, Name: res.Name}
-	for i := range res.Tickers {
-		cmp.Tickers = append(cmp.Tickers, &filing.Ticker{Value: res.Tickers[i], Exchange: res.Exchs[i]})
+	return res.transform(cik), nil
+}
+
+type companyResponse struct {
+	Name          string   `json:"name"`
+	Sic           string   `json:"sic"`
+	SicDesc       string   `json:"sicDescription"`
+	Ein           string   `json:"ein"`
+	Incorporation string   `json:"stateOfIncorporation"`
+	FiscalYearEnd string   `json:"fiscalYearEnd"`
+	Tickers       []string `json:"tickers"`
+	Exchs         []string `json:"exchanges"`
+	Addresses     map[string]struct {
+		Street1 string `json:"street1"`
+		Street2 string `json:"street2"`
+		City    string `json:"city"`
+		State   string `json:"stateOrCountry"`
+		Zip     string `json:"zipCode"`
+	} `json:"addresses"`
+	FormerNames []struct {
+		Name string `json:"name"`
+		From string `json:"from"`
+		To   string `json:"to"`
+	} `json:"formerNames"`
+}
+
+func (r *companyResponse) transform(cik string) *filing.Company {
+
+	cmp := &filing.Company{
+		Cik:           cik,
+		Name:          r.Name,
+		Sic:           r.Sic,
+		Industry:      r.SicDesc,
+		Incorporation: r.Incorporation,
+		FiscalYearEnd: r.FiscalYearEnd,
+		Ein:           r.Ein,
+	}
+	for i := range r.Tickers {
+		t := &filing.Ticker{Value: r.Tickers[i]}
+		if i < len(r.Exchs) {
+			t.Exchange = r.Exchs[i]
+		}
+		cmp.Tickers = append(cmp.Tickers, t)
 	}
 
-	return cmp, nil
+	// map keys are the address types 'business' and 'mailing'
+	types := []string{}
+	for k := range r.Addresses {
+		types = append(types, k)
+	}
+	sort.Strings(types)
+	for _, k := range types {
+		a := r.Addresses[k]
+		cmp.Addresses = append(cmp.Addresses, &filing.Address{
+			Type:    k,
+			Street1: a.Street1,
+			Street2: a.Street2,
+			City:    a.City,
+			State:   a.State,
+			Zip:     a.Zip,
+		})
+	}
+
+	for _, v := range r.FormerNames {
+		// TODO no error is expected but implement observability just to be sure
+		from, _ := time.Parse(time.RFC3339, v.From)
+		to, _ := time.Parse(time.RFC3339, v.To)
+		cmp.FormerNames = append(cmp.FormerNames, &filing.FormerName{Name: v.Name, From: from, To: to})
+	}
+
+	return cmp
 }
 
-func (c *httpClient) GetFilings(cik string) ([]*filing.Filing, error) {
+// maps every ticker known to the SEC to the CIK of its company
+func (c *httpClient) GetTickers(ctx context.Context) (map[string]string, error) {
 
-	data, err := c.get(fmt.Sprintf("https://data.sec.gov/submissions/CIK%s.json", cik))
+	data, err := c.get(ctx, c.wwwURL+"/files/company_tickers.json")
+	if err != nil {
+		return nil, err
+	}
+
+	// the response is an object with the keys '0', '1', ... instead of an array
+	res := make(map[string]struct {
+		Cik    int    `json:"cik_str"`
+		Ticker string `json:"ticker"`
+	})
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	tickers := make(map[string]string)
+	for _, v := range res {
+		tickers[strings.ToUpper(v.Ticker)] = fmt.Sprintf("%010d", v.Cik)
+	}
+
+	return tickers, nil
+}
+
+func (c *httpClient) GetFilings(ctx context.Context, cik string) ([]*filing.Filing, error) {
+
+	data, err := c.get(ctx, fmt.Sprintf("%s/submissions/CIK%s.json", c.dataURL, cik))
 	if err != nil {
 		return nil, err
 	}
@@ -68,7 +188,7 @@ func (c *httpClient) GetFilings(cik string) ([]*filing.Filing, error) {
 
 	// get filings from non recent pages and check for duplicates
 	for _, old := range res.Filings.OldPages {
-		data, err := c.get(fmt.Sprintf("https://data.sec.gov/submissions/%s", old.Name))
+		data, err := c.get(ctx, fmt.Sprintf("%s/submissions/%s", c.dataURL, old.Name))
 		if err != nil {
 			return nil, err
 		}
@@ -88,6 +208,36 @@ func (c *httpClient) GetFilings(cik string) ([]*filing.Filing, error) {
 	return filings, nil
 }
 
+// the request is conditional if an ETag of an earlier response is passed, amendments
+// are only linked by the caller since their originals might be on older pages
+func (c *httpClient) GetRecentFilings(ctx context.Context, cik, etag string) (*client.Submissions, error) {
+
+	header := http.Header{}
+	if len(etag) > 0 {
+		header.Set("If-None-Match", etag)
+	}
+	res, err := c.do(ctx, fmt.Sprintf("%s/submissions/CIK%s.json", c.dataURL, cik), header)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified {
+		return nil, client.NotModifiedErr
+	}
+
+	data := &filingResponse{}
+	err = json.NewDecoder(res.Body).Decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	subs := &client.Submissions{Filings: []*filing.Filing{}, ETag: res.Header.Get("ETag")}
+	if data.Filings.Recent != nil {
+		subs.Filings = data.Filings.Recent.transform()
+	}
+	return subs, nil
+}
+
 type filingResponse struct {
 	Name    string `json:"name"`
 	Cik     string `json:"cik"`
@@ -102,6 +252,7 @@ type filingResponse struct {
 type filingData struct {
 	Ids         []string `json:"accessionNumber"`
 	FilingDates []string `json:"filingDate"`
+	ReportDates []string `json:"reportDate"`
 	Forms       []string `json:"form"`
 	PrimDocs    []string `json:"primaryDocument"`
 }
@@ -112,15 +263,12 @@ func (d *filingData) transform() []*filing.Filing {
 
 	for i, v := range d.Forms {
 
-		// we are only looking for quarterly and annual financial reports
-		if v != "10-K" && v != "10-Q" {
-			continue
-		}
 		ext, err := getExtension(d.PrimDocs[i])
 		if err != nil {
 			continue
 		}
-		if ext != ".htm" {
+		// old filings only consist of a full submission text file
+		if ext != ".htm" && ext != ".html" && ext != ".txt" {
 			continue
 		}
 		// TODO no error is expected but implement observability just to be sure
@@ -129,11 +277,18 @@ func (d *filingData) transform() []*filing.Filing {
 			fd = time.Time{}
 		}
 
+		// report date is empty for some forms so a zero time is fine here
+		var rd time.Time
+		if i < len(d.ReportDates) {
+			rd, _ = time.Parse("2006-01-02", d.ReportDates[i])
+		}
+
 		f := &filing.Filing{
 			Id:         strings.Replace(d.Ids[i], "-", "", -1),
 			MainFile:   &filing.File{Key: d.PrimDocs[i]},
 			Form:       v,
 			FilingDate: fd,
+			ReportDate: rd,
 		}
 		filings = append(filings, f)
 	}
@@ -155,36 +310,163 @@ func getExtension(key string) (string, error) {
 	return result, nil
 }
 
-func (w *httpClient) GetFile(cik, id, key string) (*filing.File, error) {
+func (w *httpClient) GetFile(ctx context.Context, cik, id, key string) (*filing.File, error) {
+	file, body, err := w.OpenFile(ctx, cik, id, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	file.Data, err = io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// the returned file has no data, its content is streamed from the reader which must be closed
+func (w *httpClient) OpenFile(ctx context.Context, cik, id, key string) (*filing.File, io.ReadCloser, error) {
 
 	data, err := w.get(
-		fmt.Sprintf("https://www.sec.gov/Archives/edgar/data/%s/%s/index.json", cik, id),
+		ctx,
+		fmt.Sprintf("%s/Archives/edgar/data/%s/%s/index.json", w.wwwURL, cik, id),
 	)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	res := &fileResponse{}
 	err = json.Unmarshal(data, res)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	files := res.transform()
 
 	// find the main file from the fetched file list
 	for _, v := range files {
 		if v.Key == key {
-			v.Data, err = w.get(
-				fmt.Sprintf("https://www.sec.gov/Archives/edgar/data/%s/%s/%s", cik, id, key),
-			)
+			body, err := w.OpenDocument(ctx, cik, id, key)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
+			}
+			return v, body, nil
+		}
+	}
+
+	return nil, nil, errors.New("Filing main file not found in file list")
+}
+
+// streams a document whose key is already known from the file list without fetching the list again
+func (w *httpClient) OpenDocument(ctx context.Context, cik, id, key string) (io.ReadCloser, error) {
+	return w.open(ctx, fmt.Sprintf("%s/Archives/edgar/data/%s/%s/%s", w.wwwURL, cik, id, key))
+}
+
+func (w *httpClient) GetFiles(ctx context.Context, cik, id string) ([]*filing.File, error) {
+
+	data, err := w.get(
+		ctx,
+		fmt.Sprintf("%s/Archives/edgar/data/%s/%s/index.json", w.wwwURL, cik, id),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &fileResponse{}
+	err = json.Unmarshal(data, res)
+	if err != nil {
+		return nil, err
+	}
+	files := res.transform()
+
+	// the directory listing does not know about document types, only the filing index page does
+	data, err = w.get(
+		ctx,
+		fmt.Sprintf("%s/Archives/edgar/data/%s/%s/%s-index.htm", w.wwwURL, cik, id, dashed(id)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	types, err := docTypes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		f.Type = types[f.Key]
+	}
+
+	return files, nil
+}
+
+// accession numbers are stored without dashes e.g. '000032019324000081'
+func dashed(id string) string {
+	if len(id) != 18 {
+		return id
+	}
+	return id[:10] + "-" + id[10:12] + "-" + id[12:]
+}
+
+// reads the document table of the filing index page which has the columns
+// 'Seq', 'Description', 'Document', 'Type' and 'Size'
+func docTypes(data []byte) (map[string]string, error) {
+
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]string)
+	for _, tbl := range findNodes(doc, "table") {
+		if !strings.Contains(attr(tbl, "class"), "tableFile") {
+			continue
+		}
+		for _, row := range findNodes(tbl, "tr") {
+			cols := findNodes(row, "td")
+			if len(cols) < 4 {
+				continue
 			}
-			return v, nil
+			// inline XBRL documents are suffixed with 'iXBRL' in the document column
+			name := strings.Fields(text(cols[2]))
+			if len(name) < 1 {
+				continue
+			}
+			types[name[0]] = strings.TrimSpace(text(cols[3]))
 		}
 	}
 
-	return nil, errors.New("Filing main file not found in file list")
+	return types, nil
+}
+
+func findNodes(node *html.Node, tag string) []*html.Node {
+	nodes := []*html.Node{}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && child.Data == tag {
+			nodes = append(nodes, child)
+			continue
+		}
+		nodes = append(nodes, findNodes(child, tag)...)
+	}
+	return nodes
+}
+
+func attr(node *html.Node, key string) string {
+	for _, a := range node.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func text(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+	result := ""
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		result += text(child)
+	}
+	return result
 }
 
 type fileResponse struct {
@@ -209,28 +491,170 @@ func (r *fileResponse) transform() []*filing.File {
 	return files
 }
 
-func (w *httpClient) get(url string) ([]byte, error) {
+// the feed only keeps the most recent entries so we never need to go further back
+const maxFeedPages = 20
+
+func (c *httpClient) GetLatestFilings(ctx context.Context, form string, since time.Time) ([]*client.FeedEntry, error) {
+
+	entries := []*client.FeedEntry{}
+
+	for page := 0; page < maxFeedPages; page++ {
+
+		data, err := c.get(ctx, fmt.Sprintf(
+			"%s/cgi-bin/browse-edgar?action=getcurrent&type=%s&company=&dateb=&owner=include&start=%d&count=100&output=atom",
+			c.wwwURL,
+			url.QueryEscape(form),
+			page*100,
+		))
+		if err != nil {
+			return nil, err
+		}
+
+		// the feed is declared as 'ISO-8859-1' which the XML decoder can not read by itself
+		res := &feedResponse{}
+		dec := xml.NewDecoder(bytes.NewReader(data))
+		dec.CharsetReader = charset.NewReaderLabel
+		err = dec.Decode(res)
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Entries) < 1 {
+			break
+		}
+
+		// entries are ordered from newest to oldest
+		done := false
+		for _, v := range res.Entries {
+			e, err := v.transform()
+			if err != nil {
+				continue
+			}
+			if e.Updated.Before(since) {
+				done = true
+				break
+			}
+			entries = append(entries, e)
+		}
+		if done {
+			break
+		}
+	}
+
+	return entries, nil
+}
+
+type feedResponse struct {
+	Entries []*feedEntry `xml:"entry"`
+}
+
+type feedEntry struct {
+	Title    string `xml:"title"`
+	Id       string `xml:"id"`
+	Updated  string `xml:"updated"`
+	Category struct {
+		Term string `xml:"term,attr"`
+	} `xml:"category"`
+}
+
+// titles look like '10-Q - Apple Inc. (0000320193) (Filer)'
+var feedTitle = regexp.MustCompile(`\((\d{10})\) \(([A-Za-z ]+)\)$`)
+
+func (e *feedEntry) transform() (*client.FeedEntry, error) {
+
+	m := feedTitle.FindStringSubmatch(strings.TrimSpace(e.Title))
+	if m == nil {
+		return nil, errors.New("CIK could not be found in feed entry title")
+	}
+
+	// ids look like 'urn:tag:sec.gov,2008:accession-number=0000320193-24-000081'
+	_, acc, found := strings.Cut(e.Id, "accession-number=")
+	if !found {
+		return nil, errors.New("Accession number could not be found in feed entry id")
+	}
+
+	upd, err := time.Parse(time.RFC3339, strings.TrimSpace(e.Updated))
+	if err != nil {
+		return nil, err
+	}
+
+	return &client.FeedEntry{
+		Cik:     m[1],
+		Id:      strings.Replace(strings.TrimSpace(acc), "-", "", -1),
+		Form:    e.Category.Term,
+		Updated: upd,
+	}, nil
+}
+
+func (w *httpClient) get(ctx context.Context, url string) ([]byte, error) {
+	body, err := w.open(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// the caller has to close the returned body
+func (w *httpClient) open(ctx context.Context, url string) (io.ReadCloser, error) {
+	res, err := w.do(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// sends the request with the additional headers, responses which are neither successful
+// nor not modified are returned as error and the caller has to close the returned body
+func (w *httpClient) do(ctx context.Context, url string, header http.Header) (*http.Response, error) {
 
 	// build request
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.Header.Add("User-Agent", "example.com info@example.com")
 	req.Header.Add("Accept", "*/*")
 	req.Header.Add("Connection", "keep-alive")
 
 	// send request and respect rate limit
-	time.Sleep(200 * time.Millisecond)
+	err = w.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
 	res, err := w.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusNotModified {
+		return res, nil
+	}
 	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
 		return nil, errors.New(fmt.Sprintf("Got status code '%s'", res.Status))
 	}
 
-	return io.ReadAll(res.Body)
+	return res, nil
+}
+
+// reserves the next free slot so concurrent requests are spaced by the delay as well
+func (w *httpClient) wait(ctx context.Context) error {
+	w.mutex.Lock()
+	now := time.Now()
+	slot := now
+	if w.next.After(now) {
+		slot = w.next
+	}
+	w.next = slot.Add(w.delay)
+	w.mutex.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(slot.Sub(now)):
+		return nil
+	}
 }
@@ -0,0 +1,189 @@
+package httpclnt
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/adapter/client"
+	"github.com/finneas-io/data-pipeline/adapter/client/edgartest"
+)
+
+func TestGetFilings(t *testing.T) {
+
+	server := edgartest.NewServer("../../../testdata/edgar")
+	defer server.Close()
+	c := New(server.URL, server.URL, 0, 10*time.Second)
+
+	fils, err := c.GetFilings(context.Background(), "0000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the recent filings and the filings of the older page
+	forms := make(map[string]string)
+	for _, f := range fils {
+		forms[f.Id] = f.Form
+	}
+	if len(forms) != 3 || forms["000000000199000001"] != "10-Q" || forms["000000000124000001"] != "10-K" {
+		t.Errorf("Unexpected filings %v", forms)
+	}
+}
+
+func TestGetRecentFilings(t *testing.T) {
+
+	server := edgartest.NewServer("../../../testdata/edgar")
+	defer server.Close()
+	c := New(server.URL, server.URL, 0, 10*time.Second)
+
+	// older pages are not requested
+	subs, err := c.GetRecentFilings(context.Background(), "0000000001", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs.Filings) != 2 || subs.Filings[0].Id != "000000000124000002" || len(subs.ETag) < 1 {
+		t.Errorf("Unexpected recent filings %v with ETag '%s'", subs.Filings, subs.ETag)
+	}
+
+	// nothing changed since the first request
+	_, err = c.GetRecentFilings(context.Background(), "0000000001", subs.ETag)
+	if err != client.NotModifiedErr {
+		t.Errorf("Expected the submissions to be not modified but got %v", err)
+	}
+}
+
+func TestGetFiles(t *testing.T) {
+
+	server := edgartest.NewServer("../../../testdata/edgar")
+	defer server.Close()
+	c := New(server.URL, server.URL, 0, 10*time.Second)
+
+	files, err := c.GetFiles(context.Background(), "0000000001", "000000000124000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[string]string)
+	for _, f := range files {
+		types[f.Key] = f.Type
+		if f.LastModified.IsZero() {
+			t.Errorf("Last modified of '%s' is missing", f.Key)
+		}
+	}
+	if types["exmp-10k.htm"] != "10-K" || types["exmp-ex13.htm"] != "EX-13" || types["exmp-ex21.htm"] != "EX-21.1" {
+		t.Errorf("Unexpected document types %v", types)
+	}
+}
+
+func TestDocTypes(t *testing.T) {
+
+	row := func(doc, typ string) string {
+		return "<tr><td>1</td><td>Document</td><td>" + doc + "</td><td>" + typ + "</td><td>100</td></tr>"
+	}
+	cases := []struct {
+		name string
+		page string
+		want map[string]string
+	}{
+		{
+			name: "inline XBRL suffix",
+			page: `<table class="tableFile">` + row(`<a href="a.htm">a.htm</a> iXBRL`, "10-K") + `</table>`,
+			want: map[string]string{"a.htm": "10-K"},
+		},
+		{
+			name: "sub types of exhibits",
+			page: `<table class="tableFile">` + row("ex99.htm", " EX-99.1 ") + row("ex13.htm", "EX-13") + `</table>`,
+			want: map[string]string{"ex99.htm": "EX-99.1", "ex13.htm": "EX-13"},
+		},
+		{
+			name: "only document tables",
+			page: `<table class="tableFile">` + row("a.htm", "10-Q") + `</table><table>` + row("b.htm", "EX-13") + `</table>`,
+			want: map[string]string{"a.htm": "10-Q"},
+		},
+		{
+			name: "rows without a document",
+			page: `<table class="tableFile"><tr><th>Seq</th></tr>` + row("", "EX-13") + `</table>`,
+			want: map[string]string{},
+		},
+	}
+	for _, c := range cases {
+		types, err := docTypes([]byte(c.page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(types) != len(c.want) {
+			t.Errorf("%s: expected types %v but got %v", c.name, c.want, types)
+			continue
+		}
+		for k, v := range c.want {
+			if types[k] != v {
+				t.Errorf("%s: expected types %v but got %v", c.name, c.want, types)
+				break
+			}
+		}
+	}
+}
+
+func TestGetLatestFilings(t *testing.T) {
+
+	server := edgartest.NewServer("../../../testdata/edgar")
+	defer server.Close()
+	c := New(server.URL, server.URL, 0, 10*time.Second)
+
+	// the only entry of the feed was updated at 2024-02-01 20:30 UTC
+	tests := []struct {
+		form  string
+		since time.Time
+		want  []string
+	}{
+		{"10-K", time.Time{}, []string{"000000000124000001"}},
+		{"10-K", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), []string{"000000000124000001"}},
+		{"10-K", time.Date(2024, 2, 1, 20, 30, 0, 0, time.UTC), []string{"000000000124000001"}},
+		{"10-K", time.Date(2024, 2, 1, 20, 30, 1, 0, time.UTC), []string{}},
+		{"10-Q", time.Time{}, []string{}},
+	}
+
+	for _, test := range tests {
+		entries, err := c.GetLatestFilings(context.Background(), test.form, test.since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, e := range entries {
+			ids = append(ids, e.Id)
+			if e.Cik != "0000000001" || e.Form != test.form {
+				t.Errorf("Unexpected feed entry %+v", e)
+			}
+		}
+		if strings.Join(ids, ",") != strings.Join(test.want, ",") {
+			t.Errorf("Expected entries %v of '%s' since %s but got %v", test.want, test.form, test.since, ids)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+
+	server := edgartest.NewServer("../../../testdata/edgar")
+	defer server.Close()
+	c := New(server.URL, server.URL, 50*time.Millisecond, 10*time.Second)
+
+	// concurrent requests share the rate limit of the client
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.GetCompany(context.Background(), "0000000001"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected the requests to be spaced by the delay but they took %s", elapsed)
+	}
+}
@@ -1,35 +1,80 @@
 package database
 
 import (
+	"context"
 	"errors"
+	"time"
 
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/finneas-io/data-pipeline/adapter/queue"
 	"github.com/finneas-io/data-pipeline/domain/filing"
+	"github.com/finneas-io/data-pipeline/domain/job"
 	"github.com/finneas-io/data-pipeline/domain/user"
 	"github.com/google/uuid"
 )
 
 type Database interface {
 	Close() error
-	CreateBaseTables() error
-	InsertCompany(cmp *filing.Company) error
-	UpdateStoredFiling(id string) error
-	GetCompanies() ([]*filing.Company, error)
-	InsertFiling(cik string, fil *filing.Filing) error
-	GetFilings(cik string) (map[string]*filing.Filing, error)
-	InsertTable(filId string, table *filing.Table, data []byte) (uuid.UUID, error)
-	InsertCompTable(table *filing.Table, data []byte) error
-	GetAllTables(limit, page int) ([]*filing.Table, error)
-	GetCompTables(id string) ([]*filing.Table, error)
-	GetUser(username string) (*user.User, error)
-	InsertUser(user *user.User) error
-	UpdatePassword(user *user.User) error
-	InsertSession(sess *user.Session) error
-	DeleteSession(token string) error
-	GetSession(token string) (*user.Session, error)
-	GetRandomTables(userId uuid.UUID) ([]*filing.Company, error)
-	InsertLabel(tblId, userId uuid.UUID, label string) error
+	CreateBaseTables(ctx context.Context) error
+	InsertCompany(ctx context.Context, cmp *filing.Company) error
+	GetCompany(ctx context.Context, cik string) (*filing.Company, error)
+	UpdateCompany(ctx context.Context, cmp *filing.Company) error
+	UpdateStoredFiling(ctx context.Context, id string) error
+	GetCompanies(ctx context.Context) ([]*filing.Company, error)
+	TrackCompany(ctx context.Context, cik string) error
+	UntrackCompany(ctx context.Context, cik string) error
+	InsertFiling(ctx context.Context, cik string, fil *filing.Filing) error
+	GetFilings(ctx context.Context, cik string) (map[string]*filing.Filing, error)
+	GetFiling(ctx context.Context, id string) (*filing.Filing, error)
+	InsertTable(ctx context.Context, filId string, table *filing.Table, data []byte) (uuid.UUID, error)
+	InsertCompTable(ctx context.Context, table *filing.Table, data []byte) error
+	GetAllTables(ctx context.Context, limit, page int) ([]*filing.Table, error)
+	GetCompTables(ctx context.Context, id string) ([]*filing.Table, error)
+	GetUser(ctx context.Context, username string) (*user.User, error)
+	InsertUser(ctx context.Context, user *user.User) error
+	UpdatePassword(ctx context.Context, user *user.User) error
+	InsertSession(ctx context.Context, sess *user.Session) error
+	DeleteSession(ctx context.Context, token string) error
+	GetSession(ctx context.Context, token string) (*user.Session, error)
+	GetRandomTables(ctx context.Context, userId uuid.UUID) ([]*filing.Company, error)
+	InsertLabel(ctx context.Context, tblId, userId uuid.UUID, label string) error
+	GetCursor(ctx context.Context, name string) (time.Time, error)
+	UpdateCursor(ctx context.Context, name string, pos time.Time) error
+	InsertDeadLetter(ctx context.Context, dl *queue.DeadLetter) error
+	GetDeadLetters(ctx context.Context, queue string) ([]*queue.DeadLetter, error)
+	DeleteDeadLetter(ctx context.Context, id string) error
+	UpdateFilingStatus(ctx context.Context, id string, status filing.Status, cause string) error
+	UpdateCompressedFilings(ctx context.Context) (int, error)
+	GetFilingStatuses(ctx context.Context, filter *FilingFilter) ([]*filing.Progress, error)
+	CountFilingStatuses(ctx context.Context) (map[string]map[filing.Status]int, error)
+	GetSyncState(ctx context.Context, cik string) (*filing.SyncState, error)
+	UpdateSyncState(ctx context.Context, state *filing.SyncState) error
+	DeleteExpiredSessions(ctx context.Context) (int, error)
+	TryLock(ctx context.Context, name string) (func(), error)
+	InsertJobRun(ctx context.Context, run *job.Run) error
+	UpdateJobRun(ctx context.Context, run *job.Run) error
+	GetJobRuns(ctx context.Context, name string, limit int) ([]*job.Run, error)
+	InsertArchive(ctx context.Context, arc *bucket.Archive) error
+	GetArchive(ctx context.Context, vault, key string) (*bucket.Archive, error)
+	GetArchives(ctx context.Context, vault, prefix string) ([]*bucket.Archive, error)
+	UpdateRetrieval(ctx context.Context, ret *bucket.Retrieval) error
+	GetRetrieval(ctx context.Context, vault, key string) (*bucket.Retrieval, error)
+	InsertArchivedFile(ctx context.Context, file *filing.ArchivedFile) error
+	GetArchivedFiles(ctx context.Context, filter *FilingFilter) ([]*filing.ArchivedFile, error)
+}
+
+// conditions of a filing query, empty fields match every filing
+type FilingFilter struct {
+	Ids      []string // accession numbers
+	Cik      string
+	Form     string
+	Statuses []filing.Status
+	Since    time.Time // filed on or after
+	Until    time.Time // filed before
+	Limit    int
 }
 
 var DuplicateErr error = errors.New("Duplicate key error")
 var InvalidRefErr error = errors.New("Foreign key reference does not exist")
 var NotFoundErr error = errors.New("Key not found error")
+var LockedErr error = errors.New("Lock is held by someone else")
@@ -0,0 +1,891 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+	"github.com/finneas-io/data-pipeline/domain/filing"
+	"github.com/finneas-io/data-pipeline/domain/job"
+	"github.com/finneas-io/data-pipeline/domain/user"
+	"github.com/google/uuid"
+)
+
+// in-memory stand-in for the postgres adapter which keeps the same constraints,
+// it is meant for tests and local runs where nothing has to be persisted
+type memory struct {
+	mu        sync.Mutex
+	companies map[string]*company
+	filings   map[string]*filingRow
+	tables    map[uuid.UUID]*tableRow
+	compTbls  map[uuid.UUID]*filing.Table
+	users     map[string]*user.User
+	sessions  map[string]*user.Session
+	labels    map[uuid.UUID]map[uuid.UUID]string
+	cursors   map[string]time.Time
+	dead      map[string]*queue.DeadLetter
+	syncs     map[string]*filing.SyncState
+	locks     map[string]bool
+	runs      []*job.Run
+	archives  map[string]*bucket.Archive
+	retrieves map[string]*bucket.Retrieval
+	archived  map[string]*filing.ArchivedFile
+}
+
+type company struct {
+	cmp     *filing.Company
+	tracked bool
+}
+
+type filingRow struct {
+	cik    string
+	fil    *filing.Filing
+	stored bool
+	prog   filing.Progress
+}
+
+type tableRow struct {
+	filId string
+	tbl   *filing.Table
+	data  []byte
+}
+
+func New() *memory {
+	return &memory{
+		companies: make(map[string]*company),
+		filings:   make(map[string]*filingRow),
+		tables:    make(map[uuid.UUID]*tableRow),
+		compTbls:  make(map[uuid.UUID]*filing.Table),
+		users:     make(map[string]*user.User),
+		sessions:  make(map[string]*user.Session),
+		labels:    make(map[uuid.UUID]map[uuid.UUID]string),
+		cursors:   make(map[string]time.Time),
+		dead:      make(map[string]*queue.DeadLetter),
+		syncs:     make(map[string]*filing.SyncState),
+		locks:     make(map[string]bool),
+		archives:  make(map[string]*bucket.Archive),
+		retrieves: make(map[string]*bucket.Retrieval),
+		archived:  make(map[string]*filing.ArchivedFile),
+	}
+}
+
+func (db *memory) Close() error {
+	return nil
+}
+
+func (db *memory) CreateBaseTables(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (db *memory) InsertCompany(ctx context.Context, cmp *filing.Company) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// like in postgres only the forms of an existing company are updated
+	if c, ok := db.companies[cmp.Cik]; ok {
+		if len(cmp.Forms) > 0 {
+			c.cmp.Forms = append([]string(nil), cmp.Forms...)
+		}
+		return nil
+	}
+	db.companies[cmp.Cik] = &company{cmp: copyCompany(cmp), tracked: true}
+	return nil
+}
+
+func (db *memory) GetCompany(ctx context.Context, cik string) (*filing.Company, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, ok := db.companies[cik]
+	if !ok {
+		return nil, database.NotFoundErr
+	}
+	return copyCompany(c.cmp), nil
+}
+
+func (db *memory) UpdateCompany(ctx context.Context, cmp *filing.Company) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, ok := db.companies[cmp.Cik]
+	if !ok {
+		return database.NotFoundErr
+	}
+	forms := c.cmp.Forms
+	c.cmp = copyCompany(cmp)
+	c.cmp.Forms = forms
+	return nil
+}
+
+func (db *memory) UpdateStoredFiling(ctx context.Context, id string) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if f, ok := db.filings[id]; ok {
+		f.stored = true
+	}
+	return nil
+}
+
+func (db *memory) GetCompanies(ctx context.Context) ([]*filing.Company, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cmps := []*filing.Company{}
+	for _, c := range db.companies {
+		if c.tracked {
+			cmps = append(cmps, copyCompany(c.cmp))
+		}
+	}
+	sort.Slice(cmps, func(i, j int) bool { return cmps[i].Cik < cmps[j].Cik })
+	return cmps, nil
+}
+
+func (db *memory) TrackCompany(ctx context.Context, cik string) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, ok := db.companies[cik]
+	if !ok {
+		return database.NotFoundErr
+	}
+	c.tracked = true
+	return nil
+}
+
+func (db *memory) UntrackCompany(ctx context.Context, cik string) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, ok := db.companies[cik]
+	if !ok {
+		return database.NotFoundErr
+	}
+	c.tracked = false
+	return nil
+}
+
+func (db *memory) InsertFiling(ctx context.Context, cik string, fil *filing.Filing) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.companies[cik]; !ok {
+		return database.InvalidRefErr
+	}
+	if _, ok := db.filings[fil.Id]; ok {
+		return nil
+	}
+	db.filings[fil.Id] = &filingRow{
+		cik: cik,
+		fil: &filing.Filing{
+			Id:         fil.Id,
+			Form:       fil.Form,
+			FilingDate: fil.FilingDate,
+			ReportDate: fil.ReportDate,
+			Amends:     fil.Amends,
+			MainFile:   &filing.File{Key: fil.MainFile.Key, LastModified: fil.MainFile.LastModified},
+		},
+		prog: filing.Progress{
+			Id:         fil.Id,
+			Cik:        cik,
+			Form:       fil.Form,
+			FilingDate: fil.FilingDate,
+			Status:     filing.Discovered,
+		},
+	}
+	return nil
+}
+
+func (db *memory) GetFilings(ctx context.Context, cik string) (map[string]*filing.Filing, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	fils := make(map[string]*filing.Filing)
+	for id, f := range db.filings {
+		if f.cik == cik && f.stored {
+			fils[id] = &filing.Filing{Id: id}
+		}
+	}
+	return fils, nil
+}
+
+func (db *memory) GetFiling(ctx context.Context, id string) (*filing.Filing, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	f, ok := db.filings[id]
+	if !ok {
+		return nil, database.NotFoundErr
+	}
+	fil := *f.fil
+	fil.Cik = f.cik
+	fil.MainFile = &filing.File{Key: f.fil.MainFile.Key}
+	return &fil, nil
+}
+
+func (db *memory) InsertTable(ctx context.Context, filId string, table *filing.Table, data []byte) (uuid.UUID, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.filings[filId]; !ok {
+		return uuid.UUID{}, database.InvalidRefErr
+	}
+	for _, t := range db.tables {
+		if t.filId == filId && t.tbl.Index == table.Index {
+			return uuid.UUID{}, database.DuplicateErr
+		}
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	db.tables[id] = &tableRow{
+		filId: filId,
+		tbl: &filing.Table{
+			Id:        id,
+			Index:     table.Index,
+			Factor:    table.Factor,
+			FileKey:   table.FileKey,
+			HeadIndex: table.HeadIndex,
+			RawData:   table.RawData,
+		},
+		data: data,
+	}
+	return id, nil
+}
+
+func (db *memory) InsertCompTable(ctx context.Context, table *filing.Table, data []byte) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.tables[table.Id]; !ok {
+		return database.InvalidRefErr
+	}
+	if _, ok := db.compTbls[table.Id]; ok {
+		return database.DuplicateErr
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return err
+	}
+	comp := &filing.Table{Id: id, OriginalId: table.Id, Factor: table.Factor, HeadIndex: table.HeadIndex}
+	if err := json.Unmarshal(data, &comp.CompData); err != nil {
+		return err
+	}
+	db.compTbls[table.Id] = comp
+	return nil
+}
+
+func (db *memory) GetAllTables(ctx context.Context, limit, page int) ([]*filing.Table, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rows := db.sortedTables()
+	tables := []*filing.Table{}
+	for i := page * limit; i < len(rows) && i < (page+1)*limit; i++ {
+		tbl := *rows[i].tbl
+		if err := json.Unmarshal(rows[i].data, &tbl.Data); err != nil {
+			return nil, err
+		}
+		tables = append(tables, &tbl)
+	}
+	return tables, nil
+}
+
+func (db *memory) GetCompTables(ctx context.Context, id string) ([]*filing.Table, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tbls := []*filing.Table{}
+	for _, t := range db.tables {
+		comp, ok := db.compTbls[t.tbl.Id]
+		if t.filId != id || !ok {
+			continue
+		}
+		tbl := *comp
+		tbl.Index = t.tbl.Index
+		tbls = append(tbls, &tbl)
+	}
+	sort.Slice(tbls, func(i, j int) bool { return tbls[i].Index < tbls[j].Index })
+	return tbls, nil
+}
+
+func (db *memory) GetUser(ctx context.Context, username string) (*user.User, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.users[username]
+	if !ok {
+		return nil, database.NotFoundErr
+	}
+	copied := *u
+	return &copied, nil
+}
+
+func (db *memory) InsertUser(ctx context.Context, user *user.User) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.users[user.Username]; ok {
+		return database.DuplicateErr
+	}
+	copied := *user
+	db.users[user.Username] = &copied
+	return nil
+}
+
+func (db *memory) UpdatePassword(ctx context.Context, user *user.User) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, u := range db.users {
+		if u.Id == user.Id {
+			u.Password = user.Password
+			return nil
+		}
+	}
+	return database.NotFoundErr
+}
+
+func (db *memory) InsertSession(ctx context.Context, sess *user.Session) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.sessions[sess.Token]; ok {
+		return database.DuplicateErr
+	}
+	db.sessions[sess.Token] = &user.Session{
+		Token:     sess.Token,
+		User:      &user.User{Id: sess.User.Id},
+		ExpiresAt: sess.ExpiresAt,
+	}
+	return nil
+}
+
+func (db *memory) DeleteSession(ctx context.Context, token string) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.sessions[token]; !ok {
+		return database.NotFoundErr
+	}
+	delete(db.sessions, token)
+	return nil
+}
+
+func (db *memory) GetSession(ctx context.Context, token string) (*user.Session, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	sess, ok := db.sessions[token]
+	if !ok {
+		return nil, database.NotFoundErr
+	}
+	return &user.Session{Token: token, User: &user.User{Id: sess.User.Id}, ExpiresAt: sess.ExpiresAt}, nil
+}
+
+func (db *memory) GetRandomTables(ctx context.Context, userId uuid.UUID) ([]*filing.Company, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cmps := []*filing.Company{}
+	for _, t := range db.sortedTables() {
+		if _, ok := db.labels[t.tbl.Id][userId]; ok {
+			continue
+		}
+		f := db.filings[t.filId]
+		key := t.tbl.FileKey
+		if len(key) < 1 {
+			key = f.fil.MainFile.Key
+		}
+		cmps = append(cmps, &filing.Company{
+			Cik:  f.cik,
+			Name: db.companies[f.cik].cmp.Name,
+			Filings: []*filing.Filing{{
+				Id:         f.fil.Id,
+				Form:       f.fil.Form,
+				FilingDate: f.fil.FilingDate,
+				MainFile:   &filing.File{Key: key},
+				Tables:     []*filing.Table{{Id: t.tbl.Id, Index: t.tbl.Index, RawData: t.tbl.RawData}},
+			}},
+		})
+	}
+
+	rand.Shuffle(len(cmps), func(i, j int) { cmps[i], cmps[j] = cmps[j], cmps[i] })
+	if len(cmps) > 100 {
+		cmps = cmps[:100]
+	}
+	return cmps, nil
+}
+
+func (db *memory) InsertLabel(ctx context.Context, tblId, userId uuid.UUID, label string) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.tables[tblId]; !ok {
+		return database.InvalidRefErr
+	}
+	if db.labels[tblId] == nil {
+		db.labels[tblId] = make(map[uuid.UUID]string)
+	}
+	if _, ok := db.labels[tblId][userId]; ok {
+		return database.DuplicateErr
+	}
+	db.labels[tblId][userId] = label
+	return nil
+}
+
+func (db *memory) GetCursor(ctx context.Context, name string) (time.Time, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	pos, ok := db.cursors[name]
+	if !ok {
+		return time.Time{}, database.NotFoundErr
+	}
+	return pos, nil
+}
+
+func (db *memory) UpdateCursor(ctx context.Context, name string, pos time.Time) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.cursors[name] = pos
+	return nil
+}
+
+func (db *memory) InsertDeadLetter(ctx context.Context, dl *queue.DeadLetter) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.dead[dl.Id]; ok {
+		return database.DuplicateErr
+	}
+	copied := *dl
+	db.dead[dl.Id] = &copied
+	return nil
+}
+
+func (db *memory) GetDeadLetters(ctx context.Context, name string) ([]*queue.DeadLetter, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	dls := []*queue.DeadLetter{}
+	for _, dl := range db.dead {
+		if name == "" || dl.Queue == name {
+			copied := *dl
+			dls = append(dls, &copied)
+		}
+	}
+	sort.Slice(dls, func(i, j int) bool { return dls[i].CreatedAt.Before(dls[j].CreatedAt) })
+	return dls, nil
+}
+
+func (db *memory) DeleteDeadLetter(ctx context.Context, id string) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.dead[id]; !ok {
+		return database.NotFoundErr
+	}
+	delete(db.dead, id)
+	return nil
+}
+
+func (db *memory) UpdateFilingStatus(ctx context.Context, id string, status filing.Status, cause string) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	f, ok := db.filings[id]
+	if !ok {
+		return database.NotFoundErr
+	}
+	if !f.prog.Status.CanBecome(status) {
+		return nil
+	}
+
+	if status == filing.Failed {
+		if f.prog.Status != filing.Failed {
+			f.prog.LastStatus = f.prog.Status
+		}
+		f.prog.Error = cause
+		f.prog.Attempts++
+	} else {
+		f.prog.LastStatus = ""
+		f.prog.Error = ""
+	}
+	f.prog.Status = status
+	f.prog.UpdatedAt = time.Now()
+	return nil
+}
+
+func (db *memory) UpdateCompressedFilings(ctx context.Context) (int, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	compressed := make(map[string]bool)
+	for id, f := range db.filings {
+		if f.prog.Status == filing.Archived {
+			compressed[id] = true
+		}
+	}
+	for _, t := range db.tables {
+		if _, ok := db.compTbls[t.tbl.Id]; !ok {
+			delete(compressed, t.filId)
+		}
+	}
+	for id := range compressed {
+		db.filings[id].prog.Status = filing.Compressed
+		db.filings[id].prog.UpdatedAt = time.Now()
+	}
+	return len(compressed), nil
+}
+
+func (db *memory) GetFilingStatuses(ctx context.Context, filter *database.FilingFilter) ([]*filing.Progress, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	progs := []*filing.Progress{}
+	for _, f := range db.filings {
+		p := f.prog
+		if len(filter.Ids) > 0 && !slices.Contains(filter.Ids, p.Id) {
+			continue
+		}
+		if filter.Cik != "" && p.Cik != filter.Cik {
+			continue
+		}
+		if filter.Form != "" && p.Form != filter.Form {
+			continue
+		}
+		if len(filter.Statuses) > 0 && !slices.Contains(filter.Statuses, p.Status) {
+			continue
+		}
+		if !filter.Since.IsZero() && p.FilingDate.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && !p.FilingDate.Before(filter.Until) {
+			continue
+		}
+		for _, t := range db.tables {
+			if t.filId == p.Id {
+				p.Tables++
+			}
+		}
+		progs = append(progs, &p)
+	}
+	sort.Slice(progs, func(i, j int) bool {
+		if !progs[i].UpdatedAt.Equal(progs[j].UpdatedAt) {
+			return progs[i].UpdatedAt.After(progs[j].UpdatedAt)
+		}
+		return progs[i].Id < progs[j].Id
+	})
+	if filter.Limit > 0 && len(progs) > filter.Limit {
+		progs = progs[:filter.Limit]
+	}
+	return progs, nil
+}
+
+func (db *memory) CountFilingStatuses(ctx context.Context) (map[string]map[filing.Status]int, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	counts := make(map[string]map[filing.Status]int)
+	for _, f := range db.filings {
+		if counts[f.cik] == nil {
+			counts[f.cik] = make(map[filing.Status]int)
+		}
+		counts[f.cik][f.prog.Status]++
+	}
+	return counts, nil
+}
+
+func (db *memory) GetSyncState(ctx context.Context, cik string) (*filing.SyncState, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	state, ok := db.syncs[cik]
+	if !ok {
+		return nil, database.NotFoundErr
+	}
+	copied := *state
+	return &copied, nil
+}
+
+func (db *memory) UpdateSyncState(ctx context.Context, state *filing.SyncState) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.companies[state.Cik]; !ok {
+		return database.InvalidRefErr
+	}
+	copied := *state
+	db.syncs[state.Cik] = &copied
+	return nil
+}
+
+func (db *memory) DeleteExpiredSessions(ctx context.Context) (int, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	count := 0
+	for token, sess := range db.sessions {
+		if sess.ExpiresAt.Before(time.Now()) {
+			delete(db.sessions, token)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// locks are only shared within the process
+func (db *memory) TryLock(ctx context.Context, name string) (func(), error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.locks[name] {
+		return nil, database.LockedErr
+	}
+	db.locks[name] = true
+	return func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		delete(db.locks, name)
+	}, nil
+}
+
+func (db *memory) InsertJobRun(ctx context.Context, run *job.Run) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	run.Id = int64(len(db.runs) + 1)
+	copied := *run
+	db.runs = append(db.runs, &copied)
+	return nil
+}
+
+func (db *memory) UpdateJobRun(ctx context.Context, run *job.Run) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if run.Id < 1 || int(run.Id) > len(db.runs) {
+		return database.NotFoundErr
+	}
+	copied := *run
+	copied.Counts = maps.Clone(run.Counts)
+	db.runs[run.Id-1] = &copied
+	return nil
+}
+
+func (db *memory) GetJobRuns(ctx context.Context, name string, limit int) ([]*job.Run, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	runs := []*job.Run{}
+	for i := len(db.runs) - 1; i >= 0; i-- {
+		if limit > 0 && len(runs) >= limit {
+			break
+		}
+		if name == "" || db.runs[i].Job == name {
+			copied := *db.runs[i]
+			copied.Counts = maps.Clone(db.runs[i].Counts)
+			runs = append(runs, &copied)
+		}
+	}
+	return runs, nil
+}
+
+func (db *memory) InsertArchive(ctx context.Context, arc *bucket.Archive) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	copied := *arc
+	db.archives[arc.Vault+"/"+arc.Key] = &copied
+	return nil
+}
+
+func (db *memory) GetArchive(ctx context.Context, vault, key string) (*bucket.Archive, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	arc, ok := db.archives[vault+"/"+key]
+	if !ok {
+		return nil, database.NotFoundErr
+	}
+	copied := *arc
+	return &copied, nil
+}
+
+func (db *memory) GetArchives(ctx context.Context, vault, prefix string) ([]*bucket.Archive, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	arcs := []*bucket.Archive{}
+	for _, arc := range db.archives {
+		if arc.Vault == vault && strings.HasPrefix(arc.Key, prefix) {
+			copied := *arc
+			arcs = append(arcs, &copied)
+		}
+	}
+	sort.Slice(arcs, func(i, j int) bool { return arcs[i].Key < arcs[j].Key })
+	return arcs, nil
+}
+
+func (db *memory) UpdateRetrieval(ctx context.Context, ret *bucket.Retrieval) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	copied := *ret
+	db.retrieves[ret.Vault+"/"+ret.Key] = &copied
+	return nil
+}
+
+func (db *memory) GetRetrieval(ctx context.Context, vault, key string) (*bucket.Retrieval, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ret, ok := db.retrieves[vault+"/"+key]
+	if !ok {
+		return nil, database.NotFoundErr
+	}
+	copied := *ret
+	return &copied, nil
+}
+
+func (db *memory) InsertArchivedFile(ctx context.Context, file *filing.ArchivedFile) error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.filings[file.FilingId]; !ok {
+		return database.InvalidRefErr
+	}
+	copied := *file
+	db.archived[file.FilingId+"/"+file.Key] = &copied
+	return nil
+}
+
+func (db *memory) GetArchivedFiles(ctx context.Context, filter *database.FilingFilter) ([]*filing.ArchivedFile, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	files := []*filing.ArchivedFile{}
+	for _, file := range db.archived {
+		// receipts go away with their filing like the foreign key cascades
+		row, ok := db.filings[file.FilingId]
+		if !ok {
+			continue
+		}
+		p := row.prog
+		if len(filter.Ids) > 0 && !slices.Contains(filter.Ids, p.Id) {
+			continue
+		}
+		if filter.Cik != "" && p.Cik != filter.Cik {
+			continue
+		}
+		if filter.Form != "" && p.Form != filter.Form {
+			continue
+		}
+		if len(filter.Statuses) > 0 && !slices.Contains(filter.Statuses, p.Status) {
+			continue
+		}
+		if !filter.Since.IsZero() && p.FilingDate.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && !p.FilingDate.Before(filter.Until) {
+			continue
+		}
+		copied := *file
+		files = append(files, &copied)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].FilingId != files[j].FilingId {
+			return files[i].FilingId < files[j].FilingId
+		}
+		return files[i].Key < files[j].Key
+	})
+	if filter.Limit > 0 && len(files) > filter.Limit {
+		files = files[:filter.Limit]
+	}
+	return files, nil
+}
+
+// Helper Functions
+
+// table ids are version 7 UUIDs so ordering them orders by insertion
+func (db *memory) sortedTables() []*tableRow {
+	rows := []*tableRow{}
+	for _, t := range db.tables {
+		rows = append(rows, t)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].tbl.Id.String() < rows[j].tbl.Id.String()
+	})
+	return rows
+}
+
+func copyCompany(cmp *filing.Company) *filing.Company {
+	c := *cmp
+	c.Filings = nil
+	c.Forms = append([]string(nil), cmp.Forms...)
+	c.Tickers = nil
+	for _, t := range cmp.Tickers {
+		copied := *t
+		c.Tickers = append(c.Tickers, &copied)
+	}
+	return &c
+}
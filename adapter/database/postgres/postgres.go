@@ -3,33 +3,40 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
 	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/queue"
 	"github.com/finneas-io/data-pipeline/domain/filing"
+	"github.com/finneas-io/data-pipeline/domain/job"
 	"github.com/finneas-io/data-pipeline/domain/user"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type postgres struct {
-	conn *pgxpool.Pool
+	conn    *pgxpool.Pool
+	timeout time.Duration
 }
 
-func New(host, port, name, user, pass string) (*postgres, error) {
+// every database operation is cancelled after the timeout if it is greater than zero
+func New(ctx context.Context, host, port, name, user, pass string, timeout time.Duration) (*postgres, error) {
 
 	conn, err := pgxpool.New(
-		context.Background(),
+		ctx,
 		fmt.Sprintf("postgres://%s:%s@%s:%s/%s", user, pass, host, port, name),
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	return &postgres{conn: conn}, nil
+	return &postgres{conn: conn, timeout: timeout}, nil
 }
 
 func (db *postgres) Close() error {
@@ -37,9 +44,12 @@ func (db *postgres) Close() error {
 	return nil
 }
 
-func (db *postgres) CreateBaseTables() error {
+func (db *postgres) CreateBaseTables(ctx context.Context) error {
 
-	_, err := db.conn.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS company (
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS company (
 		cik VARCHAR(10) PRIMARY KEY,
 		name VARCHAR(100) NOT NULL
 	);`)
@@ -47,7 +57,7 @@ func (db *postgres) CreateBaseTables() error {
 		return err
 	}
 
-	_, err = db.conn.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS ticker (
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS ticker (
 		id SERIAL PRIMARY KEY,
 		company_cik VARCHAR(10) REFERENCES company(cik) ON DELETE CASCADE,
 		value VARCHAR(10) UNIQUE NOT NULL,
@@ -57,7 +67,7 @@ func (db *postgres) CreateBaseTables() error {
 		return err
 	}
 
-	_, err = db.conn.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS filing (
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS filing (
 		id VARCHAR(20) PRIMARY KEY,
 		company_cik VARCHAR(10) REFERENCES company(cik) ON DELETE CASCADE,
 		form VARCHAR(20) NOT NULL,
@@ -70,7 +80,7 @@ func (db *postgres) CreateBaseTables() error {
 		return err
 	}
 
-	_, err = db.conn.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS "table" (
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS "table" (
 		id UUID PRIMARY KEY,
 		filing_id VARCHAR(20) REFERENCES filing(id) ON DELETE CASCADE,
 		header_index INTEGER NOT NULL,
@@ -84,7 +94,7 @@ func (db *postgres) CreateBaseTables() error {
 		return err
 	}
 
-	_, err = db.conn.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS compressed_table (
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS compressed_table (
 		id UUID PRIMARY KEY,
 		original_id UUID REFERENCES "table"(id) ON DELETE CASCADE UNIQUE,
 		factor VARCHAR(20) NOT NULL,
@@ -95,7 +105,7 @@ func (db *postgres) CreateBaseTables() error {
 		return err
 	}
 
-	_, err = db.conn.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS "user" (
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS "user" (
 		id UUID PRIMARY KEY,
 		username VARCHAR(100) NOT NULL UNIQUE,
 		password VARCHAR(100)
@@ -104,7 +114,7 @@ func (db *postgres) CreateBaseTables() error {
 		return err
 	}
 
-	_, err = db.conn.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS "session" (
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS "session" (
 		token VARCHAR(100) PRIMARY KEY,
 		user_id UUID REFERENCES "user"(id) ON DELETE CASCADE,
 		expires_at TIMESTAMP NOT NULL
@@ -113,7 +123,7 @@ func (db *postgres) CreateBaseTables() error {
 		return err
 	}
 
-	_, err = db.conn.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS table_label (
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS table_label (
 		table_id UUID REFERENCES "table"(id) ON DELETE CASCADE,
 		user_id UUID REFERENCES "user"(id) ON DELETE CASCADE,
 		label VARCHAR(100) NOT NULL,
@@ -123,226 +133,782 @@ func (db *postgres) CreateBaseTables() error {
 		return err
 	}
 
-	return nil
-}
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS cursor (
+		name VARCHAR(50) PRIMARY KEY,
+		position TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
 
-func (db *postgres) InsertCompany(cmp *filing.Company) error {
+	_, err = db.conn.Exec(ctx, `ALTER TABLE company ADD COLUMN IF NOT EXISTS forms TEXT[] DEFAULT NULL;`)
+	if err != nil {
+		return err
+	}
 
-	_, err := db.conn.Exec(context.Background(), `INSERT INTO company (cik, name) VALUES ($1, $2);`, cmp.Cik, cmp.Name)
-	err = errorWrapper(err)
-	if err != nil && err != database.DuplicateErr {
+	_, err = db.conn.Exec(ctx, `ALTER TABLE filing ADD COLUMN IF NOT EXISTS report_date TIMESTAMP DEFAULT NULL;`)
+	if err != nil {
 		return err
 	}
 
-	for _, t := range cmp.Tickers {
-		_, err := db.conn.Exec(
-			context.Background(),
-			`INSERT INTO ticker (company_cik, value, exchange) VALUES ($1, $2, $3);`,
-			cmp.Cik,
-			t.Value,
-			t.Exchange,
-		)
-		err = errorWrapper(err)
-		if err != nil && err != database.DuplicateErr {
-			return err
-		}
+	_, err = db.conn.Exec(ctx, `ALTER TABLE filing ADD COLUMN IF NOT EXISTS amends VARCHAR(20) DEFAULT NULL;`)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	_, err = db.conn.Exec(ctx, `ALTER TABLE "table" ADD COLUMN IF NOT EXISTS file_key VARCHAR(200) DEFAULT NULL;`)
+	if err != nil {
+		return err
+	}
 
-func (db *postgres) GetCompanies() ([]*filing.Company, error) {
+	_, err = db.conn.Exec(ctx, `ALTER TABLE company ADD COLUMN IF NOT EXISTS tracked BOOLEAN DEFAULT true;`)
+	if err != nil {
+		return err
+	}
 
-	rows, err := db.conn.Query(context.Background(), `SELECT cik FROM company;`)
+	_, err = db.conn.Exec(ctx, `ALTER TABLE company ADD COLUMN IF NOT EXISTS sic VARCHAR(10) DEFAULT NULL;`)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
 
-	cmps := []*filing.Company{}
-	for rows.Next() {
-		c := &filing.Company{}
-		if err := rows.Scan(&c.Cik); err != nil {
-			return nil, err
-		}
-		cmps = append(cmps, c)
+	_, err = db.conn.Exec(ctx, `ALTER TABLE company ADD COLUMN IF NOT EXISTS industry VARCHAR(200) DEFAULT NULL;`)
+	if err != nil {
+		return err
 	}
 
-	return cmps, nil
-}
+	_, err = db.conn.Exec(ctx, `ALTER TABLE company ADD COLUMN IF NOT EXISTS incorporation VARCHAR(10) DEFAULT NULL;`)
+	if err != nil {
+		return err
+	}
 
-func (db *postgres) InsertFiling(cik string, fil *filing.Filing) error {
+	_, err = db.conn.Exec(ctx, `ALTER TABLE company ADD COLUMN IF NOT EXISTS fiscal_year_end VARCHAR(4) DEFAULT NULL;`)
+	if err != nil {
+		return err
+	}
 
-	_, err := db.conn.Exec(
-		context.Background(),
-		`INSERT INTO filing (id, company_cik, form, filing_date, last_modified, original_file) 
-			VALUES ($1, $2, $3, $4, $5, $6);`,
-		fil.Id,
-		cik,
-		fil.Form,
-		nullTime(fil.FilingDate),
-		nullTime(fil.MainFile.LastModified),
-		fil.MainFile.Key,
-	)
+	_, err = db.conn.Exec(ctx, `ALTER TABLE company ADD COLUMN IF NOT EXISTS ein VARCHAR(20) DEFAULT NULL;`)
+	if err != nil {
+		return err
+	}
 
+	_, err = db.conn.Exec(ctx, `ALTER TABLE company ADD COLUMN IF NOT EXISTS addresses JSONB DEFAULT NULL;`)
 	if err != nil {
-		err = errorWrapper(err)
-		// filing might already be stored in which case we are happi big time :)
-		if err == database.DuplicateErr {
-			return nil
-		}
 		return err
 	}
 
-	return nil
-}
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS company_history (
+		id SERIAL PRIMARY KEY,
+		company_cik VARCHAR(10) REFERENCES company(cik) ON DELETE CASCADE,
+		name VARCHAR(100) NOT NULL,
+		sic VARCHAR(10) DEFAULT NULL,
+		industry VARCHAR(200) DEFAULT NULL,
+		incorporation VARCHAR(10) DEFAULT NULL,
+		fiscal_year_end VARCHAR(4) DEFAULT NULL,
+		ein VARCHAR(20) DEFAULT NULL,
+		tickers JSONB DEFAULT NULL,
+		addresses JSONB DEFAULT NULL,
+		valid_from TIMESTAMP NOT NULL,
+		valid_to TIMESTAMP DEFAULT NULL
+	);`)
+	if err != nil {
+		return err
+	}
 
-func (db *postgres) UpdateStoredFiling(id string) error {
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS former_name (
+		company_cik VARCHAR(10) REFERENCES company(cik) ON DELETE CASCADE,
+		name VARCHAR(100) NOT NULL,
+		valid_from TIMESTAMP DEFAULT NULL,
+		valid_to TIMESTAMP DEFAULT NULL,
+		PRIMARY KEY (company_cik, name)
+	);`)
+	if err != nil {
+		return err
+	}
 
-	_, err := db.conn.Exec(
-		context.Background(),
-		`UPDATE filing SET fully_stored = true WHERE id = $1;`,
-		id,
-	)
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS dead_letter (
+		id VARCHAR(50) PRIMARY KEY,
+		queue VARCHAR(50) NOT NULL,
+		body BYTEA NOT NULL,
+		deliveries INTEGER NOT NULL,
+		error TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
 
-	return err
-}
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS queue_message (
+		id BIGSERIAL PRIMARY KEY,
+		queue VARCHAR(50) NOT NULL,
+		body BYTEA NOT NULL,
+		priority BIGINT NOT NULL DEFAULT 0,
+		deliveries INTEGER NOT NULL DEFAULT 0,
+		visible_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);`)
+	if err != nil {
+		return err
+	}
 
-// we return a map so we can compare which filings are still missing (faster than a list)
-func (db *postgres) GetFilings(cik string) (map[string]*filing.Filing, error) {
+	_, err = db.conn.Exec(ctx, `CREATE INDEX IF NOT EXISTS queue_message_next ON queue_message (queue, priority DESC, id);`)
+	if err != nil {
+		return err
+	}
 
-	rows, err := db.conn.Query(
-		context.Background(),
-		`SELECT id FROM filing WHERE filing.company_cik = $1 AND filing.fully_stored = true;`,
-		cik,
-	)
+	_, err = db.conn.Exec(ctx, `ALTER TABLE filing ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'discovered';`)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
 
-	fils := make(map[string]*filing.Filing)
-	for rows.Next() {
-		f := &filing.Filing{}
-		if err := rows.Scan(&f.Id); err != nil {
-			return nil, err
-		}
-		fils[f.Id] = f
+	_, err = db.conn.Exec(ctx, `ALTER TABLE filing ADD COLUMN IF NOT EXISTS last_status VARCHAR(20) DEFAULT NULL;`)
+	if err != nil {
+		return err
 	}
 
-	return fils, nil
-}
+	_, err = db.conn.Exec(ctx, `ALTER TABLE filing ADD COLUMN IF NOT EXISTS error TEXT DEFAULT NULL;`)
+	if err != nil {
+		return err
+	}
 
-func (db *postgres) InsertTable(filId string, table *filing.Table, data []byte) (uuid.UUID, error) {
+	_, err = db.conn.Exec(ctx, `ALTER TABLE filing ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return err
+	}
 
-	id, err := uuid.NewV7()
+	_, err = db.conn.Exec(ctx, `ALTER TABLE filing ADD COLUMN IF NOT EXISTS status_at TIMESTAMP DEFAULT NULL;`)
 	if err != nil {
-		return uuid.UUID{}, err
+		return err
 	}
 
-	_, err = db.conn.Exec(
-		context.Background(),
-		`INSERT INTO "table" (id, filing_id, index, factor, header_index, raw_data, data) 
-			VALUES ($1, $2, $3, $4, $5, $6, $7);`,
-		id,
-		filId,
-		table.Index,
-		table.Factor,
-		table.HeadIndex,
-		table.RawData,
-		data,
-	)
+	_, err = db.conn.Exec(ctx, `UPDATE filing SET status = 'archived' WHERE fully_stored = true AND status = 'discovered';`)
+	if err != nil {
+		return err
+	}
 
-	return id, errorWrapper(err)
+	_, err = db.conn.Exec(ctx, `CREATE INDEX IF NOT EXISTS filing_status ON filing (status, status_at);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS company_sync (
+		company_cik VARCHAR(10) PRIMARY KEY REFERENCES company(cik) ON DELETE CASCADE,
+		last_filing_id VARCHAR(20) DEFAULT NULL,
+		last_filing_date TIMESTAMP DEFAULT NULL,
+		etag TEXT DEFAULT NULL,
+		synced_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS job_run (
+		id BIGSERIAL PRIMARY KEY,
+		job VARCHAR(50) NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP DEFAULT NULL,
+		outcome VARCHAR(20) NOT NULL,
+		error TEXT DEFAULT NULL,
+		counts JSONB DEFAULT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(ctx, `CREATE INDEX IF NOT EXISTS job_run_started ON job_run (job, started_at DESC);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS vault_archive (
+		vault VARCHAR(100) NOT NULL,
+		key VARCHAR(300) NOT NULL,
+		archive_id TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (vault, key)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS vault_retrieval (
+		vault VARCHAR(100) NOT NULL,
+		key VARCHAR(300) NOT NULL,
+		archive_id TEXT NOT NULL,
+		job_id TEXT NOT NULL,
+		tier VARCHAR(20) NOT NULL,
+		requested_at TIMESTAMP NOT NULL,
+		completed_at TIMESTAMP DEFAULT NULL,
+		PRIMARY KEY (vault, key)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS filing_archive (
+		filing_id VARCHAR(20) REFERENCES filing(id) ON DELETE CASCADE,
+		key VARCHAR(300) NOT NULL,
+		location TEXT NOT NULL,
+		tree_hash CHAR(64) NOT NULL,
+		size BIGINT NOT NULL,
+		archived_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (filing_id, key)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS queue_state (
+		queue VARCHAR(50) PRIMARY KEY,
+		closed_at TIMESTAMPTZ NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
-func (db *postgres) InsertCompTable(table *filing.Table, data []byte) error {
+func (db *postgres) InsertCompany(ctx context.Context, cmp *filing.Company) error {
 
-	id, err := uuid.NewV7()
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	addrs, err := json.Marshal(cmp.Addresses)
 	if err != nil {
 		return err
 	}
 
+	// the configured forms might have changed since the company was inserted, changes
+	// of the other fields are only recorded by an update of the company, a company
+	// inserted without forms keeps the ones it was configured with before and a
+	// company which was removed stays removed until it is tracked again
 	_, err = db.conn.Exec(
-		context.Background(),
-		`INSERT INTO compressed_table (id, original_id, factor, header_index, data) 
-			VALUES ($1, $2, $3, $4, $5);`,
-		id,
-		table.Id,
-		table.Factor,
-		table.HeadIndex,
-		data,
+		ctx,
+		`INSERT INTO company (cik, name, sic, industry, incorporation, fiscal_year_end, ein, addresses, forms)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (cik) DO UPDATE SET forms = COALESCE(EXCLUDED.forms, company.forms);`,
+		cmp.Cik,
+		cmp.Name,
+		nullStr(cmp.Sic),
+		nullStr(cmp.Industry),
+		nullStr(cmp.Incorporation),
+		nullStr(cmp.FiscalYearEnd),
+		nullStr(cmp.Ein),
+		addrs,
+		nullForms(cmp.Forms),
+	)
+	err = errorWrapper(err)
+	if err != nil && err != database.DuplicateErr {
+		return err
+	}
+
+	for _, t := range cmp.Tickers {
+		_, err := db.conn.Exec(
+			ctx,
+			`INSERT INTO ticker (company_cik, value, exchange) VALUES ($1, $2, $3);`,
+			cmp.Cik,
+			t.Value,
+			t.Exchange,
+		)
+		err = errorWrapper(err)
+		if err != nil && err != database.DuplicateErr {
+			return err
+		}
+	}
+
+	// the first version of the company is only recorded once
+	_, err = db.conn.Exec(
+		ctx,
+		`INSERT INTO company_history (company_cik, name, sic, industry, incorporation, fiscal_year_end,
+			ein, tickers, addresses, valid_from)
+			SELECT cik, name, sic, industry, incorporation, fiscal_year_end, ein, $2, addresses, $3
+			FROM company WHERE cik = $1
+			AND NOT EXISTS (SELECT 1 FROM company_history WHERE company_cik = $1);`,
+		cmp.Cik,
+		tickersJson(cmp.Tickers),
+		time.Now(),
 	)
+	if err != nil {
+		return err
+	}
 
-	return errorWrapper(err)
+	return insertFormerNames(ctx, db.conn, cmp)
 }
 
-func (db *postgres) GetAllTables(limit, page int) ([]*filing.Table, error) {
+func (db *postgres) GetCompany(ctx context.Context, cik string) (*filing.Company, error) {
 
-	rows, err := db.conn.Query(
-		context.Background(),
-		`SELECT id, index, factor, header_index, data FROM "table" ORDER BY id ASC LIMIT $1 OFFSET $2;`,
-		limit,
-		page*limit,
-	)
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	cmp := &filing.Company{Cik: cik}
+	var sic, industry, inc, fye, ein sql.NullString
+	var addrs []byte
+	err := db.conn.QueryRow(
+		ctx,
+		`SELECT name, sic, industry, incorporation, fiscal_year_end, ein, addresses, forms
+			FROM company WHERE cik = $1;`,
+		cik,
+	).Scan(&cmp.Name, &sic, &industry, &inc, &fye, &ein, &addrs, &cmp.Forms)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, database.NotFoundErr
+		}
 		return nil, err
 	}
-	defer rows.Close()
-
-	tables := []*filing.Table{}
-	for rows.Next() {
-		tbl := &filing.Table{}
-		if err := rows.Scan(&tbl.Id, &tbl.Index, &tbl.Factor, &tbl.HeadIndex, &tbl.Data); err != nil {
+	cmp.Sic = sic.String
+	cmp.Industry = industry.String
+	cmp.Incorporation = inc.String
+	cmp.FiscalYearEnd = fye.String
+	cmp.Ein = ein.String
+	if len(addrs) > 0 {
+		err = json.Unmarshal(addrs, &cmp.Addresses)
+		if err != nil {
 			return nil, err
 		}
-		tables = append(tables, tbl)
 	}
 
-	return tables, nil
-}
-
-func (db *postgres) GetCompTables(id string) ([]*filing.Table, error) {
-
 	rows, err := db.conn.Query(
-		context.Background(),
-		`SELECT compressed_table.id, compressed_table.original_id, "table".index, compressed_table.header_index, 
-			compressed_table.factor, compressed_table.data FROM compressed_table, "table"
-			WHERE compressed_table.original_id = "table".id AND "table".filing_id = $1
-			ORDER BY "table".index ASC;`,
-		id,
+		ctx,
+		`SELECT value, COALESCE(exchange, '') FROM ticker WHERE company_cik = $1 ORDER BY id ASC;`,
+		cik,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	tbls := []*filing.Table{}
 	for rows.Next() {
-		tbl := &filing.Table{}
-		if err := rows.Scan(
-			&tbl.Id,
-			&tbl.OriginalId,
-			&tbl.Index,
-			&tbl.HeadIndex,
-			&tbl.Factor,
-			&tbl.Data,
-		); err != nil {
+		t := &filing.Ticker{}
+		if err := rows.Scan(&t.Value, &t.Exchange); err != nil {
 			return nil, err
 		}
-		tbls = append(tbls, tbl)
+		cmp.Tickers = append(cmp.Tickers, t)
 	}
 
-	return tbls, nil
+	return cmp, nil
 }
 
-func (db *postgres) GetUser(username string) (*user.User, error) {
+// updates the company and closes its current version in the history with a new one
+func (db *postgres) UpdateCompany(ctx context.Context, cmp *filing.Company) error {
 
-	user := &user.User{Username: username}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 
-	err := db.conn.QueryRow(
-		context.Background(),
-		`SELECT "user".id, "user".password FROM "user" WHERE "user".username = $1;`,
+	now := time.Now()
+
+	addrs, err := json.Marshal(cmp.Addresses)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	ct, err := tx.Exec(
+		ctx,
+		`UPDATE company SET name = $2, sic = $3, industry = $4, incorporation = $5,
+			fiscal_year_end = $6, ein = $7, addresses = $8 WHERE cik = $1;`,
+		cmp.Cik,
+		cmp.Name,
+		nullStr(cmp.Sic),
+		nullStr(cmp.Industry),
+		nullStr(cmp.Incorporation),
+		nullStr(cmp.FiscalYearEnd),
+		nullStr(cmp.Ein),
+		addrs,
+	)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		return database.NotFoundErr
+	}
+
+	// tickers can move from one company to another so they are reassigned
+	_, err = tx.Exec(ctx, `DELETE FROM ticker WHERE company_cik = $1;`, cmp.Cik)
+	if err != nil {
+		return err
+	}
+	for _, t := range cmp.Tickers {
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO ticker (company_cik, value, exchange) VALUES ($1, $2, $3)
+				ON CONFLICT (value) DO UPDATE SET company_cik = EXCLUDED.company_cik, exchange = EXCLUDED.exchange;`,
+			cmp.Cik,
+			t.Value,
+			t.Exchange,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE company_history SET valid_to = $2 WHERE company_cik = $1 AND valid_to IS NULL;`,
+		cmp.Cik,
+		now,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO company_history (company_cik, name, sic, industry, incorporation, fiscal_year_end,
+			ein, tickers, addresses, valid_from) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);`,
+		cmp.Cik,
+		cmp.Name,
+		nullStr(cmp.Sic),
+		nullStr(cmp.Industry),
+		nullStr(cmp.Incorporation),
+		nullStr(cmp.FiscalYearEnd),
+		nullStr(cmp.Ein),
+		tickersJson(cmp.Tickers),
+		addrs,
+		now,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = insertFormerNames(ctx, tx, cmp)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// the pool and transactions can both execute statements
+type executor interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func insertFormerNames(ctx context.Context, exec executor, cmp *filing.Company) error {
+	for _, n := range cmp.FormerNames {
+		_, err := exec.Exec(
+			ctx,
+			`INSERT INTO former_name (company_cik, name, valid_from, valid_to) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (company_cik, name) DO NOTHING;`,
+			cmp.Cik,
+			n.Name,
+			nullTime(n.From),
+			nullTime(n.To),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *postgres) GetCompanies(ctx context.Context) ([]*filing.Company, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.conn.Query(
+		ctx,
+		`SELECT company.cik, company.name, company.forms,
+			COALESCE(array_agg(ticker.value ORDER BY ticker.id) FILTER (WHERE ticker.id IS NOT NULL), '{}'),
+			COALESCE(array_agg(COALESCE(ticker.exchange, '') ORDER BY ticker.id) FILTER (WHERE ticker.id IS NOT NULL), '{}')
+			FROM company
+			LEFT JOIN ticker ON ticker.company_cik = company.cik
+			WHERE company.tracked = true
+			GROUP BY company.cik
+			ORDER BY company.cik ASC;`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cmps := []*filing.Company{}
+	for rows.Next() {
+		c := &filing.Company{}
+		var tickers, exchs []string
+		if err := rows.Scan(&c.Cik, &c.Name, &c.Forms, &tickers, &exchs); err != nil {
+			return nil, err
+		}
+		for i := range tickers {
+			c.Tickers = append(c.Tickers, &filing.Ticker{Value: tickers[i], Exchange: exchs[i]})
+		}
+		cmps = append(cmps, c)
+	}
+
+	return cmps, nil
+}
+
+// companies which were removed are only tracked again when they are added on purpose
+func (db *postgres) TrackCompany(ctx context.Context, cik string) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	ct, err := db.conn.Exec(
+		ctx,
+		`UPDATE company SET tracked = true WHERE cik = $1;`,
+		cik,
+	)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		return database.NotFoundErr
+	}
+
+	return nil
+}
+
+// companies are only marked as untracked to keep their filings and tables
+func (db *postgres) UntrackCompany(ctx context.Context, cik string) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	ct, err := db.conn.Exec(
+		ctx,
+		`UPDATE company SET tracked = false WHERE cik = $1;`,
+		cik,
+	)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		return database.NotFoundErr
+	}
+
+	return nil
+}
+
+func (db *postgres) InsertFiling(ctx context.Context, cik string, fil *filing.Filing) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.conn.Exec(
+		ctx,
+		`INSERT INTO filing (id, company_cik, form, filing_date, report_date, amends, last_modified, original_file) 
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`,
+		fil.Id,
+		cik,
+		fil.Form,
+		nullTime(fil.FilingDate),
+		nullTime(fil.ReportDate),
+		nullStr(fil.Amends),
+		nullTime(fil.MainFile.LastModified),
+		fil.MainFile.Key,
+	)
+
+	if err != nil {
+		err = errorWrapper(err)
+		// filing might already be stored in which case we are happi big time :)
+		if err == database.DuplicateErr {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (db *postgres) GetFiling(ctx context.Context, id string) (*filing.Filing, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	fil := &filing.Filing{Id: id, MainFile: &filing.File{}}
+	var fd, rd sql.NullTime
+	var amends sql.NullString
+	err := db.conn.QueryRow(
+		ctx,
+		`SELECT company_cik, form, filing_date, report_date, amends, original_file FROM filing WHERE id = $1;`,
+		id,
+	).Scan(&fil.Cik, &fil.Form, &fd, &rd, &amends, &fil.MainFile.Key)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, database.NotFoundErr
+		}
+		return nil, err
+	}
+	fil.FilingDate = fd.Time
+	fil.ReportDate = rd.Time
+	fil.Amends = amends.String
+
+	return fil, nil
+}
+
+func (db *postgres) UpdateStoredFiling(ctx context.Context, id string) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.conn.Exec(
+		ctx,
+		`UPDATE filing SET fully_stored = true WHERE id = $1;`,
+		id,
+	)
+
+	return err
+}
+
+// we return a map so we can compare which filings are still missing (faster than a list)
+func (db *postgres) GetFilings(ctx context.Context, cik string) (map[string]*filing.Filing, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.conn.Query(
+		ctx,
+		`SELECT id FROM filing WHERE filing.company_cik = $1 AND filing.fully_stored = true;`,
+		cik,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fils := make(map[string]*filing.Filing)
+	for rows.Next() {
+		f := &filing.Filing{}
+		if err := rows.Scan(&f.Id); err != nil {
+			return nil, err
+		}
+		fils[f.Id] = f
+	}
+
+	return fils, nil
+}
+
+func (db *postgres) InsertTable(ctx context.Context, filId string, table *filing.Table, data []byte) (uuid.UUID, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	_, err = db.conn.Exec(
+		ctx,
+		`INSERT INTO "table" (id, filing_id, file_key, index, factor, header_index, raw_data, data) 
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`,
+		id,
+		filId,
+		nullStr(table.FileKey),
+		table.Index,
+		table.Factor,
+		table.HeadIndex,
+		table.RawData,
+		data,
+	)
+
+	return id, errorWrapper(err)
+}
+
+func (db *postgres) InsertCompTable(ctx context.Context, table *filing.Table, data []byte) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(
+		ctx,
+		`INSERT INTO compressed_table (id, original_id, factor, header_index, data) 
+			VALUES ($1, $2, $3, $4, $5);`,
+		id,
+		table.Id,
+		table.Factor,
+		table.HeadIndex,
+		data,
+	)
+
+	return errorWrapper(err)
+}
+
+func (db *postgres) GetAllTables(ctx context.Context, limit, page int) ([]*filing.Table, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.conn.Query(
+		ctx,
+		`SELECT id, index, factor, header_index, data FROM "table" ORDER BY id ASC LIMIT $1 OFFSET $2;`,
+		limit,
+		page*limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := []*filing.Table{}
+	for rows.Next() {
+		tbl := &filing.Table{}
+		if err := rows.Scan(&tbl.Id, &tbl.Index, &tbl.Factor, &tbl.HeadIndex, &tbl.Data); err != nil {
+			return nil, err
+		}
+		tables = append(tables, tbl)
+	}
+
+	return tables, nil
+}
+
+func (db *postgres) GetCompTables(ctx context.Context, id string) ([]*filing.Table, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.conn.Query(
+		ctx,
+		`SELECT compressed_table.id, compressed_table.original_id, "table".index, compressed_table.header_index, 
+			compressed_table.factor, compressed_table.data FROM compressed_table, "table"
+			WHERE compressed_table.original_id = "table".id AND "table".filing_id = $1
+			ORDER BY "table".index ASC;`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tbls := []*filing.Table{}
+	for rows.Next() {
+		tbl := &filing.Table{}
+		if err := rows.Scan(
+			&tbl.Id,
+			&tbl.OriginalId,
+			&tbl.Index,
+			&tbl.HeadIndex,
+			&tbl.Factor,
+			&tbl.Data,
+		); err != nil {
+			return nil, err
+		}
+		tbls = append(tbls, tbl)
+	}
+
+	return tbls, nil
+}
+
+func (db *postgres) GetUser(ctx context.Context, username string) (*user.User, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	user := &user.User{Username: username}
+
+	err := db.conn.QueryRow(
+		ctx,
+		`SELECT "user".id, "user".password FROM "user" WHERE "user".username = $1;`,
 		username,
 	).Scan(&user.Id, &user.Password)
 	if err != nil {
@@ -352,32 +918,266 @@ func (db *postgres) GetUser(username string) (*user.User, error) {
 		return nil, err
 	}
 
-	return user, nil
-}
-
-func (db *postgres) InsertUser(user *user.User) error {
+	return user, nil
+}
+
+func (db *postgres) InsertUser(ctx context.Context, user *user.User) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.conn.Exec(
+		ctx,
+		`INSERT INTO "user" (id, username, password) VALUES ($1, $2, $3);`,
+		user.Id,
+		user.Username,
+		user.Password,
+	)
+	return errorWrapper(err)
+}
+
+func (db *postgres) UpdatePassword(ctx context.Context, user *user.User) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	ct, err := db.conn.Exec(
+		ctx,
+		`UPDATE "user" SET password = $2 WHERE id = $1;`,
+		user.Id, user.Password,
+	)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() < 1 {
+		return database.NotFoundErr
+	}
+
+	return nil
+}
+
+func (db *postgres) InsertSession(ctx context.Context, sess *user.Session) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.conn.Exec(
+		ctx,
+		`INSERT INTO "session" (token, user_id, expires_at) VALUES ($1, $2, $3);`,
+		sess.Token,
+		sess.User.Id,
+		sess.ExpiresAt,
+	)
+	return errorWrapper(err)
+}
+
+func (db *postgres) GetSession(ctx context.Context, token string) (*user.Session, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	u := &user.User{}
+	sess := &user.Session{Token: token, User: u}
+
+	err := db.conn.QueryRow(
+		ctx,
+		`SELECT user_id, expires_at FROM "session" WHERE token = $1;`,
+		token,
+	).Scan(&u.Id, &sess.ExpiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, database.NotFoundErr
+		}
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+func (db *postgres) DeleteSession(ctx context.Context, token string) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	ct, err := db.conn.Exec(
+		ctx,
+		`DELETE FROM "session" WHERE token = $1;`,
+		token,
+	)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		return database.NotFoundErr
+	}
+
+	return nil
+}
+
+func (db *postgres) GetRandomTables(ctx context.Context, userId uuid.UUID) ([]*filing.Company, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.conn.Query(
+		ctx,
+		`SELECT company.cik, company.name, filing.id, filing.form, filing.filing_date,
+			COALESCE("table".file_key, filing.original_file), "table".id, "table".index, "table".raw_data
+			FROM "table"
+			JOIN filing ON "table".filing_id = filing.id
+			JOIN company ON filing.company_cik = company.cik
+			LEFT JOIN table_label ON "table".id = table_label.table_id 
+			AND table_label.user_id = $1
+			WHERE table_label.table_id IS NULL
+			ORDER BY RANDOM() LIMIT 100;`,
+		userId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cmps := []*filing.Company{}
+	for rows.Next() {
+
+		cmp := &filing.Company{
+			Filings: []*filing.Filing{{
+				Tables:   []*filing.Table{{}},
+				MainFile: &filing.File{},
+			}},
+		}
+		if err := rows.Scan(
+			&cmp.Cik,
+			&cmp.Name,
+			&cmp.Filings[0].Id,
+			&cmp.Filings[0].Form,
+			&cmp.Filings[0].FilingDate,
+			&cmp.Filings[0].MainFile.Key,
+			&cmp.Filings[0].Tables[0].Id,
+			&cmp.Filings[0].Tables[0].Index,
+			&cmp.Filings[0].Tables[0].RawData,
+		); err != nil {
+			return nil, err
+		}
+		cmps = append(cmps, cmp)
+	}
+
+	return cmps, nil
+}
+
+func (db *postgres) InsertLabel(ctx context.Context, tblId, userId uuid.UUID, label string) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.conn.Exec(
+		ctx,
+		`INSERT INTO "table_label" (table_id, user_id, label) VALUES ($1, $2, $3);`,
+		tblId,
+		userId,
+		label,
+	)
+	return errorWrapper(err)
+}
+
+func (db *postgres) GetCursor(ctx context.Context, name string) (time.Time, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var pos time.Time
+	err := db.conn.QueryRow(
+		ctx,
+		`SELECT position FROM cursor WHERE name = $1;`,
+		name,
+	).Scan(&pos)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return time.Time{}, database.NotFoundErr
+		}
+		return time.Time{}, err
+	}
+
+	return pos, nil
+}
+
+func (db *postgres) UpdateCursor(ctx context.Context, name string, pos time.Time) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.conn.Exec(
+		ctx,
+		`INSERT INTO cursor (name, position) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET position = EXCLUDED.position;`,
+		name,
+		pos,
+	)
+	return errorWrapper(err)
+}
+
+func (db *postgres) InsertDeadLetter(ctx context.Context, dl *queue.DeadLetter) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.conn.Exec(
+		ctx,
+		`INSERT INTO dead_letter (id, queue, body, deliveries, error, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6);`,
+		dl.Id,
+		dl.Queue,
+		dl.Body,
+		dl.Deliveries,
+		dl.Error,
+		dl.CreatedAt,
+	)
+	return errorWrapper(err)
+}
+
+// an empty queue name returns the dead letters of all queues
+func (db *postgres) GetDeadLetters(ctx context.Context, name string) ([]*queue.DeadLetter, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.conn.Query(
+		ctx,
+		`SELECT id, queue, body, deliveries, error, created_at FROM dead_letter
+			WHERE $1 = '' OR queue = $1 ORDER BY created_at ASC;`,
+		name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dls := []*queue.DeadLetter{}
+	for rows.Next() {
+		dl := &queue.DeadLetter{}
+		if err := rows.Scan(&dl.Id, &dl.Queue, &dl.Body, &dl.Deliveries, &dl.Error, &dl.CreatedAt); err != nil {
+			return nil, err
+		}
+		dls = append(dls, dl)
+	}
 
-	_, err := db.conn.Exec(
-		context.Background(),
-		`INSERT INTO "user" (id, username, password) VALUES ($1, $2, $3);`,
-		user.Id,
-		user.Username,
-		user.Password,
-	)
-	return errorWrapper(err)
+	return dls, nil
 }
 
-func (db *postgres) UpdatePassword(user *user.User) error {
+func (db *postgres) DeleteDeadLetter(ctx context.Context, id string) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 
 	ct, err := db.conn.Exec(
-		context.Background(),
-		`UPDATE "user" SET password = $2 WHERE id = $1;`,
-		user.Id, user.Password,
+		ctx,
+		`DELETE FROM dead_letter WHERE id = $1;`,
+		id,
 	)
 	if err != nil {
 		return err
 	}
-
 	if ct.RowsAffected() < 1 {
 		return database.NotFoundErr
 	}
@@ -385,117 +1185,558 @@ func (db *postgres) UpdatePassword(user *user.User) error {
 	return nil
 }
 
-func (db *postgres) InsertSession(sess *user.Session) error {
+// transitions which would set a filing back are ignored since messages can be delivered twice
+func (db *postgres) UpdateFilingStatus(ctx context.Context, id string, status filing.Status, cause string) error {
 
-	_, err := db.conn.Exec(
-		context.Background(),
-		`INSERT INTO "session" (token, user_id, expires_at) VALUES ($1, $2, $3);`,
-		sess.Token,
-		sess.User.Id,
-		sess.ExpiresAt,
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var current string
+	err = tx.QueryRow(ctx, `SELECT status FROM filing WHERE id = $1 FOR UPDATE;`, id).Scan(&current)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return database.NotFoundErr
+		}
+		return err
+	}
+	if !filing.Status(current).CanBecome(status) {
+		return nil
+	}
+
+	if status == filing.Failed {
+		// the status before the failure is kept so a retry knows where to continue
+		_, err = tx.Exec(
+			ctx,
+			`UPDATE filing SET
+				status = $2,
+				last_status = CASE WHEN status = $2 THEN last_status ELSE status END,
+				error = $3,
+				attempts = attempts + 1,
+				status_at = $4
+			WHERE id = $1;`,
+			id,
+			status,
+			cause,
+			time.Now(),
+		)
+	} else {
+		_, err = tx.Exec(
+			ctx,
+			`UPDATE filing SET status = $2, last_status = NULL, error = NULL, status_at = $3 WHERE id = $1;`,
+			id,
+			status,
+			time.Now(),
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// archived filings are compressed once every one of their tables is compressed
+func (db *postgres) UpdateCompressedFilings(ctx context.Context) (int, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := db.conn.Exec(
+		ctx,
+		`UPDATE filing SET status = 'compressed', status_at = $1 WHERE status = 'archived' AND NOT EXISTS (
+			SELECT 1 FROM "table" t WHERE t.filing_id = filing.id AND NOT EXISTS (
+				SELECT 1 FROM compressed_table c WHERE c.original_id = t.id
+			)
+		);`,
+		time.Now(),
 	)
-	return errorWrapper(err)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(tag.RowsAffected()), nil
 }
 
-func (db *postgres) GetSession(token string) (*user.Session, error) {
+// the most recently updated filings come first
+func (db *postgres) GetFilingStatuses(ctx context.Context, filter *database.FilingFilter) ([]*filing.Progress, error) {
 
-	u := &user.User{}
-	sess := &user.Session{Token: token, User: u}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	statuses := []string{}
+	for _, s := range filter.Statuses {
+		statuses = append(statuses, string(s))
+	}
+
+	rows, err := db.conn.Query(
+		ctx,
+		`SELECT id, company_cik, form, filing_date, status, last_status, error, attempts, status_at,
+			(SELECT count(*) FROM "table" t WHERE t.filing_id = filing.id) FROM filing
+			WHERE ($1 = '' OR company_cik = $1)
+				AND ($2 = '' OR form = $2)
+				AND (cardinality($3::TEXT[]) = 0 OR status = ANY($3))
+				AND ($4::TIMESTAMP IS NULL OR filing_date >= $4)
+				AND ($5::TIMESTAMP IS NULL OR filing_date < $5)
+				AND (cardinality($7::TEXT[]) = 0 OR id = ANY($7))
+			ORDER BY status_at DESC NULLS LAST, id ASC
+			LIMIT NULLIF($6, 0);`,
+		filter.Cik,
+		filter.Form,
+		statuses,
+		nullTime(filter.Since),
+		nullTime(filter.Until),
+		filter.Limit,
+		ids(filter),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	progs := []*filing.Progress{}
+	for rows.Next() {
+		p := &filing.Progress{}
+		var fd, at sql.NullTime
+		var last, cause sql.NullString
+		err := rows.Scan(&p.Id, &p.Cik, &p.Form, &fd, &p.Status, &last, &cause, &p.Attempts, &at, &p.Tables)
+		if err != nil {
+			return nil, err
+		}
+		p.FilingDate = fd.Time
+		p.LastStatus = filing.Status(last.String)
+		p.Error = cause.String
+		p.UpdatedAt = at.Time
+		progs = append(progs, p)
+	}
+
+	return progs, nil
+}
+
+// number of filings per status for every company
+func (db *postgres) CountFilingStatuses(ctx context.Context) (map[string]map[filing.Status]int, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.conn.Query(ctx, `SELECT company_cik, status, count(*) FROM filing GROUP BY company_cik, status;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]map[filing.Status]int)
+	for rows.Next() {
+		var cik string
+		var status filing.Status
+		var count int
+		if err := rows.Scan(&cik, &status, &count); err != nil {
+			return nil, err
+		}
+		if counts[cik] == nil {
+			counts[cik] = make(map[filing.Status]int)
+		}
+		counts[cik][status] = count
+	}
+
+	return counts, nil
+}
+
+func (db *postgres) GetSyncState(ctx context.Context, cik string) (*filing.SyncState, error) {
 
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	state := &filing.SyncState{Cik: cik}
+	var last, etag sql.NullString
+	var date sql.NullTime
 	err := db.conn.QueryRow(
-		context.Background(),
-		`SELECT user_id, expires_at FROM "session" WHERE token = $1;`,
-		token,
-	).Scan(&u.Id, &sess.ExpiresAt)
+		ctx,
+		`SELECT last_filing_id, last_filing_date, etag, synced_at FROM company_sync WHERE company_cik = $1;`,
+		cik,
+	).Scan(&last, &date, &etag, &state.SyncedAt)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, database.NotFoundErr
 		}
 		return nil, err
 	}
+	state.LastId = last.String
+	state.LastFilingDate = date.Time
+	state.ETag = etag.String
 
-	return sess, nil
+	return state, nil
 }
 
-func (db *postgres) DeleteSession(token string) error {
+func (db *postgres) UpdateSyncState(ctx context.Context, state *filing.SyncState) error {
 
-	ct, err := db.conn.Exec(
-		context.Background(),
-		`DELETE FROM "session" WHERE token = $1;`,
-		token,
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.conn.Exec(
+		ctx,
+		`INSERT INTO company_sync (company_cik, last_filing_id, last_filing_date, etag, synced_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (company_cik) DO UPDATE SET
+				last_filing_id = EXCLUDED.last_filing_id,
+				last_filing_date = EXCLUDED.last_filing_date,
+				etag = EXCLUDED.etag,
+				synced_at = EXCLUDED.synced_at;`,
+		state.Cik,
+		nullStr(state.LastId),
+		nullTime(state.LastFilingDate),
+		nullStr(state.ETag),
+		state.SyncedAt,
 	)
+	return errorWrapper(err)
+}
+
+func (db *postgres) DeleteExpiredSessions(ctx context.Context) (int, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := db.conn.Exec(ctx, `DELETE FROM "session" WHERE expires_at < $1;`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// advisory locks belong to the session which took them so a connection is taken out of the pool
+// until the returned function releases the lock, the lock is also released if the process dies
+func (db *postgres) TryLock(ctx context.Context, name string) (func(), error) {
+
+	conn, err := db.conn.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var ok bool
+	err = conn.QueryRow(tctx, `SELECT pg_try_advisory_lock(hashtext($1));`, name).Scan(&ok)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+	if !ok {
+		conn.Release()
+		return nil, database.LockedErr
+	}
+
+	return func() {
+		ctx, cancel := db.withTimeout(context.Background())
+		defer cancel()
+		_, err := conn.Exec(ctx, `SELECT pg_advisory_unlock(hashtext($1));`, name)
+		if err != nil {
+			// closing the connection ends the session and with it the lock
+			conn.Hijack().Close(ctx)
+			return
+		}
+		conn.Release()
+	}, nil
+}
+
+func (db *postgres) InsertJobRun(ctx context.Context, run *job.Run) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	return db.conn.QueryRow(
+		ctx,
+		`INSERT INTO job_run (job, started_at, outcome) VALUES ($1, $2, $3) RETURNING id;`,
+		run.Job,
+		run.StartedAt,
+		run.Outcome,
+	).Scan(&run.Id)
+}
+
+func (db *postgres) UpdateJobRun(ctx context.Context, run *job.Run) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	counts, err := json.Marshal(run.Counts)
 	if err != nil {
 		return err
 	}
-	if ct.RowsAffected() < 1 {
+
+	tag, err := db.conn.Exec(
+		ctx,
+		`UPDATE job_run SET finished_at = $2, outcome = $3, error = $4, counts = $5 WHERE id = $1;`,
+		run.Id,
+		nullTime(run.FinishedAt),
+		run.Outcome,
+		nullStr(run.Error),
+		counts,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() < 1 {
 		return database.NotFoundErr
 	}
-
 	return nil
 }
 
-func (db *postgres) GetRandomTables(userId uuid.UUID) ([]*filing.Company, error) {
+// the latest runs come first, an empty name returns the runs of all jobs
+func (db *postgres) GetJobRuns(ctx context.Context, name string, limit int) ([]*job.Run, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 
 	rows, err := db.conn.Query(
-		context.Background(),
-		`SELECT company.cik, company.name, filing.id, filing.form, filing.filing_date,
-			filing.original_file, "table".id, "table".index, "table".raw_data
-			FROM "table"
-			JOIN filing ON "table".filing_id = filing.id
-			JOIN company ON filing.company_cik = company.cik
-			LEFT JOIN table_label ON "table".id = table_label.table_id 
-			AND table_label.user_id = $1
-			WHERE table_label.table_id IS NULL
-			ORDER BY RANDOM() LIMIT 100;`,
-		userId,
+		ctx,
+		`SELECT id, job, started_at, finished_at, outcome, error, counts FROM job_run
+			WHERE $1 = '' OR job = $1
+			ORDER BY started_at DESC, id DESC
+			LIMIT NULLIF($2, 0);`,
+		name,
+		limit,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	cmps := []*filing.Company{}
+	runs := []*job.Run{}
 	for rows.Next() {
+		run := &job.Run{}
+		var finished sql.NullTime
+		var cause sql.NullString
+		var counts []byte
+		err := rows.Scan(&run.Id, &run.Job, &run.StartedAt, &finished, &run.Outcome, &cause, &counts)
+		if err != nil {
+			return nil, err
+		}
+		run.FinishedAt = finished.Time
+		run.Error = cause.String
+		if len(counts) > 0 {
+			if err := json.Unmarshal(counts, &run.Counts); err != nil {
+				return nil, err
+			}
+		}
+		runs = append(runs, run)
+	}
 
-		cmp := &filing.Company{
-			Filings: []*filing.Filing{{
-				Tables:   []*filing.Table{{}},
-				MainFile: &filing.File{},
-			}},
+	return runs, nil
+}
+
+// an object which is archived again replaces the archive of its key
+func (db *postgres) InsertArchive(ctx context.Context, arc *bucket.Archive) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.conn.Exec(
+		ctx,
+		`INSERT INTO vault_archive (vault, key, archive_id, created_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (vault, key) DO UPDATE SET
+				archive_id = EXCLUDED.archive_id,
+				created_at = EXCLUDED.created_at;`,
+		arc.Vault,
+		arc.Key,
+		arc.ArchiveId,
+		arc.CreatedAt,
+	)
+	return errorWrapper(err)
+}
+
+func (db *postgres) GetArchive(ctx context.Context, vault, key string) (*bucket.Archive, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	arc := &bucket.Archive{Vault: vault, Key: key}
+	err := db.conn.QueryRow(
+		ctx,
+		`SELECT archive_id, created_at FROM vault_archive WHERE vault = $1 AND key = $2;`,
+		vault,
+		key,
+	).Scan(&arc.ArchiveId, &arc.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, database.NotFoundErr
 		}
-		if err := rows.Scan(
-			&cmp.Cik,
-			&cmp.Name,
-			&cmp.Filings[0].Id,
-			&cmp.Filings[0].Form,
-			&cmp.Filings[0].FilingDate,
-			&cmp.Filings[0].MainFile.Key,
-			&cmp.Filings[0].Tables[0].Id,
-			&cmp.Filings[0].Tables[0].Index,
-			&cmp.Filings[0].Tables[0].RawData,
-		); err != nil {
+		return nil, err
+	}
+
+	return arc, nil
+}
+
+// archives are ordered by their keys
+func (db *postgres) GetArchives(ctx context.Context, vault, prefix string) ([]*bucket.Archive, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.conn.Query(
+		ctx,
+		`SELECT key, archive_id, created_at FROM vault_archive
+			WHERE vault = $1 AND starts_with(key, $2) ORDER BY key ASC;`,
+		vault,
+		prefix,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	arcs := []*bucket.Archive{}
+	for rows.Next() {
+		arc := &bucket.Archive{Vault: vault}
+		if err := rows.Scan(&arc.Key, &arc.ArchiveId, &arc.CreatedAt); err != nil {
 			return nil, err
 		}
-		cmps = append(cmps, cmp)
+		arcs = append(arcs, arc)
 	}
 
-	return cmps, nil
+	return arcs, nil
 }
 
-func (db *postgres) InsertLabel(tblId, userId uuid.UUID, label string) error {
+// a new retrieval of a key replaces the previous one
+func (db *postgres) UpdateRetrieval(ctx context.Context, ret *bucket.Retrieval) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 
 	_, err := db.conn.Exec(
-		context.Background(),
-		`INSERT INTO "table_label" (table_id, user_id, label) VALUES ($1, $2, $3);`,
-		tblId,
-		userId,
-		label,
+		ctx,
+		`INSERT INTO vault_retrieval (vault, key, archive_id, job_id, tier, requested_at, completed_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (vault, key) DO UPDATE SET
+				archive_id = EXCLUDED.archive_id,
+				job_id = EXCLUDED.job_id,
+				tier = EXCLUDED.tier,
+				requested_at = EXCLUDED.requested_at,
+				completed_at = EXCLUDED.completed_at;`,
+		ret.Vault,
+		ret.Key,
+		ret.ArchiveId,
+		ret.JobId,
+		ret.Tier,
+		ret.RequestedAt,
+		nullTime(ret.CompletedAt),
+	)
+	return errorWrapper(err)
+}
+
+func (db *postgres) GetRetrieval(ctx context.Context, vault, key string) (*bucket.Retrieval, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	ret := &bucket.Retrieval{Vault: vault, Key: key}
+	var completed sql.NullTime
+	err := db.conn.QueryRow(
+		ctx,
+		`SELECT archive_id, job_id, tier, requested_at, completed_at FROM vault_retrieval
+			WHERE vault = $1 AND key = $2;`,
+		vault,
+		key,
+	).Scan(&ret.ArchiveId, &ret.JobId, &ret.Tier, &ret.RequestedAt, &completed)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, database.NotFoundErr
+		}
+		return nil, err
+	}
+	ret.CompletedAt = completed.Time
+
+	return ret, nil
+}
+
+// a document which is archived again replaces the receipt of the previous upload
+func (db *postgres) InsertArchivedFile(ctx context.Context, file *filing.ArchivedFile) error {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.conn.Exec(
+		ctx,
+		`INSERT INTO filing_archive (filing_id, key, location, tree_hash, size, archived_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (filing_id, key) DO UPDATE SET
+				location = EXCLUDED.location,
+				tree_hash = EXCLUDED.tree_hash,
+				size = EXCLUDED.size,
+				archived_at = EXCLUDED.archived_at;`,
+		file.FilingId,
+		file.Key,
+		file.Location,
+		file.TreeHash,
+		file.Size,
+		file.ArchivedAt,
 	)
 	return errorWrapper(err)
 }
 
+// archived documents of the filings which match the filter ordered by filing and key, the
+// limit applies to the documents
+func (db *postgres) GetArchivedFiles(ctx context.Context, filter *database.FilingFilter) ([]*filing.ArchivedFile, error) {
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	statuses := []string{}
+	for _, s := range filter.Statuses {
+		statuses = append(statuses, string(s))
+	}
+
+	rows, err := db.conn.Query(
+		ctx,
+		`SELECT a.filing_id, a.key, a.location, a.tree_hash, a.size, a.archived_at
+			FROM filing_archive a JOIN filing f ON f.id = a.filing_id
+			WHERE ($1 = '' OR f.company_cik = $1)
+				AND ($2 = '' OR f.form = $2)
+				AND (cardinality($3::TEXT[]) = 0 OR f.status = ANY($3))
+				AND ($4::TIMESTAMP IS NULL OR f.filing_date >= $4)
+				AND ($5::TIMESTAMP IS NULL OR f.filing_date < $5)
+				AND (cardinality($7::TEXT[]) = 0 OR f.id = ANY($7))
+			ORDER BY a.filing_id ASC, a.key ASC
+			LIMIT NULLIF($6, 0);`,
+		filter.Cik,
+		filter.Form,
+		statuses,
+		nullTime(filter.Since),
+		nullTime(filter.Until),
+		filter.Limit,
+		ids(filter),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []*filing.ArchivedFile{}
+	for rows.Next() {
+		f := &filing.ArchivedFile{}
+		err := rows.Scan(&f.FilingId, &f.Key, &f.Location, &f.TreeHash, &f.Size, &f.ArchivedAt)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
 // Helper Functions
 
+func (db *postgres) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db.timeout)
+}
+
 // to insert null into database timestamps
 func nullTime(t time.Time) sql.NullTime {
 	if t.IsZero() {
@@ -504,6 +1745,39 @@ func nullTime(t time.Time) sql.NullTime {
 	return sql.NullTime{Valid: true, Time: t}
 }
 
+// to insert null into database strings
+func nullStr(s string) sql.NullString {
+	if len(s) < 1 {
+		return sql.NullString{Valid: false}
+	}
+	return sql.NullString{Valid: true, String: s}
+}
+
+// tickers are only kept as a list in the history of a company
+func tickersJson(tickers []*filing.Ticker) []byte {
+	b, err := json.Marshal(tickers)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// companies without own forms fall back to the globally configured forms
+func nullForms(forms []string) []string {
+	if len(forms) < 1 {
+		return nil
+	}
+	return forms
+}
+
+// a nil slice would be sent as NULL whose cardinality is NULL as well
+func ids(filter *database.FilingFilter) []string {
+	if filter.Ids == nil {
+		return []string{}
+	}
+	return filter.Ids
+}
+
 // my error wrapper to use custom created error constants defined in database package
 func errorWrapper(err error) error {
 
@@ -1,11 +1,16 @@
 package postgres
 
 import (
+	"context"
 	"log"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/finneas-io/data-pipeline/adapter/database"
 	"github.com/finneas-io/data-pipeline/domain/filing"
+	"github.com/finneas-io/data-pipeline/domain/job"
 	"github.com/ory/dockertest/v3"
 	"github.com/ory/dockertest/v3/docker"
 )
@@ -48,7 +53,7 @@ func TestMain(m *testing.M) {
 	// exponential backoff-retry, because the application in the container might not be ready to accept connections yet
 	pool.MaxWait = 120 * time.Second
 	if err = pool.Retry(func() error {
-		db, err = New("localhost", "5432", "postgres", "postgres", "password123")
+		db, err = New(context.Background(), "localhost", "5432", "postgres", "postgres", "password123", 0)
 		return err
 	}); err != nil {
 		log.Fatalf("Could not connect to database: %s", err)
@@ -66,14 +71,311 @@ func TestMain(m *testing.M) {
 
 func TestInsertFiling(t *testing.T) {
 	fil := &filing.Filing{Id: "12345678901234567890"}
-	err := db.InsertFiling("1234567890", fil)
+	err := db.InsertFiling(context.Background(), "1234567890", fil)
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	// insert again to check if error is returned for uniquness violation
-	err = db.InsertFiling("1234567890", fil)
+	err = db.InsertFiling(context.Background(), "1234567890", fil)
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 }
+
+func TestFilingStatus(t *testing.T) {
+	ctx := context.Background()
+	if err := db.CreateBaseTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertCompany(ctx, &filing.Company{Cik: "0000000002", Name: "Status Corp"}); err != nil {
+		t.Fatal(err)
+	}
+	fil := &filing.Filing{Id: "000000000224000001", Form: "10-K", MainFile: &filing.File{Key: "main.htm"}}
+	if err := db.InsertFiling(ctx, "0000000002", fil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetFiling(ctx, fil.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Cik != "0000000002" || got.MainFile.Key != "main.htm" {
+		t.Errorf("Expected the filing with its company and main document but got %+v", got)
+	}
+
+	// the failure keeps the stage the filing reached and a later delivery continues from there
+	steps := []struct {
+		status filing.Status
+		want   filing.Status
+	}{
+		{filing.Downloaded, filing.Downloaded},
+		{filing.Failed, filing.Failed},
+		{filing.Failed, filing.Failed},
+		{filing.Sliced, filing.Sliced},
+		{filing.Downloaded, filing.Sliced},
+		{filing.Archived, filing.Archived},
+	}
+	for i, step := range steps {
+		if err := db.UpdateFilingStatus(ctx, fil.Id, step.status, "failed"); err != nil {
+			t.Fatal(err)
+		}
+		progs, err := db.GetFilingStatuses(ctx, &database.FilingFilter{Cik: "0000000002"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(progs) != 1 || progs[0].Status != step.want {
+			t.Fatalf("Expected status %s after step %d", step.want, i)
+		}
+		if i == 2 && (progs[0].Attempts != 2 || progs[0].LastStatus != filing.Downloaded) {
+			t.Errorf("Expected two failures after downloaded but got %d after %s", progs[0].Attempts, progs[0].LastStatus)
+		}
+	}
+
+	// a filing without tables has nothing left to compress
+	n, err := db.UpdateCompressedFilings(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected one compressed filing but got %d", n)
+	}
+	counts, err := db.CountFilingStatuses(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["0000000002"][filing.Compressed] != 1 {
+		t.Errorf("Expected the filing to be counted as compressed")
+	}
+}
+
+func TestUpdateCompany(t *testing.T) {
+	ctx := context.Background()
+	if err := db.CreateBaseTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cmp := &filing.Company{
+		Cik:     "0000000003",
+		Name:    "History Inc",
+		Tickers: []*filing.Ticker{{Value: "HIST", Exchange: "NYSE"}},
+		Forms:   []string{"10-K"},
+	}
+	if err := db.InsertCompany(ctx, cmp); err != nil {
+		t.Fatal(err)
+	}
+
+	// every update closes the current version and records the new one
+	names := []string{"History Corp", "History Holdings"}
+	for _, name := range names {
+		cmp.Name = name
+		if err := db.UpdateCompany(ctx, cmp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := db.conn.Query(
+		ctx,
+		`SELECT name, valid_to IS NULL FROM company_history WHERE company_cik = $1 ORDER BY id;`,
+		cmp.Cik,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	want := []string{"History Inc", "History Corp", "History Holdings"}
+	got := []string{}
+	for rows.Next() {
+		var name string
+		var current bool
+		if err := rows.Scan(&name, &current); err != nil {
+			t.Fatal(err)
+		}
+		if current != (len(got) == len(want)-1) {
+			t.Errorf("Expected only the last version to be current but '%s' is %t", name, current)
+		}
+		got = append(got, name)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected the history %v but got %v", want, got)
+	}
+
+	// inserting the company again without forms keeps its forms
+	if err := db.InsertCompany(ctx, &filing.Company{Cik: cmp.Cik, Name: cmp.Name}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := db.GetCompany(ctx, cmp.Cik)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "History Holdings" || len(stored.Forms) != 1 || stored.Forms[0] != "10-K" {
+		t.Errorf("Unexpected company '%s' with forms %v", stored.Name, stored.Forms)
+	}
+
+	// a removed company inserted again stays removed until it is tracked again
+	tracked := func() bool {
+		cmps, err := db.GetCompanies(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cmps {
+			if c.Cik == cmp.Cik {
+				return true
+			}
+		}
+		return false
+	}
+	if err := db.UntrackCompany(ctx, cmp.Cik); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertCompany(ctx, &filing.Company{Cik: cmp.Cik, Name: cmp.Name}); err != nil {
+		t.Fatal(err)
+	}
+	if tracked() {
+		t.Errorf("Expected the removed company to stay removed")
+	}
+	if err := db.TrackCompany(ctx, cmp.Cik); err != nil {
+		t.Fatal(err)
+	}
+	if !tracked() {
+		t.Errorf("Expected the company to be tracked again")
+	}
+
+	if err := db.UpdateCompany(ctx, &filing.Company{Cik: "0000000004", Name: "Nobody"}); err != database.NotFoundErr {
+		t.Errorf("Expected the unknown company to be not found but got %v", err)
+	}
+}
+
+func TestJobRun(t *testing.T) {
+	ctx := context.Background()
+	if err := db.CreateBaseTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock is held until it is released by whoever took it
+	unlock, err := db.TryLock(ctx, "job_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.TryLock(ctx, "job_test"); err != database.LockedErr {
+		t.Errorf("Expected the lock to be held but got %v", err)
+	}
+	unlock()
+	unlock, err = db.TryLock(ctx, "job_test")
+	if err != nil {
+		t.Fatalf("Expected the lock to be released but got %v", err)
+	}
+	unlock()
+
+	run := &job.Run{Job: "test", StartedAt: time.Now(), Outcome: job.Running}
+	if err := db.InsertJobRun(ctx, run); err != nil {
+		t.Fatal(err)
+	}
+	run.FinishedAt = time.Now()
+	run.Outcome = job.Succeeded
+	run.Counts = map[string]int64{"loaded": 3}
+	if err := db.UpdateJobRun(ctx, run); err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := db.GetJobRuns(ctx, "test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Outcome != job.Succeeded || runs[0].Counts["loaded"] != 3 {
+		t.Errorf("Expected the finished run to be recorded")
+	}
+}
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	if err := db.CreateBaseTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"0001-24-01.htm", "0001-24-01/ex13.htm", "0001-24-02.htm"} {
+		arc := &bucket.Archive{Vault: "test", Key: key, ArchiveId: "old-" + key, CreatedAt: time.Now()}
+		if err := db.InsertArchive(ctx, arc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// archiving a key again replaces its archive
+	arc := &bucket.Archive{Vault: "test", Key: "0001-24-01.htm", ArchiveId: "new", CreatedAt: time.Now()}
+	if err := db.InsertArchive(ctx, arc); err != nil {
+		t.Fatal(err)
+	}
+	arc, err := db.GetArchive(ctx, "test", "0001-24-01.htm")
+	if err != nil || arc.ArchiveId != "new" {
+		t.Errorf("Expected the archive to be replaced but got %v", err)
+	}
+	arcs, err := db.GetArchives(ctx, "test", "0001-24-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arcs) != 2 || arcs[0].Key != "0001-24-01.htm" || arcs[1].Key != "0001-24-01/ex13.htm" {
+		t.Errorf("Expected the archives of the prefix in order of their keys")
+	}
+
+	if _, err := db.GetRetrieval(ctx, "test", "0001-24-01.htm"); err != database.NotFoundErr {
+		t.Errorf("Expected no retrieval but got %v", err)
+	}
+	ret := &bucket.Retrieval{Vault: "test", Key: "0001-24-01.htm", ArchiveId: "new", JobId: "job", Tier: "Bulk", RequestedAt: time.Now()}
+	if err := db.UpdateRetrieval(ctx, ret); err != nil {
+		t.Fatal(err)
+	}
+	ret.CompletedAt = time.Now()
+	if err := db.UpdateRetrieval(ctx, ret); err != nil {
+		t.Fatal(err)
+	}
+	ret, err = db.GetRetrieval(ctx, "test", "0001-24-01.htm")
+	if err != nil || ret.JobId != "job" || ret.CompletedAt.IsZero() {
+		t.Errorf("Expected the completed retrieval but got %v", err)
+	}
+}
+
+func TestArchivedFile(t *testing.T) {
+	ctx := context.Background()
+	if err := db.CreateBaseTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertCompany(ctx, &filing.Company{Cik: "0000000003", Name: "Archive Corp"}); err != nil {
+		t.Fatal(err)
+	}
+	fil := &filing.Filing{Id: "000000000324000001", Form: "10-K", MainFile: &filing.File{Key: "main.htm"}}
+	if err := db.InsertFiling(ctx, "0000000003", fil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second upload of a document replaces its receipt
+	for _, loc := range []string{"first", "second"} {
+		file := &filing.ArchivedFile{
+			FilingId:   fil.Id,
+			Key:        fil.Id + ".htm",
+			Location:   loc,
+			TreeHash:   strings.Repeat("a", 64),
+			Size:       42,
+			ArchivedAt: time.Now(),
+		}
+		if err := db.InsertArchivedFile(ctx, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unknown := &filing.ArchivedFile{FilingId: "000000000324999999", Key: "x.htm", ArchivedAt: time.Now()}
+	if err := db.InsertArchivedFile(ctx, unknown); err != database.InvalidRefErr {
+		t.Errorf("Expected an invalid reference but got %v", err)
+	}
+
+	files, err := db.GetArchivedFiles(ctx, &database.FilingFilter{Cik: "0000000003"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Location != "second" || files[0].Size != 42 {
+		t.Errorf("Expected the receipt of the second upload")
+	}
+
+	files, err = db.GetArchivedFiles(ctx, &database.FilingFilter{Ids: []string{"000000000324000002"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected no receipts of other filings")
+	}
+}
@@ -0,0 +1,414 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+	"github.com/jackc/pgx/v5"
+)
+
+// upper bound of the delay before a message is delivered again
+const maxBackoff = 10 * time.Minute
+
+// receivers check the table at least this often in case a notification was missed
+const maxWait = time.Minute
+
+// named queue in the queue_message table, any number of processes can send and receive
+// messages of the same queue since rows are claimed with SKIP LOCKED
+type Queue struct {
+	db   *postgres
+	name string
+
+	priority      func(msg []byte) int64
+	lease         time.Duration
+	maxDeliveries int
+	backoff       time.Duration
+
+	mutex     sync.Mutex
+	wake      chan struct{}
+	listening bool
+	stop      context.CancelFunc
+}
+
+type QueueOption func(*Queue)
+
+// messages with a higher priority are received first, messages of the same
+// priority are received in the order they were sent
+func WithPriority(priority func(msg []byte) int64) QueueOption {
+	return func(q *Queue) {
+		q.priority = priority
+	}
+}
+
+// a received message is hidden from other receivers for the duration of the lease, if it is
+// neither acknowledged nor rejected in time it is delivered again
+func WithLease(lease time.Duration) QueueOption {
+	return func(q *Queue) {
+		q.lease = lease
+	}
+}
+
+// a message which was not acknowledged is delivered again after the backoff which
+// doubles with every delivery, after the maximal number of deliveries it is moved
+// to the dead letters, zero deliveries means no limit
+func WithRetry(maxDeliveries int, backoff time.Duration) QueueOption {
+	return func(q *Queue) {
+		q.maxDeliveries = maxDeliveries
+		q.backoff = backoff
+	}
+}
+
+// the database has to be a postgres database whose base tables were created
+func NewQueue(db database.Database, name string, opts ...QueueOption) (*Queue, error) {
+	pg, ok := db.(*postgres)
+	if !ok {
+		return nil, errors.New("Queues can only be kept in a postgres database")
+	}
+	if len(name) < 1 {
+		return nil, errors.New("Queue name must not be empty")
+	}
+
+	q := &Queue{db: pg, name: name, lease: 30 * time.Minute, wake: make(chan struct{})}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q, nil
+}
+
+func (q *Queue) SendMessage(ctx context.Context, body []byte) error {
+
+	ctx, cancel := q.db.withTimeout(ctx)
+	defer cancel()
+
+	var prio int64
+	if q.priority != nil {
+		prio = q.priority(body)
+	}
+
+	_, err := q.db.conn.Exec(
+		ctx,
+		`WITH msg AS (
+			INSERT INTO queue_message (queue, body, priority) VALUES ($1, $2, $3) RETURNING id
+		)
+		SELECT pg_notify($4, '') FROM msg;`,
+		q.name,
+		body,
+		prio,
+		q.channel(),
+	)
+	return err
+}
+
+// waits for a notification of the queue until a message can be claimed
+func (q *Queue) RecvMessage(ctx context.Context) (*queue.Message, error) {
+	for {
+		// the waiter is taken before the claim so no notification in between is missed
+		wake := q.waiter()
+
+		msg, err := q.claim(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if msg != nil {
+			return msg, nil
+		}
+
+		wait, drained, err := q.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if drained {
+			q.unlisten()
+			return nil, queue.DrainedErr
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (q *Queue) Ack(ctx context.Context, msg *queue.Message) error {
+
+	ctx, cancel := q.db.withTimeout(ctx)
+	defer cancel()
+
+	id, err := strconv.ParseInt(msg.Id, 10, 64)
+	if err != nil {
+		return queue.StaleErr
+	}
+
+	tag, err := q.db.conn.Exec(
+		ctx,
+		`DELETE FROM queue_message WHERE id = $1 AND deliveries = $2;`,
+		id,
+		msg.Deliveries,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() < 1 {
+		// the lease expired and the message was delivered again or dead lettered
+		return queue.StaleErr
+	}
+	return nil
+}
+
+func (q *Queue) Nack(ctx context.Context, msg *queue.Message, cause error) error {
+
+	id, err := strconv.ParseInt(msg.Id, 10, 64)
+	if err != nil {
+		return queue.StaleErr
+	}
+
+	if q.maxDeliveries > 0 && msg.Deliveries >= q.maxDeliveries {
+		return q.bury(ctx, id, msg.Deliveries, cause.Error())
+	}
+
+	ctx, cancel := q.db.withTimeout(ctx)
+	defer cancel()
+
+	// receivers are notified so they can wait for the new visibility of the message
+	var found bool
+	err = q.db.conn.QueryRow(
+		ctx,
+		`WITH msg AS (
+			UPDATE queue_message SET visible_at = now() + $3::INTERVAL
+				WHERE id = $1 AND deliveries = $2 RETURNING id
+		)
+		SELECT EXISTS (SELECT 1 FROM msg) FROM (SELECT pg_notify($4, '')) AS notified;`,
+		id,
+		msg.Deliveries,
+		backoff(q.backoff, msg.Deliveries),
+		q.channel(),
+	).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return queue.StaleErr
+	}
+	return nil
+}
+
+// marks the queue as closed, receivers return once no messages are left
+func (q *Queue) Close() error {
+
+	ctx, cancel := q.db.withTimeout(context.Background())
+	defer cancel()
+
+	_, err := q.db.conn.Exec(
+		ctx,
+		`WITH closed AS (
+			INSERT INTO queue_state (queue, closed_at) VALUES ($1, now())
+				ON CONFLICT (queue) DO UPDATE SET closed_at = EXCLUDED.closed_at
+		)
+		SELECT pg_notify($2, '');`,
+		q.name,
+		q.channel(),
+	)
+	return err
+}
+
+// removes the closed state of an earlier run so receivers wait for the messages of the new one,
+// it has to be called before the receivers of the new run are started
+func (q *Queue) Reopen(ctx context.Context) error {
+
+	ctx, cancel := q.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := q.db.conn.Exec(ctx, `DELETE FROM queue_state WHERE queue = $1;`, q.name)
+	return err
+}
+
+// claims the next visible message for the duration of the lease, returns nil if there is none
+func (q *Queue) claim(ctx context.Context) (*queue.Message, error) {
+	for {
+		tctx, cancel := q.db.withTimeout(ctx)
+		var id int64
+		msg := &queue.Message{}
+		err := q.db.conn.QueryRow(
+			tctx,
+			`UPDATE queue_message
+				SET deliveries = deliveries + 1, visible_at = now() + $2::INTERVAL
+			WHERE id = (
+				SELECT id FROM queue_message WHERE queue = $1 AND visible_at <= now()
+					ORDER BY priority DESC, id ASC LIMIT 1 FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, body, deliveries;`,
+			q.name,
+			q.lease,
+		).Scan(&id, &msg.Body, &msg.Deliveries)
+		cancel()
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		msg.Id = strconv.FormatInt(id, 10)
+
+		// the lease of the last allowed delivery expired without an answer
+		if q.maxDeliveries > 0 && msg.Deliveries > q.maxDeliveries {
+			err := q.bury(ctx, id, msg.Deliveries, "Lease expired")
+			if err != nil && !errors.Is(err, queue.StaleErr) {
+				return nil, err
+			}
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// moves the message to the dead letters within a single statement
+func (q *Queue) bury(ctx context.Context, id int64, deliveries int, cause string) error {
+
+	ctx, cancel := q.db.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := q.db.conn.Exec(
+		ctx,
+		`WITH msg AS (
+			DELETE FROM queue_message WHERE id = $1 AND deliveries = $2 RETURNING id, body, deliveries
+		)
+		INSERT INTO dead_letter (id, queue, body, deliveries, error, created_at)
+			SELECT $3::TEXT || '-' || id::TEXT, $3, body, deliveries, $4, $5 FROM msg;`,
+		id,
+		deliveries,
+		q.name,
+		cause,
+		time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("Database error: %s", err.Error())
+	}
+	if tag.RowsAffected() < 1 {
+		return queue.StaleErr
+	}
+	return nil
+}
+
+// time until the next message becomes visible and whether the queue is closed and empty
+func (q *Queue) next(ctx context.Context) (time.Duration, bool, error) {
+
+	ctx, cancel := q.db.withTimeout(ctx)
+	defer cancel()
+
+	var micros *int64
+	var closed bool
+	err := q.db.conn.QueryRow(
+		ctx,
+		`SELECT
+			(SELECT (EXTRACT(EPOCH FROM min(visible_at) - now()) * 1000000)::BIGINT
+				FROM queue_message WHERE queue = $1),
+			EXISTS (SELECT 1 FROM queue_state WHERE queue = $1);`,
+		q.name,
+	).Scan(&micros, &closed)
+	if err != nil {
+		return 0, false, err
+	}
+	if micros == nil {
+		return maxWait, closed, nil
+	}
+	wait := time.Duration(*micros) * time.Microsecond
+	return max(min(wait, maxWait), time.Millisecond), false, nil
+}
+
+// returns a channel which is closed on the next notification of the queue, the listening
+// connection is started with the first waiter and shared by all receivers
+func (q *Queue) waiter() <-chan struct{} {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.listening {
+		ctx, cancel := context.WithCancel(context.Background())
+		q.listening = true
+		q.stop = cancel
+		go q.listen(ctx)
+	}
+	return q.wake
+}
+
+// keeps one connection of the pool listening on the channel of the queue until it is stopped
+func (q *Queue) listen(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := q.wait(ctx)
+		if err != nil && ctx.Err() == nil {
+			// receivers fall back to checking the table until the connection is back
+			q.broadcast()
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+func (q *Queue) wait(ctx context.Context) error {
+	conn, err := q.db.conn.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// the connection is still listening so it is closed instead of returned to the pool
+	defer func() {
+		conn.Hijack().Close(context.Background())
+	}()
+
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{q.channel()}.Sanitize())
+	if err != nil {
+		return err
+	}
+	// messages sent before the connection was listening have to be checked once more
+	q.broadcast()
+
+	for {
+		_, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		q.broadcast()
+	}
+}
+
+// wakes up all receivers which are currently waiting
+func (q *Queue) broadcast() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+// releases the listening connection once the queue is drained
+func (q *Queue) unlisten() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.listening {
+		q.stop()
+		q.listening = false
+	}
+}
+
+func (q *Queue) channel() string {
+	return "queue_" + q.name
+}
+
+// the base delay doubles with every delivery of the message
+func backoff(base time.Duration, deliveries int) time.Duration {
+	delay := base
+	for i := 1; i < deliveries && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
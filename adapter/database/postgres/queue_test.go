@@ -0,0 +1,129 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+)
+
+func TestQueue(t *testing.T) {
+	ctx := context.Background()
+	if err := db.CreateBaseTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// two handles on the same queue stand for two processes
+	send, err := NewQueue(db, "test", WithRetry(2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv, err := NewQueue(db, "test", WithRetry(2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver is woken up by the notification of the sender
+	got := make(chan string)
+	go func() {
+		msg, err := recv.RecvMessage(ctx)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		recv.Ack(ctx, msg)
+		got <- string(msg.Body)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if err := send.SendMessage(ctx, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if body := <-got; body != "first" {
+		t.Errorf("Expected 'first' but got '%s'", body)
+	}
+	if time.Since(start) > maxWait/2 {
+		t.Errorf("Receiver was not woken up by the notification")
+	}
+
+	// a message which fails on every delivery is moved to the dead letters
+	if err := send.SendMessage(ctx, []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		msg, err := recv.RecvMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Deliveries != i {
+			t.Errorf("Expected delivery %d but got %d", i, msg.Deliveries)
+		}
+		if err := recv.Nack(ctx, msg, errors.New("failed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dls, err := db.GetDeadLetters(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) != 1 || string(dls[0].Body) != "second" {
+		t.Errorf("Expected one dead letter but got %d", len(dls))
+	}
+
+	// receivers return once the closed queue is empty
+	if err := send.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = recv.RecvMessage(ctx)
+	if err != queue.DrainedErr {
+		t.Errorf("Expected the queue to be drained")
+	}
+
+	// the closed state of the last run does not drain the receivers of the next one
+	if err := send.Reopen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, err = recv.RecvMessage(wctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected the reopened queue to wait for messages but got %v", err)
+	}
+}
+
+func TestQueueLease(t *testing.T) {
+	ctx := context.Background()
+	if err := db.CreateBaseTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewQueue(db, "lease", WithLease(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SendMessage(ctx, []byte("lease")); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := q.RecvMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := q.RecvMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Id != first.Id || second.Deliveries != 2 {
+		t.Errorf("Expected the message to be delivered again after the lease")
+	}
+
+	// the answer to the expired delivery is ignored
+	if err := q.Ack(ctx, first); err == nil {
+		t.Errorf("Expected a stale error")
+	}
+	if err := q.Ack(ctx, second); err != nil {
+		t.Error(err)
+	}
+}
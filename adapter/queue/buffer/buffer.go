@@ -1,55 +1,345 @@
 package buffer
 
 import (
+	"container/heap"
+	"context"
 	"errors"
 	"sync"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+	"github.com/google/uuid"
 )
 
+// upper bound of the delay before a message is delivered again
+const maxBackoff = 10 * time.Minute
+
 type buffer struct {
-	msgs  [][]byte
-	mutex sync.Mutex
-	cond  *sync.Cond
-	drain bool
+	msgs     items
+	flight   map[string]*flight
+	delayed  int
+	seq      uint64
+	mutex    sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	drain    bool
+
+	priority func(msg []byte) int64
+	capacity int
+	block    bool
+
+	maxDeliveries int
+	backoff       time.Duration
+	visibility    time.Duration
+	name          string
+	dead          func(ctx context.Context, dl *queue.DeadLetter) error
+}
+
+// message which was received but not acknowledged yet
+type flight struct {
+	it    *item
+	timer *time.Timer
+}
+
+type Option func(*buffer)
+
+// messages with a higher priority are received first, messages of the same
+// priority are received in the order they were sent
+func WithPriority(priority func(msg []byte) int64) Option {
+	return func(b *buffer) {
+		b.priority = priority
+	}
+}
+
+// limits the number of messages in the buffer including the ones in flight, sending
+// to a full buffer either blocks until a message is acknowledged or fails with a full error
+func WithCapacity(capacity int, block bool) Option {
+	return func(b *buffer) {
+		b.capacity = capacity
+		b.block = block
+	}
 }
 
-func New() *buffer {
-	b := &buffer{drain: false}
-	b.cond = sync.NewCond(&b.mutex)
+// a message which was not acknowledged is delivered again after the backoff which
+// doubles with every delivery, after the maximal number of deliveries it is handed
+// to the dead letters or dropped if there are none, zero deliveries means no limit
+func WithRetry(maxDeliveries int, backoff time.Duration) Option {
+	return func(b *buffer) {
+		b.maxDeliveries = maxDeliveries
+		b.backoff = backoff
+	}
+}
+
+// messages which are neither acknowledged nor rejected within the timeout count as failed
+func WithVisibility(timeout time.Duration) Option {
+	return func(b *buffer) {
+		b.visibility = timeout
+	}
+}
+
+// failed messages are handed to the function with the name of the queue
+func WithDeadLetters(name string, dead func(ctx context.Context, dl *queue.DeadLetter) error) Option {
+	return func(b *buffer) {
+		b.name = name
+		b.dead = dead
+	}
+}
+
+// without options the buffer is an unbounded FIFO queue which delivers failed messages
+// again immediately and without limit
+func New(opts ...Option) *buffer {
+	b := &buffer{drain: false, flight: make(map[string]*flight)}
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.notEmpty = sync.NewCond(&b.mutex)
+	b.notFull = sync.NewCond(&b.mutex)
 	return b
 }
 
-func (q *buffer) SendMessage(msg []byte) error {
+func (q *buffer) SendMessage(ctx context.Context, body []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// the priority is computed once since messages are compared many times
+	var prio int64
+	if q.priority != nil {
+		prio = q.priority(body)
+	}
+
+	stop := q.wakeOnDone(ctx, q.notFull)
+	defer stop()
+
 	q.mutex.Lock()
-	q.msgs = append(q.msgs, msg)
-	q.mutex.Unlock()
+	defer q.mutex.Unlock()
+
+	// wait for a free slot if the buffer is full
+	for q.capacity > 0 && q.size() >= q.capacity {
+		if !q.block {
+			return queue.FullErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.notFull.Wait()
+	}
+
+	heap.Push(&q.msgs, &item{id: uuid.NewString(), msg: body, prio: prio, seq: q.seq})
+	q.seq++
 
 	// wake up one waiting consumer
-	q.cond.Signal()
+	q.notEmpty.Signal()
 	return nil
 }
 
-func (q *buffer) RecvMessage() ([]byte, error) {
+func (q *buffer) RecvMessage(ctx context.Context) (*queue.Message, error) {
+	stop := q.wakeOnDone(ctx, q.notEmpty)
+	defer stop()
+
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
 	// wait for a message if buffer is empty
 	for len(q.msgs) < 1 {
-		if q.drain {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// messages in flight or waiting for their redelivery might still come back
+		if q.drain && len(q.flight) < 1 && q.delayed < 1 {
 			// no new messages will enter the buffer
-			return nil, errors.New("Queue has been drained")
+			return nil, queue.DrainedErr
 		}
-		q.cond.Wait()
+		q.notEmpty.Wait()
 	}
 
-	// consume message and delete it
-	msg := q.msgs[len(q.msgs)-1]
-	q.msgs = q.msgs[:len(q.msgs)-1]
-	return msg, nil
+	it := heap.Pop(&q.msgs).(*item)
+	it.deliveries++
+
+	f := &flight{it: it}
+	if q.visibility > 0 {
+		id, deliveries := it.id, it.deliveries
+		f.timer = time.AfterFunc(q.visibility, func() {
+			q.expire(id, deliveries)
+		})
+	}
+	q.flight[it.id] = f
+
+	return &queue.Message{Id: it.id, Body: it.msg, Deliveries: it.deliveries}, nil
+}
+
+func (q *buffer) Ack(ctx context.Context, msg *queue.Message) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	_, err := q.land(msg.Id, msg.Deliveries)
+	if err != nil {
+		return err
+	}
+
+	// wake up one waiting producer and all consumers which might wait for the drain
+	q.notFull.Signal()
+	q.notEmpty.Broadcast()
+	return nil
+}
+
+func (q *buffer) Nack(ctx context.Context, msg *queue.Message, cause error) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	it, err := q.land(msg.Id, msg.Deliveries)
+	if err != nil {
+		return err
+	}
+	return q.retry(ctx, it, cause)
 }
 
 func (q *buffer) Close() error {
+	q.mutex.Lock()
 	q.drain = true
+	q.mutex.Unlock()
+
 	// wake up all waiting routines to let them recheck the drain flag
-	q.cond.Broadcast()
+	q.notEmpty.Broadcast()
+	return nil
+}
+
+// number of messages which are not acknowledged yet
+func (q *buffer) size() int {
+	return len(q.msgs) + len(q.flight) + q.delayed
+}
+
+// removes the delivery of a message from the messages in flight, must be called with the lock held
+func (q *buffer) land(id string, deliveries int) (*item, error) {
+	f := q.flight[id]
+	if f == nil || f.it.deliveries != deliveries {
+		return nil, queue.StaleErr
+	}
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	delete(q.flight, id)
+	return f.it, nil
+}
+
+func (q *buffer) expire(id string, deliveries int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	it, err := q.land(id, deliveries)
+	if err != nil {
+		// the message was settled in the meantime
+		return
+	}
+	q.retry(context.Background(), it, errors.New("Visibility timeout expired"))
+}
+
+// schedules the redelivery of a failed message or hands it to the dead letters, must be
+// called with the lock held which is released while the dead letter is written
+func (q *buffer) retry(ctx context.Context, it *item, cause error) error {
+
+	if q.maxDeliveries > 0 && it.deliveries >= q.maxDeliveries {
+		if q.dead == nil {
+			q.notFull.Signal()
+			q.notEmpty.Broadcast()
+			return nil
+		}
+
+		// the message still counts while it is written so the queue is not drained too early
+		q.delayed++
+		q.mutex.Unlock()
+		err := q.dead(ctx, &queue.DeadLetter{
+			Id:         it.id,
+			Queue:      q.name,
+			Body:       it.msg,
+			Deliveries: it.deliveries,
+			Error:      cause.Error(),
+			CreatedAt:  time.Now(),
+		})
+		q.mutex.Lock()
+		q.delayed--
+
+		if err != nil {
+			// the message must not get lost so it is delivered again
+			heap.Push(&q.msgs, it)
+			q.notEmpty.Signal()
+			return err
+		}
+		q.notFull.Signal()
+		q.notEmpty.Broadcast()
+		return nil
+	}
+
+	delay := backoff(q.backoff, it.deliveries)
+	if delay <= 0 {
+		heap.Push(&q.msgs, it)
+		q.notEmpty.Signal()
+		return nil
+	}
+
+	q.delayed++
+	time.AfterFunc(delay, func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		q.delayed--
+		heap.Push(&q.msgs, it)
+		q.notEmpty.Signal()
+	})
 	return nil
 }
+
+// the base delay doubles with every delivery of the message
+func backoff(base time.Duration, deliveries int) time.Duration {
+	delay := base
+	for i := 1; i < deliveries && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+// wakes up all routines waiting on the condition when the context is done to let them recheck it
+func (q *buffer) wakeOnDone(ctx context.Context, cond *sync.Cond) func() bool {
+	return context.AfterFunc(ctx, func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		cond.Broadcast()
+	})
+}
+
+type item struct {
+	id         string
+	msg        []byte
+	prio       int64
+	seq        uint64
+	deliveries int
+}
+
+// heap of messages ordered by priority and then by the order they were sent
+type items []*item
+
+func (h items) Len() int {
+	return len(h)
+}
+
+func (h items) Less(i, j int) bool {
+	if h[i].prio != h[j].prio {
+		return h[i].prio > h[j].prio
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h items) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *items) Push(x any) {
+	*h = append(*h, x.(*item))
+}
+
+func (h *items) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,181 @@
+package buffer
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+)
+
+func recvAll(q *buffer) []string {
+	q.Close()
+	result := []string{}
+	for {
+		msg, err := q.RecvMessage(context.Background())
+		if err != nil {
+			return result
+		}
+		q.Ack(context.Background(), msg)
+		result = append(result, string(msg.Body))
+	}
+}
+
+func TestFifo(t *testing.T) {
+
+	q := New()
+	for _, v := range []string{"1", "2", "3"} {
+		if err := q.SendMessage(context.Background(), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := recvAll(q)
+	if len(got) != 3 || got[0] != "1" || got[1] != "2" || got[2] != "3" {
+		t.Errorf("Expected messages in order they were sent but got %v", got)
+	}
+}
+
+func TestPriority(t *testing.T) {
+
+	// messages are numbers which are their priority
+	q := New(WithPriority(func(msg []byte) int64 {
+		v, _ := strconv.Atoi(string(msg)[:1])
+		return int64(v)
+	}))
+	for _, v := range []string{"1a", "3a", "2a", "3b", "1b"} {
+		if err := q.SendMessage(context.Background(), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := recvAll(q)
+	want := []string{"3a", "3b", "2a", "1a", "1b"}
+	for i := range want {
+		if i >= len(got) || got[i] != want[i] {
+			t.Fatalf("Expected %v but got %v", want, got)
+		}
+	}
+}
+
+func TestCapacityFail(t *testing.T) {
+
+	q := New(WithCapacity(1, false))
+	if err := q.SendMessage(context.Background(), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SendMessage(context.Background(), []byte("2")); err != queue.FullErr {
+		t.Errorf("Expected full error but got %v", err)
+	}
+}
+
+func TestCapacityBlock(t *testing.T) {
+
+	q := New(WithCapacity(1, true))
+	if err := q.SendMessage(context.Background(), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// sending blocks until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.SendMessage(ctx, []byte("2")); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline error but got %v", err)
+	}
+
+	// or until a message is received
+	sent := make(chan error)
+	go func() {
+		sent <- q.SendMessage(context.Background(), []byte("3"))
+	}()
+	select {
+	case <-sent:
+		t.Fatal("Message was sent to a full buffer")
+	case <-time.After(20 * time.Millisecond):
+	}
+	msg, err := q.RecvMessage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	got := recvAll(q)
+	if len(got) != 1 || got[0] != "3" {
+		t.Errorf("Expected only the last message but got %v", got)
+	}
+}
+
+func TestRetry(t *testing.T) {
+
+	dead := make(chan *queue.DeadLetter, 1)
+	q := New(
+		WithRetry(2, time.Millisecond),
+		WithDeadLetters("test", func(ctx context.Context, dl *queue.DeadLetter) error {
+			dead <- dl
+			return nil
+		}),
+	)
+	if err := q.SendMessage(context.Background(), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// the message is delivered again after it was rejected
+	for i := 1; i <= 2; i++ {
+		msg, err := q.RecvMessage(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Deliveries != i {
+			t.Errorf("Expected delivery %d but got %d", i, msg.Deliveries)
+		}
+		if err := q.Nack(context.Background(), msg, errors.New("failed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// after the maximal number of deliveries it is a dead letter
+	dl := <-dead
+	if dl.Queue != "test" || dl.Deliveries != 2 || dl.Error != "failed" || string(dl.Body) != "1" {
+		t.Errorf("Unexpected dead letter %v", dl)
+	}
+	if _, err := q.RecvMessage(context.Background()); err != queue.DrainedErr {
+		t.Errorf("Expected the queue to be drained")
+	}
+}
+
+func TestVisibility(t *testing.T) {
+
+	q := New(WithVisibility(10 * time.Millisecond))
+	if err := q.SendMessage(context.Background(), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	first, err := q.RecvMessage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the drained queue still delivers the message again once it was not acknowledged in time
+	second, err := q.RecvMessage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Id != first.Id || second.Deliveries != 2 {
+		t.Errorf("Expected second delivery of the same message but got %v", second)
+	}
+	if err := q.Ack(context.Background(), first); err != queue.StaleErr {
+		t.Errorf("Expected stale error but got %v", err)
+	}
+	if err := q.Ack(context.Background(), second); err != nil {
+		t.Fatal(err)
+	}
+}
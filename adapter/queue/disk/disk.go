@@ -0,0 +1,738 @@
+// Package disk implements a durable queue on top of an append-only log in a local directory.
+//
+// Messages are appended to segment files named after the offset of their first message.
+// Every record consists of the length and the CRC-32 checksum of the body followed by
+// the body itself. Acknowledged offsets are appended to 'acks.log' and the offset below
+// which all messages are acknowledged is kept in the file 'offset'. Segments and
+// acknowledgements below that offset are removed by compaction.
+//
+// After a restart all messages which were not acknowledged are delivered again, their
+// delivery counts start from zero since only acknowledgements are persisted.
+package disk
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+)
+
+// upper bound of the delay before a message is delivered again
+const maxBackoff = 10 * time.Minute
+
+// the acknowledgements are rewritten once they contain this many outdated entries
+const compactAcks = 1024
+
+const headerLen = 8
+
+type Sync int
+
+const (
+	// every message and acknowledgement is flushed to disk before the call returns
+	SyncAlways Sync = iota
+	// the files are flushed periodically so a crash loses at most one interval
+	SyncInterval
+	// flushing is left to the operating system
+	SyncNever
+)
+
+type segment struct {
+	base  int64
+	path  string
+	index []int64
+	size  int64
+}
+
+type disk struct {
+	dir      string
+	segments []*segment
+	writer   *os.File
+	acks     *os.File
+	ackCount int
+
+	next       int64
+	read       int64
+	commit     int64
+	acked      map[int64]bool
+	ready      []int64
+	deliveries map[int64]int
+	flight     map[int64]*time.Timer
+	delayed    int
+
+	mutex    sync.Mutex
+	notEmpty *sync.Cond
+	drain    bool
+	closed   bool
+	stop     chan struct{}
+
+	sync          Sync
+	interval      time.Duration
+	segmentSize   int64
+	maxDeliveries int
+	backoff       time.Duration
+	visibility    time.Duration
+	name          string
+	dead          func(ctx context.Context, dl *queue.DeadLetter) error
+}
+
+type Option func(*disk)
+
+// the interval is only used with periodic flushing
+func WithSync(sync Sync, interval time.Duration) Option {
+	return func(d *disk) {
+		d.sync = sync
+		d.interval = interval
+	}
+}
+
+// a new segment is started once the current one is larger than the size in bytes
+func WithSegmentSize(size int64) Option {
+	return func(d *disk) {
+		d.segmentSize = size
+	}
+}
+
+// a message which was not acknowledged is delivered again after the backoff which
+// doubles with every delivery, after the maximal number of deliveries it is handed
+// to the dead letters or dropped if there are none, zero deliveries means no limit
+func WithRetry(maxDeliveries int, backoff time.Duration) Option {
+	return func(d *disk) {
+		d.maxDeliveries = maxDeliveries
+		d.backoff = backoff
+	}
+}
+
+// messages which are neither acknowledged nor rejected within the timeout count as failed
+func WithVisibility(timeout time.Duration) Option {
+	return func(d *disk) {
+		d.visibility = timeout
+	}
+}
+
+// failed messages are handed to the function with the name of the queue
+func WithDeadLetters(name string, dead func(ctx context.Context, dl *queue.DeadLetter) error) Option {
+	return func(d *disk) {
+		d.name = name
+		d.dead = dead
+	}
+}
+
+// opens the queue in the directory and resumes with all messages which were not acknowledged
+func New(dir string, opts ...Option) (*disk, error) {
+
+	d := &disk{
+		dir:         dir,
+		acked:       make(map[int64]bool),
+		deliveries:  make(map[int64]int),
+		flight:      make(map[int64]*time.Timer),
+		stop:        make(chan struct{}),
+		sync:        SyncAlways,
+		interval:    time.Second,
+		segmentSize: 64 << 20,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	d.notEmpty = sync.NewCond(&d.mutex)
+	if d.sync == SyncInterval && d.interval <= 0 {
+		return nil, errors.New("Sync interval must be greater than zero")
+	}
+
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+	err = d.load()
+	if err != nil {
+		return nil, err
+	}
+
+	if d.sync == SyncInterval {
+		go d.flushPeriodically()
+	}
+	return d, nil
+}
+
+func (d *disk) SendMessage(ctx context.Context, body []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.drain {
+		return errors.New("Queue has been closed")
+	}
+
+	err := d.append(body)
+	if err != nil {
+		return err
+	}
+
+	// wake up one waiting consumer
+	d.notEmpty.Signal()
+	return nil
+}
+
+func (d *disk) RecvMessage(ctx context.Context) (*queue.Message, error) {
+	// wake up all waiting routines when the context is done to let them recheck it
+	stop := context.AfterFunc(ctx, func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		d.notEmpty.Broadcast()
+	})
+	defer stop()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		offset, ok := d.take()
+		if ok {
+			body, err := d.body(offset)
+			if err != nil {
+				return nil, err
+			}
+			return d.deliver(offset, body), nil
+		}
+
+		// messages in flight or waiting for their redelivery might still come back
+		if d.drain && len(d.flight) < 1 && d.delayed < 1 {
+			d.finish()
+			return nil, queue.DrainedErr
+		}
+		d.notEmpty.Wait()
+	}
+}
+
+func (d *disk) Ack(ctx context.Context, msg *queue.Message) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	offset, err := d.land(msg)
+	if err != nil {
+		return err
+	}
+	err = d.ack(offset)
+
+	// wake up all consumers which might wait for the drain
+	d.notEmpty.Broadcast()
+	return err
+}
+
+func (d *disk) Nack(ctx context.Context, msg *queue.Message, cause error) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	offset, err := d.land(msg)
+	if err != nil {
+		return err
+	}
+	return d.retry(ctx, offset, cause)
+}
+
+// no more messages can be sent, the messages in the log can still be received
+func (d *disk) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.drain {
+		return nil
+	}
+	d.drain = true
+
+	// wake up all waiting routines to let them recheck the drain flag
+	d.notEmpty.Broadcast()
+
+	err := d.writer.Sync()
+	if err != nil {
+		return err
+	}
+	return d.writer.Close()
+}
+
+// reads the state of the queue from the directory
+func (d *disk) load() error {
+
+	data, err := os.ReadFile(filepath.Join(d.dir, "offset"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		d.commit, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("Offset file is corrupt: %s", err.Error())
+		}
+	}
+
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name, found := strings.CutSuffix(e.Name(), ".log")
+		if !found || e.Name() == "acks.log" {
+			continue
+		}
+		base, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		d.segments = append(d.segments, &segment{base: base, path: filepath.Join(d.dir, e.Name())})
+	}
+	sort.Slice(d.segments, func(i, j int) bool { return d.segments[i].base < d.segments[j].base })
+
+	d.next = d.commit
+	for i, seg := range d.segments {
+		// only the last segment can have a torn record from a crash while writing
+		err = seg.scan(i == len(d.segments)-1)
+		if err != nil {
+			return err
+		}
+		d.next = seg.base + int64(len(seg.index))
+	}
+
+	err = d.loadAcks()
+	if err != nil {
+		return err
+	}
+	d.read = d.commit
+
+	if len(d.segments) < 1 || d.segments[len(d.segments)-1].size >= d.segmentSize {
+		return d.roll()
+	}
+	last := d.segments[len(d.segments)-1]
+	d.writer, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0666)
+	return err
+}
+
+func (d *disk) loadAcks() error {
+
+	path := filepath.Join(d.dir, "acks.log")
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// a torn acknowledgement at the end was never confirmed so it is dropped
+	valid := len(data) - len(data)%8
+	for i := 0; i < valid; i += 8 {
+		offset := int64(binary.BigEndian.Uint64(data[i : i+8]))
+		if offset >= d.commit {
+			d.acked[offset] = true
+		}
+	}
+	d.ackCount = valid / 8
+
+	d.acks, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if valid < len(data) {
+		return d.acks.Truncate(int64(valid))
+	}
+	return nil
+}
+
+// builds the positions of the records and truncates a torn record at the end
+func (s *segment) scan(last bool) error {
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	header := make([]byte, headerLen)
+	var pos int64
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			length := int64(binary.BigEndian.Uint32(header[:4]))
+			body := make([]byte, length)
+			_, err = io.ReadFull(r, body)
+			if err == nil && crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+				err = errors.New("Checksum mismatch")
+			}
+			if err == nil {
+				s.index = append(s.index, pos)
+				pos += headerLen + length
+				continue
+			}
+		}
+		if !last {
+			return fmt.Errorf("Segment '%s' is corrupt: %s", s.path, err.Error())
+		}
+		break
+	}
+
+	s.size = pos
+	return os.Truncate(s.path, pos)
+}
+
+// starts a new segment with the next offset
+func (d *disk) roll() error {
+
+	if d.writer != nil {
+		err := d.writer.Sync()
+		if err != nil {
+			return err
+		}
+		err = d.writer.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	seg := &segment{base: d.next, path: filepath.Join(d.dir, fmt.Sprintf("%020d.log", d.next))}
+	file, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	d.writer = file
+	d.segments = append(d.segments, seg)
+	return nil
+}
+
+func (d *disk) append(body []byte) error {
+
+	seg := d.segments[len(d.segments)-1]
+	if seg.size >= d.segmentSize {
+		err := d.roll()
+		if err != nil {
+			return err
+		}
+		seg = d.segments[len(d.segments)-1]
+	}
+
+	record := make([]byte, headerLen+len(body))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(body))
+	copy(record[headerLen:], body)
+
+	_, err := d.writer.Write(record)
+	if err != nil {
+		return err
+	}
+	if d.sync == SyncAlways {
+		err = d.writer.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	seg.index = append(seg.index, seg.size)
+	seg.size += int64(len(record))
+	d.next++
+	return nil
+}
+
+// next offset to deliver, messages to deliver again come before new ones
+func (d *disk) take() (int64, bool) {
+	if len(d.ready) > 0 {
+		offset := d.ready[0]
+		d.ready = d.ready[1:]
+		return offset, true
+	}
+	for d.read < d.next {
+		offset := d.read
+		d.read++
+		// messages acknowledged before a restart are skipped
+		if offset >= d.commit && !d.acked[offset] {
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+func (d *disk) body(offset int64) ([]byte, error) {
+
+	i := sort.Search(len(d.segments), func(i int) bool { return d.segments[i].base > offset }) - 1
+	if i < 0 || offset-d.segments[i].base >= int64(len(d.segments[i].index)) {
+		return nil, fmt.Errorf("Offset %d is not in the log", offset)
+	}
+	seg := d.segments[i]
+
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, headerLen)
+	pos := seg.index[offset-seg.base]
+	_, err = file.ReadAt(header, pos)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[:4]))
+	_, err = file.ReadAt(body, pos+headerLen)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, fmt.Errorf("Checksum mismatch of offset %d", offset)
+	}
+	return body, nil
+}
+
+func (d *disk) deliver(offset int64, body []byte) *queue.Message {
+
+	d.deliveries[offset]++
+	deliveries := d.deliveries[offset]
+
+	var timer *time.Timer
+	if d.visibility > 0 {
+		timer = time.AfterFunc(d.visibility, func() {
+			d.expire(offset, deliveries)
+		})
+	}
+	d.flight[offset] = timer
+
+	return &queue.Message{Id: strconv.FormatInt(offset, 10), Body: body, Deliveries: deliveries}
+}
+
+// removes the delivery of a message from the messages in flight
+func (d *disk) land(msg *queue.Message) (int64, error) {
+	offset, err := strconv.ParseInt(msg.Id, 10, 64)
+	if err != nil {
+		return 0, queue.StaleErr
+	}
+	timer, ok := d.flight[offset]
+	if !ok || d.deliveries[offset] != msg.Deliveries {
+		return 0, queue.StaleErr
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+	delete(d.flight, offset)
+	return offset, nil
+}
+
+func (d *disk) expire(offset int64, deliveries int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	_, err := d.land(&queue.Message{Id: strconv.FormatInt(offset, 10), Deliveries: deliveries})
+	if err != nil {
+		// the message was settled in the meantime
+		return
+	}
+	d.retry(context.Background(), offset, errors.New("Visibility timeout expired"))
+}
+
+// records the acknowledgement and compacts the log once the committed offset moves
+func (d *disk) ack(offset int64) error {
+
+	delete(d.deliveries, offset)
+
+	record := make([]byte, 8)
+	binary.BigEndian.PutUint64(record, uint64(offset))
+	_, err := d.acks.Write(record)
+	if err != nil {
+		return err
+	}
+	d.ackCount++
+	if d.sync == SyncAlways {
+		err = d.acks.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	d.acked[offset] = true
+	commit := d.commit
+	for d.acked[d.commit] {
+		delete(d.acked, d.commit)
+		d.commit++
+	}
+	if commit == d.commit {
+		return nil
+	}
+	return d.compact()
+}
+
+// persists the committed offset and removes what is below it
+func (d *disk) compact() error {
+
+	tmp := filepath.Join(d.dir, "offset.tmp")
+	err := writeFile(tmp, []byte(strconv.FormatInt(d.commit, 10)), d.sync == SyncAlways)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, filepath.Join(d.dir, "offset"))
+	if err != nil {
+		return err
+	}
+
+	// a segment can be removed once the next one starts at or below the committed offset
+	for len(d.segments) > 1 && d.segments[1].base <= d.commit {
+		err = os.Remove(d.segments[0].path)
+		if err != nil {
+			return err
+		}
+		d.segments = d.segments[1:]
+	}
+
+	if d.ackCount-len(d.acked) < compactAcks {
+		return nil
+	}
+
+	data := make([]byte, 0, 8*len(d.acked))
+	for offset := range d.acked {
+		data = binary.BigEndian.AppendUint64(data, uint64(offset))
+	}
+	tmp = filepath.Join(d.dir, "acks.tmp")
+	err = writeFile(tmp, data, true)
+	if err != nil {
+		return err
+	}
+	err = d.acks.Close()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.dir, "acks.log")
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	d.acks, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	d.ackCount = len(d.acked)
+	return nil
+}
+
+// schedules the redelivery of a failed message or hands it to the dead letters, must be
+// called with the lock held which is released while the dead letter is written
+func (d *disk) retry(ctx context.Context, offset int64, cause error) error {
+
+	deliveries := d.deliveries[offset]
+	if d.maxDeliveries > 0 && deliveries >= d.maxDeliveries {
+		if d.dead == nil {
+			return d.ack(offset)
+		}
+
+		body, err := d.body(offset)
+		if err != nil {
+			return err
+		}
+
+		// the message still counts while it is written so the queue is not drained too early
+		d.delayed++
+		d.mutex.Unlock()
+		err = d.dead(ctx, &queue.DeadLetter{
+			Id:         fmt.Sprintf("%s-%d", d.name, offset),
+			Queue:      d.name,
+			Body:       body,
+			Deliveries: deliveries,
+			Error:      cause.Error(),
+			CreatedAt:  time.Now(),
+		})
+		d.mutex.Lock()
+		d.delayed--
+
+		if err != nil {
+			// the message must not get lost so it is delivered again
+			d.ready = append(d.ready, offset)
+			d.notEmpty.Signal()
+			return err
+		}
+		err = d.ack(offset)
+		d.notEmpty.Broadcast()
+		return err
+	}
+
+	delay := backoff(d.backoff, deliveries)
+	if delay <= 0 {
+		d.ready = append(d.ready, offset)
+		d.notEmpty.Signal()
+		return nil
+	}
+
+	d.delayed++
+	time.AfterFunc(delay, func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		d.delayed--
+		d.ready = append(d.ready, offset)
+		d.notEmpty.Signal()
+	})
+	return nil
+}
+
+// releases the files once the queue is drained
+func (d *disk) finish() {
+	if d.closed {
+		return
+	}
+	d.closed = true
+	close(d.stop)
+	d.acks.Sync()
+	d.acks.Close()
+}
+
+func (d *disk) flushPeriodically() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		d.mutex.Lock()
+		if !d.drain {
+			d.writer.Sync()
+		}
+		d.acks.Sync()
+		d.mutex.Unlock()
+	}
+}
+
+// the base delay doubles with every delivery of the message
+func backoff(base time.Duration, deliveries int) time.Duration {
+	delay := base
+	for i := 1; i < deliveries && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+func writeFile(path string, data []byte, sync bool) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && sync {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,112 @@
+package disk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResume(t *testing.T) {
+
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	q, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := q.SendMessage(ctx, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first and third message are acknowledged, the second is in flight when we stop
+	for i := 0; i < 3; i++ {
+		msg, err := q.RecvMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != 1 {
+			if err := q.Ack(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// a crash while the next message was written leaves a torn record
+	segs, _ := filepath.Glob(filepath.Join(dir, "*0.log"))
+	file, err := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 0, 9, 1, 2})
+	file.Close()
+
+	q, err = New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	got := []string{}
+	for {
+		msg, err := q.RecvMessage(ctx)
+		if err != nil {
+			break
+		}
+		got = append(got, string(msg.Body))
+		if err := q.Ack(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 || got[0] != "1" || got[1] != "3" {
+		t.Errorf("Expected the unacknowledged messages 1 and 3 but got %v", got)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	// every message starts a new segment
+	q, err := New(dir, WithSegmentSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := q.SendMessage(ctx, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := q.RecvMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Ack(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segs, _ := filepath.Glob(filepath.Join(dir, "000*.log"))
+	if len(segs) != 2 {
+		t.Errorf("Expected 2 segments after compaction but got %v", segs)
+	}
+	offset, err := os.ReadFile(filepath.Join(dir, "offset"))
+	if err != nil || string(offset) != "3" {
+		t.Errorf("Expected committed offset 3 but got '%s'", offset)
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+
+	q, err := New(t.TempDir(), WithSync(SyncInterval, 0))
+	if err == nil {
+		q.Close()
+		t.Fatal("Expected an error for a zero interval")
+	}
+}
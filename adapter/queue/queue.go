@@ -1,14 +1,61 @@
 package queue
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// received messages have to be acknowledged once they are processed, messages which
+// are not acknowledged are delivered again until they are moved to the dead letters
 type Queue interface {
-	SendMessage(msg []byte) error
-	RecvMessage() ([]byte, error)
+	SendMessage(ctx context.Context, body []byte) error
+	RecvMessage(ctx context.Context) (*Message, error)
+	Ack(ctx context.Context, msg *Message) error
+	Nack(ctx context.Context, msg *Message, cause error) error
 	Close() error
 }
 
+// queues which are shared by separate processes keep their closed state after a run, the
+// stages which send to such a queue reopen it before a new run starts
+type Reopener interface {
+	Reopen(ctx context.Context) error
+}
+
+type Message struct {
+	Id         string
+	Body       []byte
+	Deliveries int
+}
+
+// message which could not be processed within the allowed number of deliveries
+type DeadLetter struct {
+	Id         string
+	Queue      string
+	Body       []byte
+	Deliveries int
+	Error      string
+	CreatedAt  time.Time
+}
+
+// returned by bounded queues which do not block when they are full
+var FullErr error = errors.New("Queue is full")
+
+// returned by receives once the queue was closed and every message is settled, stages
+// treat it as the completion of the stage before them
+var DrainedErr error = errors.New("Queue has been drained")
+
+// returned when a message is acknowledged which is not in flight anymore, e.g. because
+// its visibility timeout expired and it was delivered again
+var StaleErr error = errors.New("Message is not in flight")
+
+// claim check of a filing whose manifest and documents are kept in the spool, the message only
+// carries the reference to the manifest and the filing date to order messages without fetching it
 type FilMessage struct {
-	Cik string `json:"cik"`
-	Id  string `json:"id"`
+	Cik  string    `json:"cik"`
+	Id   string    `json:"id"`
+	Ref  string    `json:"ref"`
+	Date time.Time `json:"date"`
 }
 
 type GraphMessage struct {
@@ -0,0 +1,459 @@
+package sqsqueue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+	"github.com/google/uuid"
+)
+
+// limits of the SQS API
+const (
+	maxBatch      = 10
+	maxWait       = 20 * time.Second
+	maxVisibility = 12 * time.Hour
+)
+
+// upper bound of the delay before a message is delivered again
+const maxBackoff = 10 * time.Minute
+
+// tag of queues whose producer is done, receivers return once such a queue is empty
+const closedTag = "closed"
+
+type sqsQueue struct {
+	client *sqs.SQS
+	url    string
+	name   string
+
+	endpoint      string
+	wait          time.Duration
+	linger        time.Duration
+	attributes    func(msg []byte) map[string]string
+	maxDeliveries int
+	backoff       time.Duration
+	visibility    time.Duration
+	dead          func(ctx context.Context, dl *queue.DeadLetter) error
+
+	// messages of the last receive which were not handed out yet
+	mutex    sync.Mutex
+	received []*sqs.Message
+
+	// sends waiting to be written as one batch
+	sends  chan *send
+	close  sync.Once
+	closed chan struct{}
+	done   chan struct{}
+}
+
+type send struct {
+	ctx  context.Context
+	body []byte
+	err  chan error
+}
+
+type Option func(*sqsQueue)
+
+// points the client to another endpoint like a local emulator
+func WithEndpoint(endpoint string) Option {
+	return func(q *sqsQueue) {
+		q.endpoint = endpoint
+	}
+}
+
+// an empty receive waits up to the duration for a message to arrive, SQS allows at most 20 seconds
+func WithLongPolling(wait time.Duration) Option {
+	return func(q *sqsQueue) {
+		q.wait = wait
+	}
+}
+
+// concurrent sends within the duration are written as one batch of up to ten messages
+func WithBatching(linger time.Duration) Option {
+	return func(q *sqsQueue) {
+		q.linger = linger
+	}
+}
+
+// the returned strings are sent as attributes of the message so they can be read without the body
+func WithAttributes(attributes func(msg []byte) map[string]string) Option {
+	return func(q *sqsQueue) {
+		q.attributes = attributes
+	}
+}
+
+// a message which was not acknowledged is delivered again after the backoff which
+// doubles with every delivery, after the maximal number of deliveries it is handed
+// to the dead letters or dropped if there are none, zero deliveries means no limit
+func WithRetry(maxDeliveries int, backoff time.Duration) Option {
+	return func(q *sqsQueue) {
+		q.maxDeliveries = maxDeliveries
+		q.backoff = backoff
+	}
+}
+
+// messages which are neither acknowledged nor rejected within the timeout are delivered again
+func WithVisibility(timeout time.Duration) Option {
+	return func(q *sqsQueue) {
+		q.visibility = timeout
+	}
+}
+
+// failed messages are handed to the function with the name of the queue
+func WithDeadLetters(dead func(ctx context.Context, dl *queue.DeadLetter) error) Option {
+	return func(q *sqsQueue) {
+		q.dead = dead
+	}
+}
+
+// the queue is created with default attributes if it does not exist yet, message bodies
+// have to be valid text since SQS does not accept arbitrary bytes
+func New(ctx context.Context, awsSession *session.Session, name string, opts ...Option) (*sqsQueue, error) {
+	q := &sqsQueue{
+		name:   name,
+		wait:   maxWait,
+		sends:  make(chan *send),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+
+	cfg := aws.NewConfig()
+	if len(q.endpoint) > 0 {
+		cfg = cfg.WithEndpoint(q.endpoint)
+	}
+	q.client = sqs.New(awsSession, cfg)
+
+	out, err := q.client.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(name)})
+	if isCode(err, sqs.ErrCodeQueueDoesNotExist) {
+		var created *sqs.CreateQueueOutput
+		created, err = q.client.CreateQueueWithContext(ctx, &sqs.CreateQueueInput{QueueName: aws.String(name)})
+		if err == nil {
+			q.url = *created.QueueUrl
+		}
+	} else if err == nil {
+		q.url = *out.QueueUrl
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	go q.batch()
+	return q, nil
+}
+
+// waits until the batch containing the message was written
+func (q *sqsQueue) SendMessage(ctx context.Context, body []byte) error {
+	s := &send{ctx: ctx, body: body, err: make(chan error, 1)}
+	select {
+	case q.sends <- s:
+	case <-q.closed:
+		return errors.New("Queue has been closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-s.err:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// messages are received in batches and handed out one by one
+func (q *sqsQueue) RecvMessage(ctx context.Context) (*queue.Message, error) {
+	for {
+		q.mutex.Lock()
+		if len(q.received) > 0 {
+			m := q.received[0]
+			q.received = q.received[1:]
+			q.mutex.Unlock()
+
+			msg, err := q.message(ctx, m)
+			if err != nil || msg != nil {
+				return msg, err
+			}
+			continue
+		}
+		q.mutex.Unlock()
+
+		input := &sqs.ReceiveMessageInput{
+			QueueUrl:                    aws.String(q.url),
+			MaxNumberOfMessages:         aws.Int64(maxBatch),
+			WaitTimeSeconds:             aws.Int64(int64(min(q.wait, maxWait) / time.Second)),
+			MessageAttributeNames:       aws.StringSlice([]string{"All"}),
+			MessageSystemAttributeNames: aws.StringSlice([]string{sqs.MessageSystemAttributeNameApproximateReceiveCount}),
+		}
+		if q.visibility > 0 {
+			input.VisibilityTimeout = aws.Int64(seconds(min(q.visibility, maxVisibility)))
+		}
+		out, err := q.client.ReceiveMessageWithContext(ctx, input)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		if len(out.Messages) < 1 {
+			drained, err := q.drained(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if drained {
+				return nil, queue.DrainedErr
+			}
+			continue
+		}
+
+		q.mutex.Lock()
+		q.received = append(q.received, out.Messages...)
+		q.mutex.Unlock()
+	}
+}
+
+func (q *sqsQueue) Ack(ctx context.Context, msg *queue.Message) error {
+	_, err := q.client.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(q.url),
+		ReceiptHandle: aws.String(msg.Id),
+	})
+	return stale(err)
+}
+
+func (q *sqsQueue) Nack(ctx context.Context, msg *queue.Message, cause error) error {
+	if q.maxDeliveries > 0 && msg.Deliveries >= q.maxDeliveries {
+		return q.bury(ctx, msg, cause.Error())
+	}
+
+	// the message becomes visible again once the backoff is over
+	_, err := q.client.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.url),
+		ReceiptHandle:     aws.String(msg.Id),
+		VisibilityTimeout: aws.Int64(seconds(backoff(q.backoff, msg.Deliveries))),
+	})
+	return stale(err)
+}
+
+// removes the closed tag of an earlier run so receivers wait for the messages of the new one,
+// it has to be called before the receivers of the new run are started
+func (q *sqsQueue) Reopen(ctx context.Context) error {
+	_, err := q.client.UntagQueueWithContext(ctx, &sqs.UntagQueueInput{
+		QueueUrl: aws.String(q.url),
+		TagKeys:  aws.StringSlice([]string{closedTag}),
+	})
+	return err
+}
+
+// writes the pending sends and tags the queue as closed, receivers return once it is empty
+func (q *sqsQueue) Close() error {
+	q.close.Do(func() {
+		close(q.closed)
+	})
+	<-q.done
+
+	_, err := q.client.TagQueue(&sqs.TagQueueInput{
+		QueueUrl: aws.String(q.url),
+		Tags:     map[string]*string{closedTag: aws.String("true")},
+	})
+	return err
+}
+
+// converts a received message, returns nil if it was moved to the dead letters instead
+func (q *sqsQueue) message(ctx context.Context, m *sqs.Message) (*queue.Message, error) {
+	deliveries, _ := strconv.Atoi(aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	msg := &queue.Message{
+		Id:         aws.StringValue(m.ReceiptHandle),
+		Body:       []byte(aws.StringValue(m.Body)),
+		Deliveries: deliveries,
+	}
+
+	// the visibility timeout of the last allowed delivery expired without an answer
+	if q.maxDeliveries > 0 && msg.Deliveries > q.maxDeliveries {
+		err := q.bury(ctx, msg, "Visibility timeout expired")
+		if err != nil && !errors.Is(err, queue.StaleErr) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return msg, nil
+}
+
+// hands the message to the dead letters and deletes it from the queue
+func (q *sqsQueue) bury(ctx context.Context, msg *queue.Message, cause string) error {
+	if q.dead != nil {
+		err := q.dead(ctx, &queue.DeadLetter{
+			// receipt handles are too long to identify the dead letter
+			Id:         q.name + "-" + uuid.NewString(),
+			Queue:      q.name,
+			Body:       msg.Body,
+			Deliveries: msg.Deliveries,
+			Error:      cause,
+			CreatedAt:  time.Now(),
+		})
+		if err != nil {
+			// the message must not get lost so it is delivered again after its visibility timeout
+			return err
+		}
+	}
+	return q.Ack(ctx, msg)
+}
+
+// the queue is drained if its producer closed it and no messages are left, the counts of
+// SQS are approximate so a message which was just sent might not be counted yet
+func (q *sqsQueue) drained(ctx context.Context) (bool, error) {
+	tags, err := q.client.ListQueueTagsWithContext(ctx, &sqs.ListQueueTagsInput{QueueUrl: aws.String(q.url)})
+	if err != nil {
+		return false, err
+	}
+	if tags.Tags[closedTag] == nil {
+		return false, nil
+	}
+
+	attrs, err := q.client.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(q.url),
+		AttributeNames: aws.StringSlice([]string{
+			sqs.QueueAttributeNameApproximateNumberOfMessages,
+			sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+			sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed,
+		}),
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, v := range attrs.Attributes {
+		if aws.StringValue(v) != "0" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// collects concurrent sends into batches until the queue is closed
+func (q *sqsQueue) batch() {
+	defer close(q.done)
+
+	for {
+		var first *send
+		select {
+		case first = <-q.sends:
+		case <-q.closed:
+			return
+		}
+
+		batch := []*send{first}
+		timer := time.NewTimer(q.linger)
+	collect:
+		for len(batch) < maxBatch {
+			select {
+			case s := <-q.sends:
+				batch = append(batch, s)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		q.flush(batch)
+	}
+}
+
+func (q *sqsQueue) flush(batch []*send) {
+	entries := []*sqs.SendMessageBatchRequestEntry{}
+	for i, s := range batch {
+		entry := &sqs.SendMessageBatchRequestEntry{
+			Id:          aws.String(strconv.Itoa(i)),
+			MessageBody: aws.String(string(s.body)),
+		}
+		if q.attributes != nil {
+			entry.MessageAttributes = map[string]*sqs.MessageAttributeValue{}
+			for k, v := range q.attributes(s.body) {
+				entry.MessageAttributes[k] = &sqs.MessageAttributeValue{
+					DataType:    aws.String("String"),
+					StringValue: aws.String(v),
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	// the batch is only cancelled once every sender in it gave up
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stops := []func() bool{}
+	remaining := len(batch)
+	var mutex sync.Mutex
+	for _, s := range batch {
+		stops = append(stops, context.AfterFunc(s.ctx, func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			remaining--
+			if remaining < 1 {
+				cancel()
+			}
+		}))
+	}
+	defer func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}()
+
+	out, err := q.client.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(q.url),
+		Entries:  entries,
+	})
+	if err != nil {
+		for _, s := range batch {
+			s.err <- err
+		}
+		return
+	}
+
+	failed := map[string]*sqs.BatchResultErrorEntry{}
+	for _, f := range out.Failed {
+		failed[aws.StringValue(f.Id)] = f
+	}
+	for i, s := range batch {
+		if f := failed[strconv.Itoa(i)]; f != nil {
+			s.err <- awserr.New(aws.StringValue(f.Code), aws.StringValue(f.Message), nil)
+			continue
+		}
+		s.err <- nil
+	}
+}
+
+// the base delay doubles with every delivery of the message
+func backoff(base time.Duration, deliveries int) time.Duration {
+	delay := base
+	for i := 1; i < deliveries && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+// SQS counts timeouts in whole seconds
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// a receipt handle becomes invalid once the message was delivered again
+func stale(err error) error {
+	if isCode(err, sqs.ErrCodeReceiptHandleIsInvalid) || isCode(err, sqs.ErrCodeMessageNotInflight) {
+		return queue.StaleErr
+	}
+	return err
+}
+
+func isCode(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
@@ -0,0 +1,226 @@
+package sqsqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+var sess *session.Session
+var endpoint string
+
+func TestMain(m *testing.M) {
+	// uses a sensible default on windows (tcp/http) and linux/osx (socket)
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		log.Fatalf("Could not construct pool: %s", err)
+	}
+
+	err = pool.Client.Ping()
+	if err != nil {
+		log.Fatalf("Could not connect to Docker: %s", err)
+	}
+
+	// elasticmq speaks the SQS protocol and keeps the queues in memory
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "softwaremill/elasticmq-native",
+		Tag:        "1.6.9",
+	}, func(config *docker.HostConfig) {
+		// set AutoRemove to true so that stopped container goes away by itself
+		config.AutoRemove = true
+		config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		log.Fatalf("Could not start resource: %s", err)
+	}
+
+	resource.Expire(120) // Tell docker to hard kill the container in 120 seconds
+
+	endpoint = fmt.Sprintf("http://localhost:%s", resource.GetPort("9324/tcp"))
+	sess = session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("elasticmq"),
+		Credentials: credentials.NewStaticCredentials("x", "x", ""),
+	}))
+
+	// exponential backoff-retry, because the application in the container might not be ready to accept connections yet
+	pool.MaxWait = 120 * time.Second
+	if err = pool.Retry(func() error {
+		client := sqs.New(sess, aws.NewConfig().WithEndpoint(endpoint))
+		_, err := client.ListQueues(&sqs.ListQueuesInput{})
+		return err
+	}); err != nil {
+		log.Fatalf("Could not connect to elasticmq: %s", err)
+	}
+
+	defer func() {
+		if err := pool.Purge(resource); err != nil {
+			log.Fatalf("Could not purge resource: %s", err)
+		}
+	}()
+
+	// run tests
+	m.Run()
+}
+
+func TestBatching(t *testing.T) {
+	ctx := context.Background()
+
+	q, err := New(
+		ctx,
+		sess,
+		"batching",
+		WithEndpoint(endpoint),
+		WithLongPolling(time.Second),
+		WithBatching(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent sends end in the same batch
+	var wg sync.WaitGroup
+	for i := 0; i < 15; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := q.SendMessage(ctx, []byte(fmt.Sprintf("%02d", i))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for {
+		msg, err := q.RecvMessage(ctx)
+		if err != nil {
+			break
+		}
+		got = append(got, string(msg.Body))
+		if err := q.Ack(ctx, msg); err != nil {
+			t.Error(err)
+		}
+	}
+	sort.Strings(got)
+	if len(got) != 15 || got[0] != "00" || got[14] != "14" {
+		t.Errorf("Expected 15 messages but got %v", got)
+	}
+
+	// acknowledged messages are deleted from the queue
+	out, err := q.client.ReceiveMessage(&sqs.ReceiveMessageInput{QueueUrl: aws.String(q.url)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Messages) > 0 {
+		t.Errorf("Expected the acknowledged messages to be deleted")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+
+	dead := []*queue.DeadLetter{}
+	q, err := New(
+		ctx,
+		sess,
+		"retry",
+		WithEndpoint(endpoint),
+		WithLongPolling(time.Second),
+		WithRetry(2, 0),
+		WithDeadLetters(func(ctx context.Context, dl *queue.DeadLetter) error {
+			dead = append(dead, dl)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.SendMessage(ctx, []byte("fail")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		msg, err := q.RecvMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Deliveries != i {
+			t.Errorf("Expected delivery %d but got %d", i, msg.Deliveries)
+		}
+		if err := q.Nack(ctx, msg, errors.New("failed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dead) != 1 || string(dead[0].Body) != "fail" || dead[0].Queue != "retry" {
+		t.Errorf("Expected the message in the dead letters")
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.RecvMessage(ctx); err != queue.DrainedErr {
+		t.Errorf("Expected the queue to be drained")
+	}
+
+	// the closed tag of the last run does not drain the receivers of the next one
+	if err := q.Reopen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if _, err := q.RecvMessage(wctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the reopened queue to wait for messages but got %v", err)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	ctx := context.Background()
+
+	q, err := New(
+		ctx,
+		sess,
+		"attributes",
+		WithEndpoint(endpoint),
+		WithAttributes(func(msg []byte) map[string]string {
+			return map[string]string{"cik": string(msg)}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SendMessage(ctx, []byte("0000000001")); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := q.client.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(q.url),
+		MessageAttributeNames: aws.StringSlice([]string{"All"}),
+		WaitTimeSeconds:       aws.Int64(1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Messages) != 1 {
+		t.Fatalf("Expected one message but got %d", len(out.Messages))
+	}
+	attr := out.Messages[0].MessageAttributes["cik"]
+	if attr == nil || aws.StringValue(attr.StringValue) != "0000000001" {
+		t.Errorf("Expected the attribute 'cik' to be sent with the message")
+	}
+}
@@ -64,7 +64,7 @@ func (s *httpServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := s.auth.LoginUser(body.Username, body.Password)
+	token, err := s.auth.LoginUser(r.Context(), body.Username, body.Password)
 	if err != nil {
 		if err == auth.InvalidCredsErr {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
@@ -98,7 +98,7 @@ func (s *httpServer) handleRandomTable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tbl, err := s.label.RandomTable(userId)
+	tbl, err := s.label.RandomTable(r.Context(), userId)
 	if err != nil {
 		if err == label.NoTblLeftErr {
 			http.Error(w, err.Error(), http.StatusNotFound)
@@ -154,7 +154,7 @@ func (s *httpServer) handleTableLabel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.label.CreateLabel(tblId, userId, body.Label)
+	err = s.label.CreateLabel(r.Context(), tblId, userId, body.Label)
 	if err != nil {
 		if err == label.InvalidLabelErr {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -188,7 +188,7 @@ func (s *httpServer) handleFilingProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, err := s.proxy.GetFiling(r.PathValue("cik"), r.PathValue("id"), r.PathValue("key"))
+	data, err := s.proxy.GetFiling(r.Context(), r.PathValue("cik"), r.PathValue("id"), r.PathValue("key"))
 	if err != nil {
 		http.Error(w, "Not Found", http.StatusNotFound)
 		return
@@ -206,7 +206,7 @@ func (s *httpServer) handleAuth(w http.ResponseWriter, r *http.Request) (uuid.UU
 		http.Error(w, "Session token is missing in request header", http.StatusUnauthorized)
 		return uuid.UUID{}, errors.New("")
 	}
-	userId, err := s.auth.ValidateSession(token)
+	userId, err := s.auth.ValidateSession(r.Context(), token)
 	if err != nil {
 		if err == auth.InvalidCredsErr || err == auth.ExpiredSessErr {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
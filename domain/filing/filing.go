@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -15,10 +16,18 @@ import (
 )
 
 type Company struct {
-	Cik     string    `json:"cik"`
-	Name    string    `json:"name"`
-	Tickers []*Ticker `json:"tickers"`
-	Filings []*Filing `json:"filings"`
+	Cik           string        `json:"cik"`
+	Name          string        `json:"name"`
+	Sic           string        `json:"sic"`
+	Industry      string        `json:"industry"`
+	Incorporation string        `json:"incorporation"`
+	FiscalYearEnd string        `json:"fiscal_year_end"`
+	Ein           string        `json:"ein"`
+	Forms         []string      `json:"forms"`
+	Addresses     []*Address    `json:"addresses"`
+	FormerNames   []*FormerName `json:"former_names"`
+	Tickers       []*Ticker     `json:"tickers"`
+	Filings       []*Filing     `json:"filings"`
 }
 
 type Ticker struct {
@@ -26,26 +35,69 @@ type Ticker struct {
 	Exchange string `json:"exchange"`
 }
 
+// type of an address is either 'business' or 'mailing'
+type Address struct {
+	Type    string `json:"type"`
+	Street1 string `json:"street1"`
+	Street2 string `json:"street2"`
+	City    string `json:"city"`
+	State   string `json:"state"`
+	Zip     string `json:"zip"`
+}
+
+type FormerName struct {
+	Name string    `json:"name"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// position of the last load of the filings of a company so the next load only
+// has to request what changed since
+type SyncState struct {
+	Cik            string
+	LastId         string // newest filing listed at the last load
+	LastFilingDate time.Time
+	ETag           string // version of the submissions at the last load
+	SyncedAt       time.Time
+}
+
 type Filing struct {
 	Id         string    `json:"id"`
+	Cik        string    `json:"cik"` // only set by the database
 	Form       string    `json:"form"`
 	FilingDate time.Time `json:"filing_date"`
+	ReportDate time.Time `json:"report_date"`
+	Amends     string    `json:"amends"`
 	MainFile   *File     `json:"main_file"`
+	Files      []*File   `json:"files"`
 	Tables     []*Table  `json:"tables"`
 }
 
 type File struct {
 	Key          string    `json:"key"`
+	Type         string    `json:"type"`
 	LastModified time.Time `json:"last_modified"`
 	Data         []byte    `json:"data"`
 }
 
+// document of a filing as it was stored in the archive bucket with what is needed to find
+// and verify it later
+type ArchivedFile struct {
+	FilingId   string
+	Key        string // key in the archive bucket
+	Location   string // archive id in vaults
+	TreeHash   string // hex encoded SHA-256 tree hash
+	Size       int64
+	ArchivedAt time.Time
+}
+
 type Table struct {
 	Id         uuid.UUID  `json:"id"`
 	OriginalId uuid.UUID  `json:"original_id"`
 	HeadIndex  int        `json:"head_index"`
 	Index      int        `json:"index"`
 	Factor     string     `json:"factor"`
+	FileKey    string     `json:"file_key"`
 	CompData   compMatrix `json:"data"`
 	RawData    string     `json:"raw_data"`
 	Data       matrix     `json:"-"`
@@ -60,42 +112,182 @@ type Edge struct {
 	Weight int
 }
 
+// CIKs are stored zero padded to ten digits e.g. '0000320193'
+func PadCik(str string) (string, bool) {
+	str = strings.TrimSpace(str)
+	if len(str) < 1 || len(str) > 10 {
+		return "", false
+	}
+	for _, r := range str {
+		if r < '0' || r > '9' {
+			return "", false
+		}
+	}
+	return strings.Repeat("0", 10-len(str)) + str, true
+}
+
+// quarterly and annual financial reports are loaded if nothing else is configured
+var DefaultForms = []string{"10-K", "10-Q"}
+
+// returns the form which is amended by the given form e.g. '10-K' for '10-K/A'
+func BaseForm(form string) string {
+	return strings.TrimSuffix(form, "/A")
+}
+
+func IsAmendment(form string) bool {
+	return strings.HasSuffix(form, "/A")
+}
+
+// compares the fields the SEC might change over time
+func (c *Company) Differs(o *Company) bool {
+
+	if c.Name != o.Name ||
+		c.Sic != o.Sic ||
+		c.Industry != o.Industry ||
+		c.Incorporation != o.Incorporation ||
+		c.FiscalYearEnd != o.FiscalYearEnd ||
+		c.Ein != o.Ein {
+		return true
+	}
+
+	if len(c.Tickers) != len(o.Tickers) || len(c.Addresses) != len(o.Addresses) {
+		return true
+	}
+	tickers := make(map[Ticker]bool)
+	for _, t := range c.Tickers {
+		tickers[*t] = true
+	}
+	for _, t := range o.Tickers {
+		if !tickers[*t] {
+			return true
+		}
+	}
+	addrs := make(map[Address]bool)
+	for _, a := range c.Addresses {
+		addrs[*a] = true
+	}
+	for _, a := range o.Addresses {
+		if !addrs[*a] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forms of the company take precedence over the globally configured forms
+func (c *Company) Accepts(form string, global []string) bool {
+	forms := c.Forms
+	if len(forms) < 1 {
+		forms = global
+	}
+	for _, f := range forms {
+		if f == form {
+			return true
+		}
+	}
+	return false
+}
+
+// links every amendment to the filing it amends, the original filing is the one with the
+// same period of report or if there is none the latest one filed before the amendment
+func LinkAmendments(fils []*Filing) {
+
+	for _, a := range fils {
+		if !IsAmendment(a.Form) {
+			continue
+		}
+
+		var match *Filing
+		for _, o := range fils {
+			if o.Form != BaseForm(a.Form) || o.FilingDate.After(a.FilingDate) {
+				continue
+			}
+			if !a.ReportDate.IsZero() && o.ReportDate.Equal(a.ReportDate) {
+				match = o
+				break
+			}
+			if match == nil || o.FilingDate.After(match.FilingDate) {
+				match = o
+			}
+		}
+
+		if match != nil {
+			a.Amends = match.Id
+		}
+	}
+}
+
+// tables of the main file and all other files of the filing, the table index
+// keeps counting across files so it is unique within the filing
 func (f *Filing) LoadTables() error {
 
 	if f.MainFile == nil {
 		return errors.New("Main file is nil")
 	}
 
-	document, err := toHtml(f.MainFile.Data)
-	if err != nil {
-		return err
-	}
-
-	// get nodes of HTML node type 'table'
-	nodes := getNodes(document, "table")
 	tables := []*Table{}
-	for i, n := range nodes {
-		mat, head := convert(n)
-		str, err := toStr(n)
+	for _, file := range append([]*File{f.MainFile}, f.Files...) {
+		err := ScanTables(bytes.NewReader(file.Data), func(t *Table) error {
+			t.Index = len(tables)
+			t.FileKey = file.Key
+			tables = append(tables, t)
+			return nil
+		})
 		if err != nil {
 			return err
 		}
-		tables = append(
-			tables,
-			&Table{
-				Index:     i,
-				Factor:    searchStr(n, 8, 300, []string{"thousand", "million"}),
-				HeadIndex: head,
-				RawData:   str,
-				Data:      mat,
-			},
-		)
 	}
 
 	f.Tables = tables
 	return nil
 }
 
+// plain text documents of old filings can also contain SGML tags like '<TABLE>' so
+// we only treat documents with HTML rows as HTML
+func isHtml(data []byte) bool {
+	lower := bytes.ToLower(data)
+	return bytes.Contains(lower, []byte("<html")) || bytes.Contains(lower, []byte("<tr"))
+}
+
+// key of a file of the filing in buckets where documents of many filings are kept side by side
+func (f *Filing) StoreKey(file *File) string {
+	return f.Id + "_" + file.Key
+}
+
+// key of a file of the filing in the archive, the main document is kept under the id of the
+// filing with its own extension and exhibits in a folder of the id
+func (f *Filing) ArchiveKey(file *File) string {
+	if file == f.MainFile {
+		ext := path.Ext(file.Key)
+		if len(ext) < 1 {
+			ext = ".htm"
+		}
+		return f.Id + ext
+	}
+	return f.Id + "/" + file.Key
+}
+
+// whether the main document is a full submission text file which contains all of the exhibits
+func (f *Filing) IsLegacy() bool {
+	return strings.HasSuffix(f.MainFile.Key, ".txt")
+}
+
+// key of the description of the filing and its files next to the files in such buckets
+func (f *Filing) ManifestKey() string {
+	return f.Id + ".json"
+}
+
+// document types of exhibits look like 'EX-99.1' so 'EX-99' matches all of its sub types
+func (f *File) IsType(types []string) bool {
+	for _, t := range types {
+		if f.Type == t || strings.HasPrefix(f.Type, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *Table) Compress() error {
 
 	mat := t.Data.sumCells()
@@ -307,10 +499,6 @@ func (m compMatrix) transpose() (compMatrix, error) {
 	return newMtrx, nil
 }
 
-func toHtml(data []byte) (*html.Node, error) {
-	return html.Parse(bytes.NewReader(data))
-}
-
 func getNodes(node *html.Node, nType string) []*html.Node {
 
 	nodes := []*html.Node{}
@@ -393,58 +581,6 @@ func convert(table *html.Node) (matrix, int) {
 	return matrix, headIdx
 }
 
-func searchStr(node *html.Node, maxDist, maxLen int, queries []string) string {
-
-	var crawler func(node *html.Node, except *html.Node) string
-	crawler = func(node *html.Node, except *html.Node) string {
-		if node == except {
-			return ""
-		}
-
-		if node.Type == html.TextNode {
-			return node.Data
-		}
-
-		result := ""
-		for child := node.FirstChild; child != nil; child = child.NextSibling {
-			result += crawler(child, except)
-		}
-		return result
-	}
-
-	current := node
-	for maxDist > 0 {
-		maxDist--
-
-		// determine next node
-		if current.PrevSibling == nil {
-			// check if we already have reached the root
-			if current.Parent == nil {
-				return ""
-			}
-			// no more siblings so we go one level up
-			current = current.Parent
-		} else {
-			current = current.PrevSibling
-		}
-
-		str := crawler(current, node)
-		if len(str) > maxLen {
-			break
-		}
-
-		letts := getLetters(str)
-		// check if the content contains one of the filter values
-		for _, q := range queries {
-			if strings.Contains(letts, q) {
-				return str
-			}
-		}
-	}
-
-	return ""
-}
-
 func getLetters(str string) string {
 	str = strings.ToLower(str)
 	result := ""
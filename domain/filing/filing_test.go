@@ -0,0 +1,189 @@
+package filing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccepts(t *testing.T) {
+
+	global := []string{"10-K", "10-Q"}
+	cases := []struct {
+		forms []string
+		form  string
+		want  bool
+	}{
+		{nil, "10-K", true},
+		{nil, "8-K", false},
+		{[]string{}, "10-Q", true},
+		{[]string{"8-K"}, "8-K", true},
+		{[]string{"8-K"}, "10-K", false},
+		{[]string{"10-K"}, "10-K/A", false},
+	}
+	for _, c := range cases {
+		cmp := &Company{Forms: c.forms}
+		if got := cmp.Accepts(c.form, global); got != c.want {
+			t.Errorf("Expected a company with forms %v to accept %s to be %t", c.forms, c.form, c.want)
+		}
+	}
+}
+
+func TestLinkAmendments(t *testing.T) {
+
+	date := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	cases := []struct {
+		name string
+		fils []*Filing
+		want map[string]string
+	}{
+		{
+			name: "same period of report",
+			fils: []*Filing{
+				{Id: "a", Form: "10-K/A", FilingDate: date("2024-06-01"), ReportDate: date("2022-12-31")},
+				{Id: "b", Form: "10-K", FilingDate: date("2024-02-01"), ReportDate: date("2023-12-31")},
+				{Id: "c", Form: "10-K", FilingDate: date("2023-02-01"), ReportDate: date("2022-12-31")},
+			},
+			want: map[string]string{"a": "c"},
+		},
+		{
+			name: "latest filed before without a period of report",
+			fils: []*Filing{
+				{Id: "a", Form: "10-Q/A", FilingDate: date("2024-06-01")},
+				{Id: "b", Form: "10-Q", FilingDate: date("2024-05-01")},
+				{Id: "c", Form: "10-Q", FilingDate: date("2024-02-01")},
+				{Id: "d", Form: "10-Q", FilingDate: date("2024-07-01")},
+			},
+			want: map[string]string{"a": "b"},
+		},
+		{
+			name: "only filings of the base form",
+			fils: []*Filing{
+				{Id: "a", Form: "10-K/A", FilingDate: date("2024-06-01")},
+				{Id: "b", Form: "10-Q", FilingDate: date("2024-05-01")},
+				{Id: "c", Form: "10-K/A", FilingDate: date("2024-04-01")},
+			},
+			want: map[string]string{},
+		},
+	}
+	for _, c := range cases {
+		LinkAmendments(c.fils)
+		for _, f := range c.fils {
+			if f.Amends != c.want[f.Id] {
+				t.Errorf("%s: expected '%s' to amend '%s' but got '%s'", c.name, f.Id, c.want[f.Id], f.Amends)
+			}
+		}
+	}
+}
+
+func TestIsType(t *testing.T) {
+
+	cases := []struct {
+		typ   string
+		types []string
+		want  bool
+	}{
+		{"EX-13", []string{"EX-13"}, true},
+		{"EX-99.1", []string{"EX-99"}, true},
+		{"EX-99.1", []string{"EX-99.1"}, true},
+		{"EX-99.1", []string{"EX-99.2"}, false},
+		{"EX-101.INS", []string{"EX-10"}, false},
+		{"EX-13", []string{"EX-1"}, false},
+		{"EX-21.1", []string{"EX-13", "EX-21"}, true},
+		{"GRAPHIC", []string{"EX-13"}, false},
+		{"", []string{"EX-13"}, false},
+		{"EX-13", nil, false},
+	}
+	for _, c := range cases {
+		f := &File{Type: c.typ}
+		if got := f.IsType(c.types); got != c.want {
+			t.Errorf("Expected type '%s' to match %v to be %t", c.typ, c.types, c.want)
+		}
+	}
+}
+
+func TestPadCik(t *testing.T) {
+
+	cases := []struct {
+		str  string
+		want string
+		ok   bool
+	}{
+		{"320193", "0000320193", true},
+		{"0000320193", "0000320193", true},
+		{" 1 ", "0000000001", true},
+		{"12345678901", "", false},
+		{"AAPL", "", false},
+		{"32019a", "", false},
+		{"-1", "", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		got, ok := PadCik(c.str)
+		if got != c.want || ok != c.ok {
+			t.Errorf("Expected '%s' to be padded to '%s' (%t) but got '%s' (%t)", c.str, c.want, c.ok, got, ok)
+		}
+	}
+}
+
+func TestDiffers(t *testing.T) {
+
+	base := func() *Company {
+		return &Company{
+			Cik:       "0000000001",
+			Name:      "Example Corp",
+			Sic:       "3571",
+			Tickers:   []*Ticker{{Value: "EXMP", Exchange: "Nasdaq"}, {Value: "EXMPW", Exchange: "Nasdaq"}},
+			Addresses: []*Address{{Type: "business", City: "Springfield"}},
+			Forms:     []string{"10-K"},
+		}
+	}
+	cases := []struct {
+		name   string
+		change func(c *Company)
+		want   bool
+	}{
+		{"unchanged", func(c *Company) {}, false},
+		{"tickers in another order", func(c *Company) { c.Tickers[0], c.Tickers[1] = c.Tickers[1], c.Tickers[0] }, false},
+		{"forms are not compared", func(c *Company) { c.Forms = nil }, false},
+		{"name", func(c *Company) { c.Name = "Example Inc" }, true},
+		{"industry code", func(c *Company) { c.Sic = "7372" }, true},
+		{"exchange of a ticker", func(c *Company) { c.Tickers[1].Exchange = "NYSE" }, true},
+		{"removed ticker", func(c *Company) { c.Tickers = c.Tickers[:1] }, true},
+		{"moved address", func(c *Company) { c.Addresses[0].City = "Shelbyville" }, true},
+		{"added address", func(c *Company) { c.Addresses = append(c.Addresses, &Address{Type: "mailing"}) }, true},
+	}
+	for _, c := range cases {
+		changed := base()
+		c.change(changed)
+		if got := base().Differs(changed); got != c.want {
+			t.Errorf("%s: expected the company to differ to be %t", c.name, c.want)
+		}
+	}
+}
+
+func TestArchiveKey(t *testing.T) {
+
+	cases := []struct {
+		main *File
+		file *File
+		want string
+	}{
+		{&File{Key: "exmp-10k.htm"}, nil, "000000000124000001.htm"},
+		{&File{Key: "0000000001-99-000001.txt"}, nil, "000000000124000001.txt"},
+		{&File{Key: "main"}, nil, "000000000124000001.htm"},
+		{&File{Key: "exmp-10k.htm"}, &File{Key: "exmp-ex13.htm"}, "000000000124000001/exmp-ex13.htm"},
+	}
+	for _, c := range cases {
+		fil := &Filing{Id: "000000000124000001", MainFile: c.main}
+		file := c.file
+		if file == nil {
+			file = c.main
+		}
+		if got := fil.ArchiveKey(file); got != c.want {
+			t.Errorf("Expected '%s' to be archived under '%s' but got '%s'", file.Key, c.want, got)
+		}
+	}
+}
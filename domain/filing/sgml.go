@@ -0,0 +1,144 @@
+package filing
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// full submission text files wrap every document of a filing like this:
+//
+//	<DOCUMENT>
+//	<TYPE>10-K
+//	<SEQUENCE>1
+//	<FILENAME>d10k.txt
+//	<TEXT>
+//	...
+//	</TEXT>
+//	</DOCUMENT>
+var (
+	docRegex  = regexp.MustCompile(`(?s)<DOCUMENT>(.*?)</DOCUMENT>`)
+	textRegex = regexp.MustCompile(`(?s)<TEXT>\r?\n?(.*?)</TEXT>`)
+)
+
+func IsSubmission(data []byte) bool {
+	return bytes.Contains(data, []byte("<DOCUMENT>"))
+}
+
+// splits a full submission text file into its documents, uuencoded documents are decoded
+func SplitSubmission(data []byte) ([]*File, error) {
+
+	matches := docRegex.FindAllSubmatch(data, -1)
+	if len(matches) < 1 {
+		return nil, errors.New("No documents found in submission")
+	}
+
+	files := []*File{}
+	for i, m := range matches {
+
+		body := m[1]
+		text := textRegex.FindSubmatch(body)
+		if text == nil {
+			continue
+		}
+
+		f := &File{
+			Key:  sgmlValue(body, "FILENAME"),
+			Type: sgmlValue(body, "TYPE"),
+			Data: text[1],
+		}
+
+		if name, ok := uuBegin(f.Data); ok {
+			decoded, err := uuDecode(f.Data)
+			if err != nil {
+				return nil, err
+			}
+			f.Data = decoded
+			if len(f.Key) < 1 {
+				f.Key = name
+			}
+		}
+
+		// very old submissions have no file names for their documents
+		if len(f.Key) < 1 {
+			seq := sgmlValue(body, "SEQUENCE")
+			if len(seq) < 1 {
+				seq = fmt.Sprint(i + 1)
+			}
+			f.Key = seq + ".txt"
+		}
+
+		files = append(files, f)
+	}
+
+	// documents without a text have nothing to be read from
+	if len(files) < 1 {
+		return nil, errors.New("No documents with a text found in submission")
+	}
+
+	return files, nil
+}
+
+// header tags in submissions have no closing tag, the value ends with the line
+func sgmlValue(body []byte, tag string) string {
+	_, after, found := bytes.Cut(body, []byte("<"+tag+">"))
+	if !found {
+		return ""
+	}
+	line, _, _ := bytes.Cut(after, []byte("\n"))
+	return strings.TrimSpace(string(line))
+}
+
+// uuencoded parts start with a line like 'begin 644 annual.pdf'
+func uuBegin(data []byte) (string, bool) {
+	line, _, _ := bytes.Cut(bytes.TrimLeft(data, " \r\n"), []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 3 || fields[0] != "begin" {
+		return "", false
+	}
+	return fields[2], true
+}
+
+func uuDecode(data []byte) ([]byte, error) {
+
+	lines := strings.Split(strings.TrimLeft(string(data), " \r\n"), "\n")
+	result := []byte{}
+
+	// the first line is the 'begin' line
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		if line == "end" {
+			return result, nil
+		}
+		if len(line) < 1 {
+			continue
+		}
+
+		// first character encodes the number of decoded bytes in this line
+		n := int((line[0] - 32) & 63)
+		if n == 0 {
+			continue
+		}
+		chars := []byte(line[1:])
+		for len(chars)%4 != 0 {
+			chars = append(chars, ' ')
+		}
+
+		decoded := []byte{}
+		for i := 0; i+3 < len(chars); i += 4 {
+			c0 := (chars[i] - 32) & 63
+			c1 := (chars[i+1] - 32) & 63
+			c2 := (chars[i+2] - 32) & 63
+			c3 := (chars[i+3] - 32) & 63
+			decoded = append(decoded, c0<<2|c1>>4, c1<<4|c2>>2, c2<<6|c3)
+		}
+		if n > len(decoded) {
+			return nil, errors.New("Uuencoded line is too short")
+		}
+		result = append(result, decoded[:n]...)
+	}
+
+	return nil, errors.New("Uuencoded part has no end")
+}
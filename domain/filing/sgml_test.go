@@ -0,0 +1,91 @@
+package filing
+
+import (
+	"bytes"
+	"testing"
+)
+
+const submission = `<SEC-DOCUMENT>0000000001-99-000001.txt : 19990315
+<SEC-HEADER>0000000001-99-000001.hdr.sgml : 19990315
+</SEC-HEADER>
+<DOCUMENT>
+<TYPE>10-K
+<SEQUENCE>1
+<TEXT>
+                                 (In thousands)
+<TABLE>
+<CAPTION>
+                                       1998        1997
+<S>                                  <C>         <C>
+Net sales                            $ 1,234     $ 1,100
+</TABLE>
+</TEXT>
+</DOCUMENT>
+<DOCUMENT>
+<TYPE>EX-27
+<SEQUENCE>2
+<FILENAME>ex27.txt
+<TEXT>
+begin 644 ex27.txt
+` + "%2&5L;&\\`\n`\n" + `end
+</TEXT>
+</DOCUMENT>
+</SEC-DOCUMENT>
+`
+
+func TestSplitSubmission(t *testing.T) {
+
+	files, err := SplitSubmission([]byte(submission))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 documents but got %d", len(files))
+	}
+
+	if files[0].Type != "10-K" || files[0].Key != "1.txt" {
+		t.Errorf("Unexpected main document '%s' of type '%s'", files[0].Key, files[0].Type)
+	}
+	if files[1].Type != "EX-27" || files[1].Key != "ex27.txt" {
+		t.Errorf("Unexpected exhibit '%s' of type '%s'", files[1].Key, files[1].Type)
+	}
+	if !bytes.Equal(files[1].Data, []byte("Hello")) {
+		t.Errorf("Uuencoded exhibit was decoded to '%s'", files[1].Data)
+	}
+}
+
+func TestSplitSubmissionEmpty(t *testing.T) {
+
+	cases := []string{
+		"",
+		"<SEC-DOCUMENT>\n</SEC-DOCUMENT>\n",
+		"<SEC-DOCUMENT>\n<DOCUMENT>\n<TYPE>10-K\n</DOCUMENT>\n",
+	}
+	for _, c := range cases {
+		files, err := SplitSubmission([]byte(c))
+		if err == nil {
+			t.Errorf("Expected an error for a submission without documents but got %d documents of %q", len(files), c)
+		}
+	}
+
+	// reading the tables fails instead of panicking
+	err := ScanTables(bytes.NewReader([]byte(cases[2])), func(tbl *Table) error { return nil })
+	if err == nil {
+		t.Errorf("Expected an error for scanning a submission without documents")
+	}
+}
+
+func TestLoadTablesSubmission(t *testing.T) {
+
+	fil := &Filing{MainFile: &File{Key: "0000000001-99-000001.txt", Data: []byte(submission)}}
+	err := fil.LoadTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fil.Tables) != 1 {
+		t.Fatalf("Expected 1 table but got %d", len(fil.Tables))
+	}
+	if fil.Tables[0].Factor == "" {
+		t.Errorf("Factor of the table was not found")
+	}
+}
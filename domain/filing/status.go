@@ -0,0 +1,65 @@
+package filing
+
+import "time"
+
+// stage a filing has reached in the pipeline
+type Status string
+
+const (
+	Discovered Status = "discovered"
+	Downloaded Status = "downloaded"
+	Sliced     Status = "sliced"
+	Archived   Status = "archived"
+	Compressed Status = "compressed"
+	Failed     Status = "failed"
+)
+
+// stages in the order a filing passes them
+var Statuses = []Status{Discovered, Downloaded, Sliced, Archived, Compressed}
+
+// filings only move forward through the stages so messages which are delivered twice
+// can't set them back, a failed filing continues at any stage once it is retried and
+// every stage but the last one can fail
+func (s Status) CanBecome(next Status) bool {
+	if next == Failed {
+		return s != Compressed
+	}
+	if s == Failed {
+		return next.rank() >= 0
+	}
+	return next.rank() > s.rank()
+}
+
+// position in the stages or -1 for failed and unknown statuses
+func (s Status) rank() int {
+	for i, v := range Statuses {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// current status of a filing with the error of its last failure
+type Progress struct {
+	Id         string
+	Cik        string
+	Form       string
+	FilingDate time.Time
+	Status     Status
+	LastStatus Status // status before the filing failed
+	Error      string
+	Attempts   int // number of failures so far
+	Tables     int // number of tables sliced so far
+	UpdatedAt  time.Time
+}
+
+// whether the filing passed the stage, failed filings passed the stages up to the status they
+// had before they failed
+func (p *Progress) Reached(status Status) bool {
+	reached := p.Status
+	if reached == Failed {
+		reached = p.LastStatus
+	}
+	return status.rank() >= 0 && reached.rank() >= status.rank()
+}
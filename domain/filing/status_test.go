@@ -0,0 +1,47 @@
+package filing
+
+import "testing"
+
+func TestCanBecome(t *testing.T) {
+
+	cases := []struct {
+		from Status
+		to   Status
+		want bool
+	}{
+		{Discovered, Downloaded, true},
+		{Downloaded, Archived, true},
+		{Sliced, Downloaded, false},
+		{Sliced, Sliced, false},
+		{Sliced, Failed, true},
+		{Failed, Downloaded, true},
+		{Failed, Failed, true},
+		{Compressed, Failed, false},
+		{Discovered, Status("unknown"), false},
+	}
+	for _, c := range cases {
+		if got := c.from.CanBecome(c.to); got != c.want {
+			t.Errorf("Expected %s to %s to be %t", c.from, c.to, c.want)
+		}
+	}
+}
+
+func TestReached(t *testing.T) {
+
+	cases := []struct {
+		prog *Progress
+		want bool
+	}{
+		{&Progress{Status: Sliced}, false},
+		{&Progress{Status: Archived}, true},
+		{&Progress{Status: Compressed}, true},
+		{&Progress{Status: Failed, LastStatus: Sliced}, false},
+		{&Progress{Status: Failed, LastStatus: Archived}, true},
+		{&Progress{Status: Failed}, false},
+	}
+	for _, c := range cases {
+		if got := c.prog.Reached(Archived); got != c.want {
+			t.Errorf("Expected %+v to have reached archived to be %t", c.prog, c.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package filing
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// number of bytes looked at to decide how a document has to be parsed
+const sniffLen = 64 * 1024
+
+// number of text chunks before a table which are searched for the factor
+const factorDist = 8
+
+// maximal length of the text before a table which is searched for the factor
+const factorLen = 300
+
+var factorQueries = []string{"thousand", "million"}
+
+// emits the tables of a document one at a time, HTML documents are tokenized
+// incrementally so only the current table is held in memory no matter how large
+// the document is, legacy submissions and plain text documents are read at once
+func ScanTables(r io.Reader, fn func(*Table) error) error {
+
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+		return err
+	}
+
+	if !IsSubmission(head) && isHtml(head) {
+		return scanHtml(br, fn)
+	}
+
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	if IsSubmission(data) {
+		docs, err := SplitSubmission(data)
+		if err != nil {
+			return err
+		}
+		if len(docs) < 1 {
+			return errors.New("No documents found in submission")
+		}
+		// the first document is the main document, exhibits are separate files of the filing
+		data = docs[0].Data
+	}
+
+	if isHtml(data) {
+		return scanHtml(bytes.NewReader(data), fn)
+	}
+	for _, t := range textTables(data) {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanHtml(r io.Reader, fn func(*Table) error) error {
+
+	z := html.NewTokenizer(r)
+
+	// raw markup of the current outermost table
+	var raw bytes.Buffer
+	depth := 0
+
+	// text of the current preformatted block
+	var pre strings.Builder
+	inPre := false
+
+	// latest text chunks in front of the current position
+	recent := []string{}
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		}
+
+		tag := ""
+		if tt == html.StartTagToken || tt == html.EndTagToken {
+			name, _ := z.TagName()
+			tag = string(name)
+		}
+
+		if tag == "table" && tt == html.StartTagToken {
+			depth++
+		}
+		if depth > 0 {
+			raw.Write(z.Raw())
+			if tag == "table" && tt == html.EndTagToken {
+				depth--
+				if depth == 0 {
+					t, err := parseTable(raw.Bytes())
+					if err != nil {
+						return err
+					}
+					t.Factor = factor(recent)
+					if err := fn(t); err != nil {
+						return err
+					}
+					raw.Reset()
+					// like in the document tree text before a previous table is too far away
+					recent = recent[:0]
+				}
+			}
+			continue
+		}
+
+		switch {
+		case tag == "pre" && tt == html.StartTagToken:
+			inPre = true
+		case tag == "pre" && tt == html.EndTagToken && inPre:
+			inPre = false
+			for _, t := range preTables(pre.String()) {
+				if err := fn(t); err != nil {
+					return err
+				}
+			}
+			pre.Reset()
+		case tt == html.TextToken:
+			text := string(z.Text())
+			if inPre {
+				pre.WriteString(text)
+				continue
+			}
+			if len(strings.TrimSpace(text)) < 1 {
+				continue
+			}
+			recent = append(recent, text)
+			if len(recent) > factorDist {
+				recent = recent[1:]
+			}
+		}
+	}
+}
+
+// parses the markup of a single table like it would be part of a whole document
+func parseTable(data []byte) (*Table, error) {
+
+	document, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	nodes := getNodes(document, "table")
+	if len(nodes) < 1 {
+		return nil, errors.New("Table markup does not contain a table")
+	}
+
+	mat, head := convert(nodes[0])
+	str, err := toStr(nodes[0])
+	if err != nil {
+		return nil, err
+	}
+	return &Table{HeadIndex: head, RawData: str, Data: mat}, nil
+}
+
+// searches the text in front of a table from the closest chunk backwards for the factor
+func factor(recent []string) string {
+	str := ""
+	for i := len(recent) - 1; i >= 0; i-- {
+		str = recent[i] + str
+		if len(str) > factorLen {
+			break
+		}
+		letts := getLetters(str)
+		for _, q := range factorQueries {
+			if strings.Contains(letts, q) {
+				return str
+			}
+		}
+	}
+	return ""
+}
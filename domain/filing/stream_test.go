@@ -0,0 +1,122 @@
+package filing
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const streamTable = `<p>The following amounts are in thousands of dollars.</p>
+<table>
+<tr><td>Item</td><td>2023</td><td>2022</td></tr>
+<tr style="background-color: #cceeff"><td>Revenue %d</td><td>1,000</td><td>900</td></tr>
+<tr><td>Net income</td><td><table><tr><td>100</td></tr></table></td><td>90</td></tr>
+</table>
+<p>Some text between the tables which is long enough to be a paragraph of a report.</p>
+`
+
+func TestScanTables(t *testing.T) {
+
+	doc := "<html><body>" + fmt.Sprintf(streamTable, 1) + fmt.Sprintf(streamTable, 2) + "</body></html>"
+
+	tables := []*Table{}
+	err := ScanTables(strings.NewReader(doc), func(t *Table) error {
+		tables = append(tables, t)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nested tables are part of their outer table
+	if len(tables) != 2 {
+		t.Fatalf("Expected 2 tables but got %d", len(tables))
+	}
+	for i, tbl := range tables {
+		if !strings.Contains(tbl.Factor, "thousands") {
+			t.Errorf("Factor of table %d was not found, got '%s'", i, tbl.Factor)
+		}
+		if tbl.HeadIndex != 1 {
+			t.Errorf("Expected head index 1 of table %d but got %d", i, tbl.HeadIndex)
+		}
+		if len(tbl.Data) != 3 || tbl.Data[1][0][0] != fmt.Sprintf("Revenue %d", i+1) {
+			t.Errorf("Unexpected data of table %d: %v", i, tbl.Data)
+		}
+	}
+}
+
+// generates an HTML document with the given number of tables without holding it in memory
+func generate(tables int) io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		io.WriteString(w, "<html><body>")
+		for i := 0; i < tables; i++ {
+			io.WriteString(w, fmt.Sprintf(streamTable, i))
+		}
+		io.WriteString(w, "</body></html>")
+		w.Close()
+	}()
+	return r
+}
+
+// samples the heap while the function runs and returns the highest value in MB
+func peakHeap(fn func()) float64 {
+	runtime.GC()
+
+	var peak uint64
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stats := &runtime.MemStats{}
+		for {
+			runtime.ReadMemStats(stats)
+			if stats.HeapInuse > peak {
+				peak = stats.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	fn()
+	close(done)
+	wg.Wait()
+	return float64(peak) / (1 << 20)
+}
+
+// with about 100 MB of HTML the peak heap of the scanner stays at a few MB while
+// parsing the whole document into a tree takes several times the document size
+func BenchmarkScanTables(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		peak := peakHeap(func() {
+			err := ScanTables(generate(250000), func(t *Table) error { return nil })
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+		b.ReportMetric(peak, "peak-MB")
+	}
+}
+
+func BenchmarkParseDocument(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		peak := peakHeap(func() {
+			_, err := html.Parse(generate(250000))
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+		b.ReportMetric(peak, "peak-MB")
+	}
+}
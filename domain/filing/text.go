@@ -0,0 +1,319 @@
+package filing
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// tables in plain text documents are wrapped in SGML table tags
+var textTableRegex = regexp.MustCompile(`(?is)<TABLE>(.*?)</TABLE>`)
+
+// EDGAR marks the start of every column with '<S>' or '<C>' in the line before the body of a table
+var markerRegex = regexp.MustCompile(`(?i)<(S|C)>`)
+
+// years in header rows are numbers which should not end the header
+var yearRegex = regexp.MustCompile(`^(19|20)\d\d$`)
+
+// number cells only consist of digits and signs like '$ (1,234.5)'
+var numberRegex = regexp.MustCompile(`^[$(]*\s*-?[\d,.]*\d[\d,.]*\s*[)%]*$`)
+
+// lines which only underline or separate parts of the table
+var ruleRegex = regexp.MustCompile(`^[\s\-=_]+$`)
+
+// tables which are found in a plain text document, if the document has no table tags
+// the tables are searched in the whole text
+func textTables(data []byte) []*Table {
+
+	str := string(data)
+	locs := textTableRegex.FindAllStringSubmatchIndex(str, -1)
+	if len(locs) < 1 {
+		return preTables(str)
+	}
+
+	tables := []*Table{}
+	for _, loc := range locs {
+		block := str[loc[2]:loc[3]]
+		t := textTable(str[:loc[0]], block)
+		if t != nil {
+			tables = append(tables, t)
+		}
+	}
+
+	return tables
+}
+
+// preformatted text has no markup around tables so we look for blocks of lines with numbers
+func preTables(str string) []*Table {
+
+	lines := strings.Split(str, "\n")
+	tables := []*Table{}
+
+	start, end, rows := -1, -1, 0
+	flush := func() {
+		if rows >= 2 {
+			// headers of the table are the text lines right above the first number line
+			from := start
+			for from > 0 && from > start-4 && len(strings.TrimSpace(lines[from-1])) > 0 {
+				from--
+			}
+			before := strings.Join(lines[:from], "\n")
+			t := textTable(before, strings.Join(lines[from:end+1], "\n"))
+			if t != nil {
+				tables = append(tables, t)
+			}
+		}
+		start, end, rows = -1, -1, 0
+	}
+
+	for i, line := range lines {
+		if !isNumberLine(line) {
+			// a few lines without numbers like sub headings can be part of the table
+			if start >= 0 && i-end > 3 {
+				flush()
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		end = i
+		rows++
+	}
+	flush()
+
+	return tables
+}
+
+func isNumberLine(line string) bool {
+	segs := segments(line)
+	for _, s := range segs[min(1, len(segs)):] {
+		if isNumber(s.text) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNumber(str string) bool {
+	return numberRegex.MatchString(str) && !yearRegex.MatchString(str)
+}
+
+func textTable(before, block string) *Table {
+
+	mat, head := convertText(block)
+	if len(mat) < 1 {
+		return nil
+	}
+
+	return &Table{
+		Factor:    searchText(before, block, 8, []string{"thousand", "million"}),
+		HeadIndex: head,
+		RawData:   "<pre>" + html.EscapeString(block) + "</pre>",
+		Data:      mat,
+	}
+}
+
+type segment struct {
+	start int
+	end   int
+	text  string
+}
+
+// cells of a line are separated by at least two spaces, single spaces separate words
+func segments(line string) []segment {
+
+	segs := []segment{}
+	start := -1
+	spaces := 0
+	for i, r := range line + "  " {
+		if r != ' ' {
+			if start < 0 {
+				start = i
+			}
+			spaces = 0
+			continue
+		}
+		spaces++
+		if spaces == 2 && start >= 0 {
+			segs = append(segs, segment{start: start, end: i - 1, text: line[start : i-1]})
+			start = -1
+		}
+	}
+
+	// currency signs are padded to align but belong to the following number
+	merged := []segment{}
+	for i := 0; i < len(segs); i++ {
+		if segs[i].text == "$" && i+1 < len(segs) {
+			segs[i+1].start = segs[i].start
+			segs[i+1].text = "$ " + segs[i+1].text
+			continue
+		}
+		merged = append(merged, segs[i])
+	}
+
+	return merged
+}
+
+// columns are found by the overlap of the cells in the body of the table, header cells
+// spanning several columns are repeated in each of them like cells with a colspan in HTML
+func convertText(block string) (matrix, int) {
+
+	lines := []string{}
+	head := -1
+	for _, line := range strings.Split(strings.ReplaceAll(block, "\t", "        "), "\n") {
+
+		line = strings.TrimRight(line, "\r")
+		upper := strings.ToUpper(line)
+
+		// footnotes follow after the body of the table
+		if strings.Contains(upper, "<FN>") {
+			break
+		}
+		if strings.Contains(upper, "<CAPTION>") {
+			continue
+		}
+		if markerRegex.MatchString(line) {
+			head = len(lines)
+			// keep the position of all other characters of the line
+			line = markerRegex.ReplaceAllStringFunc(line, func(m string) string {
+				return strings.Repeat(" ", len(m))
+			})
+		}
+		if len(strings.TrimSpace(line)) < 1 || ruleRegex.MatchString(line) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	// tables without markers have their header until the first line with numbers
+	if head < 0 {
+		head = 0
+		for head < len(lines) && !isNumberLine(lines[head]) {
+			head++
+		}
+		if head == len(lines) {
+			head = 0
+		}
+	}
+
+	cols := columns(lines[head:])
+	if len(cols) < 1 {
+		cols = columns(lines)
+	}
+
+	mat := matrix{}
+	for i, line := range lines {
+		row := make([][]string, len(cols))
+		for j := range row {
+			row[j] = []string{}
+		}
+		for _, s := range segments(line) {
+			for _, j := range overlaps(cols, s, i < head) {
+				row[j] = append(row[j], s.text)
+			}
+		}
+		mat = append(mat, row)
+	}
+
+	return mat, head
+}
+
+// merges the overlapping cells of all lines into columns
+func columns(lines []string) []segment {
+
+	cols := []segment{}
+	for _, line := range lines {
+		for _, s := range segments(line) {
+			merged := []segment{}
+			for _, c := range cols {
+				if c.start <= s.end && s.start <= c.end {
+					s.start = min(s.start, c.start)
+					s.end = max(s.end, c.end)
+					continue
+				}
+				merged = append(merged, c)
+			}
+			cols = append(merged, s)
+		}
+	}
+
+	// order columns from left to right
+	for i := 1; i < len(cols); i++ {
+		for j := i; j > 0 && cols[j].start < cols[j-1].start; j-- {
+			cols[j], cols[j-1] = cols[j-1], cols[j]
+		}
+	}
+
+	return cols
+}
+
+// returns the columns a cell belongs to, header cells can span several columns
+// while body cells are assigned to the single column they overlap the most
+func overlaps(cols []segment, s segment, span bool) []int {
+
+	result := []int{}
+	best, bestLen, bestDist := 0, 0, -1
+	for i, c := range cols {
+		l := min(c.end, s.end) - max(c.start, s.start)
+		if l > 0 && span {
+			result = append(result, i)
+		}
+		if l > bestLen {
+			best, bestLen = i, l
+		}
+		// cells in between columns belong to the closest column
+		dist := min(abs(c.start-s.end), abs(s.start-c.end))
+		if bestLen == 0 && (bestDist < 0 || dist < bestDist) {
+			best, bestDist = i, dist
+		}
+	}
+
+	if len(result) > 0 {
+		return result
+	}
+	return []int{best}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// searches the caption of the table and the lines in front of the table for one of the queries
+func searchText(before, block string, maxDist int, queries []string) string {
+
+	for _, line := range strings.Split(block, "\n") {
+		if markerRegex.MatchString(line) {
+			break
+		}
+		if containsQuery(line, queries) {
+			return strings.TrimSpace(line)
+		}
+	}
+
+	lines := strings.Split(before, "\n")
+	for i := len(lines) - 1; i >= 0 && maxDist > 0; i-- {
+		if len(strings.TrimSpace(lines[i])) < 1 {
+			continue
+		}
+		maxDist--
+		if containsQuery(lines[i], queries) {
+			return strings.TrimSpace(lines[i])
+		}
+	}
+
+	return ""
+}
+
+func containsQuery(str string, queries []string) bool {
+	letts := getLetters(str)
+	for _, q := range queries {
+		if strings.Contains(letts, q) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package filing
+
+import (
+	"reflect"
+	"testing"
+)
+
+const plainTable = `
+<CAPTION>
+                                      (In thousands, except per share data)
+
+                                              Year Ended December 31,
+                                         --------------------------------
+                                           1998        1997        1996
+<S>                                    <C>         <C>         <C>
+Net sales                               $ 1,234     $ 1,100     $   950
+Cost of sales                               800         700         600
+                                        -------     -------     -------
+Net income per share                    $  1.25     $  (.10)    $  1.00
+`
+
+func TestConvertText(t *testing.T) {
+
+	mat, head := convertText(plainTable)
+	if head != 3 {
+		t.Errorf("Expected header index 3 but got %d", head)
+	}
+
+	want := matrix{
+		{{}, {"(In thousands, except per share data)"}, {"(In thousands, except per share data)"}, {"(In thousands, except per share data)"}},
+		{{}, {"Year Ended December 31,"}, {"Year Ended December 31,"}, {"Year Ended December 31,"}},
+		{{}, {"1998"}, {"1997"}, {"1996"}},
+		{{"Net sales"}, {"$ 1,234"}, {"$ 1,100"}, {"$ 950"}},
+		{{"Cost of sales"}, {"800"}, {"700"}, {"600"}},
+		{{"Net income per share"}, {"$ 1.25"}, {"$ (.10)"}, {"$ 1.00"}},
+	}
+	if !reflect.DeepEqual(mat, want) {
+		t.Errorf("Unexpected matrix %q", mat)
+	}
+
+	tbl := &Table{Data: mat, HeadIndex: head}
+	err := tbl.Compress()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPreTables(t *testing.T) {
+
+	pre := `The company had a good year.  Revenue grew strongly.
+
+                        1998        1997
+Revenue                $ 500       $ 400
+Expenses                 300         200
+Net                      200         200
+
+The end.`
+
+	tbls := preTables(pre)
+	if len(tbls) != 1 {
+		t.Fatalf("Expected 1 table but got %d", len(tbls))
+	}
+	if tbls[0].HeadIndex != 1 || len(tbls[0].Data) != 4 {
+		t.Errorf("Unexpected table %q with header index %d", tbls[0].Data, tbls[0].HeadIndex)
+	}
+}
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/finneas-io/data-pipeline/adapter/bucket"
 	"github.com/finneas-io/data-pipeline/adapter/bucket/folder"
+	"github.com/finneas-io/data-pipeline/adapter/bucket/s3bucket"
 	"github.com/finneas-io/data-pipeline/adapter/bucket/vault"
 	"github.com/finneas-io/data-pipeline/adapter/client"
 	"github.com/finneas-io/data-pipeline/adapter/client/httpclnt"
@@ -18,16 +32,27 @@ import (
 	"github.com/finneas-io/data-pipeline/adapter/logger/console"
 	"github.com/finneas-io/data-pipeline/adapter/queue"
 	"github.com/finneas-io/data-pipeline/adapter/queue/buffer"
+	"github.com/finneas-io/data-pipeline/adapter/queue/disk"
+	"github.com/finneas-io/data-pipeline/adapter/queue/sqsqueue"
 	"github.com/finneas-io/data-pipeline/adapter/server/httpserv"
+	"github.com/finneas-io/data-pipeline/domain/filing"
+	"github.com/finneas-io/data-pipeline/domain/job"
 	"github.com/finneas-io/data-pipeline/service/archive"
 	"github.com/finneas-io/data-pipeline/service/auth"
+	"github.com/finneas-io/data-pipeline/service/company"
 	"github.com/finneas-io/data-pipeline/service/compress"
 	"github.com/finneas-io/data-pipeline/service/create"
+	"github.com/finneas-io/data-pipeline/service/daemon"
+	"github.com/finneas-io/data-pipeline/service/deadletter"
 	"github.com/finneas-io/data-pipeline/service/extract"
 	"github.com/finneas-io/data-pipeline/service/initial"
 	"github.com/finneas-io/data-pipeline/service/label"
 	"github.com/finneas-io/data-pipeline/service/proxy"
+	"github.com/finneas-io/data-pipeline/service/restore"
+	"github.com/finneas-io/data-pipeline/service/retry"
 	"github.com/finneas-io/data-pipeline/service/slice"
+	"github.com/finneas-io/data-pipeline/service/status"
+	"github.com/finneas-io/data-pipeline/service/verify"
 	"github.com/joho/godotenv"
 )
 
@@ -44,76 +69,410 @@ func main() {
 	user := os.Getenv("DB_USER")
 	pass := os.Getenv("DB_PASS")
 
+	// the first Ctrl-C or termination of the process lets the pipeline commands drain their queues
+	// and cancels the other commands, a second one cancels all running operations
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	drain := make(chan struct{})
+	graceful := os.Args[1] == "load" || os.Args[1] == "watch" || os.Args[1] == "retry" || os.Args[1] == "daemon"
+	go func() {
+		sigs := make(chan os.Signal, 2)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		if graceful {
+			log.Println("Draining the pipeline, signal again to stop immediately")
+			close(drain)
+			<-sigs
+		}
+		cancel()
+	}()
+
+	// timeouts of single operations, zero disables the timeout
+	httpTimeout := duration("HTTP_TIMEOUT", 5*time.Minute)
+	dbTimeout := duration("DB_TIMEOUT", time.Minute)
+	bucketTimeout := duration("BUCKET_TIMEOUT", 10*time.Minute)
+
 	// adapter which are needed in all commands
 	var db database.Database
-	db, err := postgres.New(host, port, name, user, pass)
+	db, err := postgres.New(ctx, host, port, name, user, pass, dbTimeout)
 	if err != nil {
 		panic(err)
 	}
 	var l logger.Logger = console.New()
 
+	// forms which are loaded for companies without own forms
+	forms := filing.DefaultForms
+	if v := os.Getenv("FORMS"); len(v) > 0 {
+		forms = strings.Split(v, ",")
+	}
+
+	// exhibit types of which tables are extracted besides the main document
+	exhibits := []string{"EX-13"}
+	if v, ok := os.LookupEnv("EXHIBITS"); ok {
+		exhibits = strings.Split(v, ",")
+		if len(v) < 1 {
+			exhibits = nil
+		}
+	}
+
 	if os.Args[1] == "init" {
-		var client client.Client = httpclnt.New()
+		var client client.Client = newClient(httpTimeout)
 		var root bucket.Bucket = folder.New(".")
 
 		initService := initial.New(db, client, root, l)
 
-		err = initService.InitDatabase()
+		err = initService.InitDatabase(ctx)
 		if err != nil {
 			panic(err)
 		}
 
-		err = initService.LoadCompanies("ciks.json")
+		err = initService.LoadCompanies(ctx, "ciks.json")
 		if err != nil {
 			panic(err)
 		}
 	}
 
+	// how the stages of the pipeline commands are run
+	p := pipeline{
+		extract: integer("EXTRACT_WORKERS", 1),
+		slice:   integer("SLICE_WORKERS", 1),
+		archive: integer("ARCHIVE_WORKERS", 1),
+		drain:   drain,
+		timeout: duration("DRAIN_TIMEOUT", 5*time.Minute),
+	}
+
 	if os.Args[1] == "load" {
-		var c client.Client = httpclnt.New()
-		var exctQueue queue.Queue = buffer.New()
-		var slicQueue queue.Queue = buffer.New()
+		// the full comparison requests the complete submissions of every company
+		flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		full := flags.Bool("full", false, "compare against all filings instead of the changes since the last load")
+		flags.Parse(os.Args[2:])
+		p.full = *full
+		p.stage = stageArg(flags.Args())
+		_, err = load(ctx, db, newClient(httpTimeout), newSpool(), newArchive(db, bucketTimeout), l, forms, exhibits, p)
+		if err != nil {
+			log.Println(err.Error())
+			db.Close()
+			os.Exit(1)
+		}
+	}
+
+	if os.Args[1] == "retry" {
+		err = retryFilings(ctx, db, newClient(httpTimeout), newSpool(), newArchive(db, bucketTimeout), l, forms, exhibits, filterArgs(), p)
+		if err != nil {
+			log.Println(err.Error())
+			db.Close()
+			os.Exit(1)
+		}
+	}
 
-		exctService := extract.New(db, c, exctQueue, l)
+	if os.Args[1] == "watch" {
+		p.stage = stageArg(os.Args[2:])
 
-		go func() {
-			err = exctService.LoadFilings()
+		// how often the latest filings feed is polled
+		interval := duration("WATCH_INTERVAL", time.Minute)
+
+		var c client.Client = newClient(httpTimeout)
+		var spool bucket.Bucket = newSpool()
+		var exctQueue queue.Queue = newQueue(db, sliceQueue)
+		var slicQueue queue.Queue = newQueue(db, archiveQueue)
+
+		exctService := extract.New(db, c, spool, exctQueue, l, forms, exhibits)
+		slicService := slice.New(db, spool, exctQueue, slicQueue, l)
+		archService := archive.New(db, spool, newArchive(db, bucketTimeout), slicQueue, l)
+
+		err = runStages(ctx, p, []namedStage{
+			{extractStage, func(ctx context.Context) error { return exctService.WatchFilings(ctx, interval) }, []queue.Queue{exctQueue}},
+			{sliceStage, func(ctx context.Context) error { return slicService.SliceFilings(ctx, p.slice) }, []queue.Queue{slicQueue}},
+			{archiveStage, func(ctx context.Context) error { return archService.StoreFiles(ctx, p.archive) }, nil},
+		})
+		if err != nil {
+			log.Println(err.Error())
+			db.Close()
+			os.Exit(1)
+		}
+	}
+
+	if os.Args[1] == "daemon" && len(os.Args) > 2 {
+		if os.Args[2] != "runs" || len(os.Args) > 4 {
+			panic(errors.New("Only the subcommand 'runs' and optionally a job name are accepted"))
+		}
+		name := ""
+		if len(os.Args) == 4 {
+			name = os.Args[3]
+		}
+		runs, err := db.GetJobRuns(ctx, name, 20)
+		if err != nil {
+			panic(err)
+		}
+		for _, run := range runs {
+			counts := []string{}
+			for k, v := range run.Counts {
+				counts = append(counts, fmt.Sprintf("%s=%d", k, v))
+			}
+			sort.Strings(counts)
+			finished := ""
+			if !run.FinishedAt.IsZero() {
+				finished = run.FinishedAt.Format(time.RFC3339)
+			}
+			fmt.Printf(
+				"%s\t%s\t%s\t%s\t%s\t%s\n",
+				run.Job,
+				run.StartedAt.Format(time.RFC3339),
+				finished,
+				run.Outcome,
+				strings.Join(counts, ","),
+				run.Error,
+			)
+		}
+	} else if os.Args[1] == "daemon" {
+		// every job whose schedule is set runs inside of this process, a job which is
+		// still running in this or another process is skipped
+		jobs := []*daemon.Job{}
+		schedule := func(name, env string, task daemon.Task) {
+			spec := os.Getenv(env)
+			if len(spec) < 1 {
+				return
+			}
+			s, err := job.ParseSchedule(spec)
 			if err != nil {
-				log.Println(err.Error())
+				panic(err)
 			}
-		}()
+			jobs = append(jobs, &daemon.Job{Name: name, Schedule: s, Task: task})
+		}
 
-		slicService := slice.New(db, exctQueue, slicQueue, l)
+		schedule("load", "SCHEDULE_LOAD", func(ctx context.Context) (map[string]int64, error) {
+			return load(ctx, db, newClient(httpTimeout), newSpool(), newArchive(db, bucketTimeout), l, forms, exhibits, p)
+		})
+		schedule("compress", "SCHEDULE_COMPRESS", func(ctx context.Context) (map[string]int64, error) {
+			n, err := compress.New(db, l).CompressTables(ctx)
+			return map[string]int64{"compressed": int64(n)}, err
+		})
+		schedule("sync-companies", "SCHEDULE_SYNC_COMPANIES", func(ctx context.Context) (map[string]int64, error) {
+			n, err := company.New(db, newClient(httpTimeout), folder.New("."), l).SyncCompanies(ctx)
+			return map[string]int64{"changed": int64(n)}, err
+		})
+		schedule("session-cleanup", "SCHEDULE_SESSION_CLEANUP", func(ctx context.Context) (map[string]int64, error) {
+			n, err := auth.New(db, l).CleanSessions(ctx)
+			return map[string]int64{"deleted": int64(n)}, err
+		})
+		if len(jobs) < 1 {
+			panic(errors.New("No job is scheduled, set at least one of the SCHEDULE_ variables"))
+		}
 
-		go func() {
-			err = slicService.SliceFilings()
+		err = daemon.New(db, jobs, l).Run(ctx, drain)
+		if err != nil {
+			log.Println(err.Error())
+			db.Close()
+			os.Exit(1)
+		}
+	}
+
+	if os.Args[1] == "add" ||
+		os.Args[1] == "remove" ||
+		os.Args[1] == "list" ||
+		os.Args[1] == "import" ||
+		os.Args[1] == "sync-companies" {
+		var c client.Client = newClient(httpTimeout)
+		var root bucket.Bucket = folder.New(".")
+		cmpService := company.New(db, c, root, l)
+
+		switch os.Args[1] {
+		case "add":
+			err = cmpService.AddCompanies(ctx, os.Args[2:])
+		case "remove":
+			err = cmpService.RemoveCompanies(ctx, os.Args[2:])
+		case "import":
+			if len(os.Args) != 3 {
+				panic(errors.New("Exactly one additional argument is required for this command"))
+			}
+			err = cmpService.ImportCompanies(ctx, os.Args[2])
+		case "sync-companies":
+			_, err = cmpService.SyncCompanies(ctx)
+		case "list":
+			var cmps []*filing.Company
+			cmps, err = cmpService.ListCompanies(ctx)
+			for _, cmp := range cmps {
+				tickers := []string{}
+				for _, t := range cmp.Tickers {
+					tickers = append(tickers, t.Value)
+				}
+				fmt.Printf("%s\t%s\t%s\n", cmp.Cik, cmp.Name, strings.Join(tickers, ","))
+			}
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if os.Args[1] == "deadletter" {
+		if len(os.Args) < 3 || len(os.Args) > 4 {
+			panic(errors.New("A subcommand 'list' or 'replay' and optionally a queue name are required"))
+		}
+		name := ""
+		if len(os.Args) == 4 {
+			name = os.Args[3]
+		}
+
+		spool := newSpool()
+		slicService := slice.New(db, spool, nil, nil, l)
+		archService := archive.New(db, spool, newArchive(db, bucketTimeout), nil, l)
+
+		// dead letters are processed by the stage which failed and all stages after it
+		dlService := deadletter.New(db, map[string]deadletter.Handler{
+			sliceQueue: func(ctx context.Context, body []byte) error {
+				err := slicService.SliceFiling(ctx, body)
+				if err != nil {
+					return err
+				}
+				return archService.StoreFiling(ctx, body)
+			},
+			archiveQueue: archService.StoreFiling,
+		}, l)
+
+		switch os.Args[2] {
+		case "list":
+			dls, err := dlService.ListDeadLetters(ctx, name)
 			if err != nil {
-				log.Println(err.Error())
+				panic(err)
 			}
-		}()
+			for _, dl := range dls {
+				fmt.Printf(
+					"%s\t%s\t%d\t%s\t%s\n",
+					dl.Id,
+					dl.Queue,
+					dl.Deliveries,
+					dl.CreatedAt.Format(time.RFC3339),
+					dl.Error,
+				)
+			}
+		case "replay":
+			count, err := dlService.ReplayDeadLetters(ctx, name)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("Replayed %d dead letters\n", count)
+		default:
+			panic(errors.New("Unknown subcommand, use 'list' or 'replay'"))
+		}
+	}
 
-		region := os.Getenv("REGION") // region for aws
-		sess, err := session.NewSession(&aws.Config{
-			Region: aws.String(region),
-		})
+	if os.Args[1] == "status" {
+		if len(os.Args) > 3 {
+			panic(errors.New("At most the number of failures to show can be passed"))
+		}
+		limit := 10
+		if len(os.Args) == 3 {
+			n, err := strconv.Atoi(os.Args[2])
+			if err != nil {
+				panic(err)
+			}
+			limit = n
+		}
+
+		rep, err := status.New(db, l).Report(ctx, limit)
 		if err != nil {
 			panic(err)
 		}
 
-		archName := os.Getenv("ARCHIVE") // name of the glacier vault
-		var a bucket.Bucket = vault.New(sess, archName)
+		// failed filings are counted in their own column next to the stages they reached
+		statuses := append(append([]filing.Status{}, filing.Statuses...), filing.Failed)
+		header := []string{"cik"}
+		totals := []string{"total"}
+		for _, s := range statuses {
+			header = append(header, string(s))
+			totals = append(totals, strconv.Itoa(rep.Totals[s]))
+		}
+		fmt.Println(strings.Join(header, "\t"))
+		for _, cmp := range rep.Companies {
+			row := []string{cmp.Cik}
+			for _, s := range statuses {
+				row = append(row, strconv.Itoa(cmp.Counts[s]))
+			}
+			fmt.Println(strings.Join(row, "\t"))
+		}
+		fmt.Println(strings.Join(totals, "\t"))
+
+		if len(rep.Failures) > 0 {
+			fmt.Printf("\nRecent failures:\n")
+		}
+		for _, f := range rep.Failures {
+			fmt.Printf(
+				"%s\t%s\t%s\t%d\t%s\t%s\n",
+				f.Id,
+				f.Cik,
+				f.LastStatus,
+				f.Attempts,
+				f.UpdatedAt.Format(time.RFC3339),
+				f.Error,
+			)
+		}
+	}
 
-		archService := archive.New(db, a, slicQueue, l)
+	if os.Args[1] == "restore" {
+		// filings are selected by their accession numbers or by company
+		flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		cik := flags.String("cik", "", "restore all filings of the company with this CIK")
+		ids := flags.String("id", "", "comma separated accession numbers of the filings to restore")
+		dir := flags.String("dir", "restore", "folder the documents are restored into")
+		wait := flags.Duration("wait", 0, "check pending retrievals again after this interval until all are restored")
+		flags.Parse(os.Args[2:])
+		if len(*cik) < 1 && len(*ids) < 1 {
+			panic(errors.New("Either -cik or -id is required for this command"))
+		}
+		filter := database.FilingFilter{Cik: *cik}
+		if len(*ids) > 0 {
+			filter.Ids = strings.Split(*ids, ",")
+		}
 
-		err = archService.StoreFiles()
+		err := os.MkdirAll(*dir, 0777)
+		if err != nil {
+			panic(err)
+		}
+		restService := restore.New(db, newArchive(db, bucketTimeout), folder.New(*dir), l)
+		restored, pending, err := restService.RestoreFilings(ctx, filter, *wait)
+		fmt.Printf("Restored %d documents, %d are still being retrieved\n", restored, pending)
 		if err != nil {
 			log.Println(err.Error())
+			db.Close()
+			os.Exit(1)
+		}
+	}
+
+	if os.Args[1] == "verify" {
+		// archived documents are selected like the filings of the retry command
+		rep, err := verify.New(db, newArchive(db, bucketTimeout), l).VerifyFiles(ctx, filterArgs())
+		if err != nil {
+			log.Println(err.Error())
+			db.Close()
+			os.Exit(1)
+		}
+		for _, m := range rep.Mismatches {
+			fmt.Printf(
+				"%s\t%s\t%s\t%d\t%s\t%d\t%s\n",
+				m.File.FilingId,
+				m.File.Key,
+				m.File.TreeHash,
+				m.File.Size,
+				m.TreeHash,
+				m.Size,
+				m.Error,
+			)
+		}
+		fmt.Printf(
+			"Verified %d documents, %d do not match, %d are still being retrieved\n",
+			rep.Verified,
+			len(rep.Mismatches),
+			rep.Pending,
+		)
+		if len(rep.Mismatches) > 0 {
+			db.Close()
+			os.Exit(1)
 		}
 	}
 
 	if os.Args[1] == "compress" {
 		compService := compress.New(db, l)
-		err := compService.CompressTables()
+		_, err := compService.CompressTables(ctx)
 		if err != nil {
 			panic(err)
 		}
@@ -124,14 +483,544 @@ func main() {
 			panic(errors.New("Exactly one additional argument is required for this command"))
 		}
 		crteService := create.New(db, l)
-		err := crteService.CreateUser(os.Args[2])
+		err := crteService.CreateUser(ctx, os.Args[2])
 		if err != nil {
 			panic(err)
 		}
 	}
 
 	if os.Args[1] == "webserver" {
-		var c client.Client = httpclnt.New()
+		var c client.Client = newClient(httpTimeout)
 		panic(httpserv.New(8000, auth.New(db, l), label.New(db, l), proxy.New(c, l)).Listen())
 	}
 }
+
+// runs the extract, slice and archive stages with queues in between until all of them completed,
+// every stage closes its output queue once all of its workers are done so the next stage completes
+// once it worked off its queue, the returned error reports everything which failed during the run
+// and the counts what every stage processed
+func load(
+	ctx context.Context,
+	db database.Database,
+	c client.Client,
+	spool bucket.Bucket,
+	arch bucket.Bucket,
+	l logger.Logger,
+	forms []string,
+	exhibits []string,
+	p pipeline,
+) (map[string]int64, error) {
+	start := time.Now()
+
+	var exctQueue queue.Queue = newQueue(db, sliceQueue)
+	var slicQueue queue.Queue = newQueue(db, archiveQueue)
+
+	exctService := extract.New(db, c, spool, exctQueue, l, forms, exhibits)
+	slicService := slice.New(db, spool, exctQueue, slicQueue, l)
+	archService := archive.New(db, spool, arch, slicQueue, l)
+
+	err := runStages(ctx, p, []namedStage{
+		{extractStage, func(ctx context.Context) error { return exctService.LoadFilings(ctx, p.extract, p.full) }, []queue.Queue{exctQueue}},
+		{sliceStage, func(ctx context.Context) error { return slicService.SliceFilings(ctx, p.slice) }, []queue.Queue{slicQueue}},
+		{archiveStage, func(ctx context.Context) error { return archService.StoreFiles(ctx, p.archive) }, nil},
+	})
+	errs := []error{err}
+
+	// failed deliveries are retried so only filings which could not be loaded at all and
+	// messages which ended in the dead letters count as failures of the run
+	loaded, loadFailed := exctService.Processed()
+	sliced, sliceFailed := slicService.Processed()
+	stored, storeFailed := archService.Processed()
+	dead, err := deadLetters(db, start)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	l.Log(fmt.Sprintf(
+		"Loaded %d filings (%d failed), sliced %d (%d failed deliveries), stored %d (%d failed deliveries), %d dead letters in %s",
+		loaded,
+		loadFailed,
+		sliced,
+		sliceFailed,
+		stored,
+		storeFailed,
+		dead,
+		time.Since(start).Round(time.Second),
+	))
+
+	if loadFailed > 0 {
+		errs = append(errs, fmt.Errorf("%d filings could not be loaded", loadFailed))
+	}
+	if dead > 0 {
+		errs = append(errs, fmt.Errorf("%d messages were moved to the dead letters", dead))
+	}
+	counts := map[string]int64{
+		"loaded":       loaded,
+		"load_failed":  loadFailed,
+		"sliced":       sliced,
+		"slice_failed": sliceFailed,
+		"stored":       stored,
+		"store_failed": storeFailed,
+		"dead_letters": int64(dead),
+	}
+	return counts, errors.Join(errs...)
+}
+
+// sends the incomplete filings which match the filter through the stages they did not complete
+// yet, the retry takes the place of the extract stage and only downloads documents which are
+// neither in the spool nor in the archive
+func retryFilings(
+	ctx context.Context,
+	db database.Database,
+	c client.Client,
+	spool bucket.Bucket,
+	arch bucket.Bucket,
+	l logger.Logger,
+	forms []string,
+	exhibits []string,
+	filter database.FilingFilter,
+	p pipeline,
+) error {
+	start := time.Now()
+
+	var exctQueue queue.Queue = newQueue(db, sliceQueue)
+	var slicQueue queue.Queue = newQueue(db, archiveQueue)
+
+	exctService := extract.New(db, c, spool, exctQueue, l, forms, exhibits)
+	rtryService := retry.New(db, spool, arch, exctService.DownloadFiling, exctQueue, slicQueue, l)
+	slicService := slice.New(db, spool, exctQueue, slicQueue, l)
+	archService := archive.New(db, spool, arch, slicQueue, l)
+
+	err := runStages(ctx, p, []namedStage{
+		{extractStage, func(ctx context.Context) error { return rtryService.RetryFilings(ctx, filter) }, []queue.Queue{exctQueue, slicQueue}},
+		{sliceStage, func(ctx context.Context) error { return slicService.SliceFilings(ctx, p.slice) }, []queue.Queue{slicQueue}},
+		{archiveStage, func(ctx context.Context) error { return archService.StoreFiles(ctx, p.archive) }, nil},
+	})
+	errs := []error{err}
+
+	retried, retryFailed := rtryService.Processed()
+	sliced, sliceFailed := slicService.Processed()
+	stored, storeFailed := archService.Processed()
+	dead, err := deadLetters(db, start)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	l.Log(fmt.Sprintf(
+		"Retried %d filings (%d failed), sliced %d (%d failed deliveries), stored %d (%d failed deliveries), %d dead letters in %s",
+		retried,
+		retryFailed,
+		sliced,
+		sliceFailed,
+		stored,
+		storeFailed,
+		dead,
+		time.Since(start).Round(time.Second),
+	))
+
+	if retryFailed > 0 {
+		errs = append(errs, fmt.Errorf("%d filings could not be retried", retryFailed))
+	}
+	if dead > 0 {
+		errs = append(errs, fmt.Errorf("%d messages were moved to the dead letters", dead))
+	}
+	return errors.Join(errs...)
+}
+
+// number of messages which were moved to the dead letters since the start of a run
+func deadLetters(db database.Database, start time.Time) (int, error) {
+	dls, err := db.GetDeadLetters(context.Background(), "")
+	if err != nil {
+		return 0, fmt.Errorf("Database error: %s", err.Error())
+	}
+	dead := 0
+	for _, dl := range dls {
+		if !dl.CreatedAt.Before(start) {
+			dead++
+		}
+	}
+	return dead, nil
+}
+
+// how the stages of the pipeline commands are run
+type pipeline struct {
+	// only this stage is run if it is not empty
+	stage string
+
+	// extract compares against all filings of every company instead of the changes since the last load
+	full bool
+
+	// number of concurrent workers of every stage, the filings of one company are always
+	// loaded by the same extract worker
+	extract int
+	slice   int
+	archive int
+
+	// closed once the first stage should stop, the other stages are cancelled if they did
+	// not work off their queues within the timeout
+	drain   <-chan struct{}
+	timeout time.Duration
+}
+
+// names of the stages which can be run as separate processes
+const (
+	extractStage = "extract"
+	sliceStage   = "slice"
+	archiveStage = "archive"
+)
+
+type namedStage struct {
+	name string
+	run  func(ctx context.Context) error
+	outs []queue.Queue // queues the stage sends to
+}
+
+// runs all stages or only the selected one until every stage returned, a stage which fails
+// cancels the others since the stages after it would wait for it forever
+func runStages(ctx context.Context, p pipeline, stages []namedStage) error {
+	selected := []namedStage{}
+	for _, s := range stages {
+		if len(p.stage) < 1 || s.name == p.stage {
+			selected = append(selected, s)
+		}
+	}
+	if len(selected) < 1 {
+		return fmt.Errorf("Unknown stage '%s'", p.stage)
+	}
+
+	// queues shared with other processes might still be closed by the last run
+	for _, s := range selected {
+		for _, q := range s.outs {
+			r, ok := q.(queue.Reopener)
+			if !ok {
+				continue
+			}
+			if err := r.Reopen(ctx); err != nil {
+				return fmt.Errorf("Queue error: %s", err.Error())
+			}
+		}
+	}
+
+	work, stopWork := context.WithCancel(ctx)
+	defer stopWork()
+	intake, stopIntake := context.WithCancel(work)
+	defer stopIntake()
+
+	// the drain only stops the first stage, completion then propagates through the queues
+	var expired atomic.Bool
+	go func() {
+		select {
+		case <-p.drain:
+		case <-work.Done():
+			return
+		}
+		stopIntake()
+
+		var timeout <-chan time.Time
+		if p.timeout > 0 {
+			timeout = time.After(p.timeout)
+		}
+		select {
+		case <-timeout:
+			expired.Store(true)
+			stopWork()
+		case <-work.Done():
+		}
+	}()
+
+	errs := make([]error, len(selected))
+	var wg sync.WaitGroup
+	for i, s := range selected {
+		sctx := work
+		if i == 0 {
+			sctx = intake
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.run(sctx)
+			// stages which were cancelled on purpose did not fail themselves
+			if err == nil || (errors.Is(err, context.Canceled) && sctx.Err() != nil) {
+				return
+			}
+			errs[i] = fmt.Errorf("Stage '%s' failed: %s", s.name, err.Error())
+			stopWork()
+		}()
+	}
+	wg.Wait()
+
+	if expired.Load() {
+		errs = append(errs, fmt.Errorf("Stages did not drain within %s", p.timeout))
+	}
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+	return errors.Join(errs...)
+}
+
+// optional stage argument of the pipeline commands, the stages of a single pipeline can only
+// be spread over several processes if they share a queue outside of the memory
+func stageArg(args []string) string {
+	if len(args) < 1 {
+		return ""
+	}
+	// the disk queue is kept by a single process and can not be shared between stages
+	if q := os.Getenv("QUEUE"); q != "postgres" && q != "sqs" {
+		panic(errors.New("Single stages can only be run with QUEUE set to 'postgres' or 'sqs'"))
+	}
+	return args[0]
+}
+
+// optional flags of the retry and verify commands which select the filings by company, form and filing date
+func filterArgs() database.FilingFilter {
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	cik := flags.String("cik", "", "only filings of the company with this CIK")
+	form := flags.String("form", "", "only filings of this form")
+	since := flags.String("since", "", "only filings filed on or after this date (YYYY-MM-DD)")
+	until := flags.String("until", "", "only filings filed before this date (YYYY-MM-DD)")
+	flags.Parse(os.Args[2:])
+
+	filter := database.FilingFilter{Cik: *cik, Form: *form}
+	var err error
+	if len(*since) > 0 {
+		filter.Since, err = time.Parse(time.DateOnly, *since)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if len(*until) > 0 {
+		filter.Until, err = time.Parse(time.DateOnly, *until)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return filter
+}
+
+// names of the queues by the stage which consumes them
+const (
+	sliceQueue   = "slice"
+	archiveQueue = "archive"
+)
+
+// queue between two stages which is either kept in memory, on disk with QUEUE set to 'disk', in the
+// database with QUEUE set to 'postgres' or in SQS with QUEUE set to 'sqs', messages which fail too
+// often end in the dead letters
+func newQueue(db database.Database, name string) queue.Queue {
+	maxDeliveries := integer("QUEUE_MAX_DELIVERIES", 5)
+	backoff := duration("QUEUE_BACKOFF", 10*time.Second)
+	visibility := duration("QUEUE_VISIBILITY", 30*time.Minute)
+
+	if os.Getenv("QUEUE") == "postgres" {
+		// the visibility timeout is the lease of a received message
+		opts := []postgres.QueueOption{
+			postgres.WithLease(visibility),
+			postgres.WithRetry(maxDeliveries, backoff),
+		}
+		if os.Getenv("QUEUE_ORDER") == "newest" {
+			opts = append(opts, postgres.WithPriority(extract.NewestFirst))
+		}
+		q, err := postgres.NewQueue(db, name, opts...)
+		if err != nil {
+			panic(err)
+		}
+		return q
+	}
+
+	if os.Getenv("QUEUE") == "sqs" {
+		// queues of several deployments in the same account are told apart by the prefix
+		q, err := sqsqueue.New(
+			context.Background(),
+			newSession(),
+			os.Getenv("SQS_PREFIX")+name,
+			sqsqueue.WithEndpoint(os.Getenv("SQS_ENDPOINT")),
+			sqsqueue.WithBatching(duration("SQS_LINGER", 0)),
+			sqsqueue.WithAttributes(extract.Attributes),
+			sqsqueue.WithRetry(maxDeliveries, backoff),
+			sqsqueue.WithVisibility(visibility),
+			sqsqueue.WithDeadLetters(db.InsertDeadLetter),
+		)
+		if err != nil {
+			panic(err)
+		}
+		return q
+	}
+
+	if os.Getenv("QUEUE") == "disk" {
+		dir := os.Getenv("QUEUE_DIR")
+		if len(dir) < 1 {
+			dir = "queue"
+		}
+		sync := disk.SyncAlways
+		switch os.Getenv("QUEUE_SYNC") {
+		case "interval":
+			sync = disk.SyncInterval
+		case "never":
+			sync = disk.SyncNever
+		}
+		q, err := disk.New(
+			filepath.Join(dir, name),
+			disk.WithSync(sync, duration("QUEUE_SYNC_INTERVAL", time.Second)),
+			disk.WithRetry(maxDeliveries, backoff),
+			disk.WithVisibility(visibility),
+			disk.WithDeadLetters(name, db.InsertDeadLetter),
+		)
+		if err != nil {
+			panic(err)
+		}
+		return q
+	}
+
+	// by default messages are delivered in the order they were sent and the buffer grows without limit
+	opts := []buffer.Option{
+		buffer.WithRetry(maxDeliveries, backoff),
+		buffer.WithVisibility(visibility),
+		buffer.WithDeadLetters(name, db.InsertDeadLetter),
+	}
+	if os.Getenv("QUEUE_ORDER") == "newest" {
+		opts = append(opts, buffer.WithPriority(extract.NewestFirst))
+	}
+	if capacity := integer("QUEUE_CAPACITY", 0); capacity > 0 {
+		// producers wait for consumers instead of dropping filings
+		opts = append(opts, buffer.WithCapacity(capacity, true))
+	}
+	return buffer.New(opts...)
+}
+
+// client of EDGAR, the base URLs can be pointed to a stand-in for testing
+func newClient(timeout time.Duration) client.Client {
+	dataURL := os.Getenv("SEC_DATA_URL")
+	if len(dataURL) < 1 {
+		dataURL = httpclnt.DataURL
+	}
+	wwwURL := os.Getenv("SEC_WWW_URL")
+	if len(wwwURL) < 1 {
+		wwwURL = httpclnt.WwwURL
+	}
+	return httpclnt.New(dataURL, wwwURL, duration("SEC_DELAY", httpclnt.DefaultDelay), timeout)
+}
+
+// the glacier vault where original filing documents are archived, the archive ids and retrieval
+// jobs are kept in the database and retrieved documents are downloaded into the staging folder,
+// with BUCKET set to 's3' the documents are archived in an S3 bucket instead
+func newArchive(db database.Database, timeout time.Duration) bucket.Bucket {
+	if os.Getenv("BUCKET") == "s3" {
+		return newS3Bucket(db, timeout)
+	}
+
+	archName := os.Getenv("ARCHIVE") // name of the glacier vault
+	dir := os.Getenv("STAGING_DIR")
+	if len(dir) < 1 {
+		dir = filepath.Join(os.TempDir(), "data-pipeline-staging")
+	}
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		panic(err)
+	}
+	opts := []vault.Option{
+		vault.WithEndpoint(os.Getenv("ARCHIVE_ENDPOINT")),
+		vault.WithCatalog(db),
+		vault.WithStaging(folder.New(dir)),
+	}
+	if tier := os.Getenv("RETRIEVAL_TIER"); len(tier) > 0 {
+		opts = append(opts, vault.WithTier(tier))
+	}
+	return vault.New(newSession(), archName, timeout, opts...)
+}
+
+// S3 bucket whose objects are placed by the key template and stored in the storage class of
+// main documents or exhibits, exhibits are stored like main documents unless set otherwise
+func newS3Bucket(db database.Database, timeout time.Duration) bucket.Bucket {
+	template := os.Getenv("S3_KEY_TEMPLATE")
+	if len(template) < 1 {
+		template = "{cik}/{accession}/{file}"
+	}
+	mainClass := os.Getenv("S3_STORAGE_CLASS")
+	exhibitClass := os.Getenv("S3_EXHIBIT_STORAGE_CLASS")
+	if len(exhibitClass) < 1 {
+		exhibitClass = mainClass
+	}
+	// the deep archive only restores with the standard and bulk tiers
+	tier := os.Getenv("S3_RESTORE_TIER")
+	if len(tier) < 1 {
+		tier = s3.TierStandard
+	}
+	if tier == s3.TierExpedited && (mainClass == s3bucket.DeepArchive || exhibitClass == s3bucket.DeepArchive) {
+		panic(errors.New("Objects in the deep archive can't be restored with the expedited tier"))
+	}
+
+	return s3bucket.New(
+		newSession(),
+		os.Getenv("S3_BUCKET"),
+		timeout,
+		s3bucket.WithEndpoint(os.Getenv("S3_ENDPOINT")),
+		s3bucket.WithKeyTemplate(template, func(ctx context.Context, accession string) (*s3bucket.Accession, error) {
+			fil, err := db.GetFiling(ctx, accession)
+			if err != nil {
+				return nil, fmt.Errorf("Filing '%s' is unknown: %s", accession, err.Error())
+			}
+			return &s3bucket.Accession{Cik: fil.Cik, MainFile: fil.MainFile.Key}, nil
+		}),
+		// exhibits are kept in a folder of the filing
+		s3bucket.WithStorageClass(func(key string) string {
+			if strings.Contains(key, "/") {
+				return exhibitClass
+			}
+			return mainClass
+		}),
+		s3bucket.WithEncryption(os.Getenv("S3_SSE"), os.Getenv("S3_SSE_KMS_KEY_ID")),
+		s3bucket.WithPartSize(int64(integer("S3_PART_SIZE_MB", 5))<<20),
+		s3bucket.WithRestore(int64(integer("S3_RESTORE_DAYS", 1)), tier),
+	)
+}
+
+// session of all aws services
+func newSession() *session.Session {
+	region := os.Getenv("REGION") // region for aws
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return sess
+}
+
+// local folder where downloaded documents are kept until they are archived
+func newSpool() bucket.Bucket {
+	dir := os.Getenv("SPOOL_DIR")
+	if len(dir) < 1 {
+		dir = filepath.Join(os.TempDir(), "data-pipeline-spool")
+	}
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		panic(err)
+	}
+	return folder.New(dir)
+}
+
+// reads a duration like '30s' from the environment or returns the default
+func duration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if len(v) < 1 {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// reads an integer from the environment or returns the default
+func integer(key string, def int) int {
+	v := os.Getenv(key)
+	if len(v) < 1 {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		panic(err)
+	}
+	return i
+}
@@ -0,0 +1,809 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/finneas-io/data-pipeline/adapter/bucket/folder"
+	"github.com/finneas-io/data-pipeline/adapter/bucket/glaciertest"
+	"github.com/finneas-io/data-pipeline/adapter/bucket/s3test"
+	"github.com/finneas-io/data-pipeline/adapter/bucket/vault"
+	"github.com/finneas-io/data-pipeline/adapter/client/edgartest"
+	"github.com/finneas-io/data-pipeline/adapter/client/httpclnt"
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/database/memory"
+	"github.com/finneas-io/data-pipeline/adapter/logger/console"
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+	"github.com/finneas-io/data-pipeline/adapter/queue/buffer"
+	"github.com/finneas-io/data-pipeline/domain/filing"
+	"github.com/finneas-io/data-pipeline/service/compress"
+	"github.com/finneas-io/data-pipeline/service/extract"
+	"github.com/finneas-io/data-pipeline/service/restore"
+	"github.com/finneas-io/data-pipeline/service/slice"
+	"github.com/finneas-io/data-pipeline/service/verify"
+)
+
+func TestLoad(t *testing.T) {
+
+	server := edgartest.NewServer("testdata/edgar")
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	db := memory.New()
+	err := db.InsertCompany(ctx, &filing.Company{Cik: "0000000001", Name: "Example Corp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spoolDir := t.TempDir()
+	archDir := t.TempDir()
+	c := httpclnt.New(server.URL, server.URL, 0, 10*time.Second)
+
+	// the load completes once every stage worked off its queue
+	counts, err := load(
+		ctx,
+		db,
+		c,
+		folder.New(spoolDir),
+		folder.New(archDir),
+		console.New(),
+		[]string{"10-K", "10-Q"},
+		[]string{"EX-13", "EX-27"},
+		pipeline{extract: 2, slice: 2, archive: 2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["loaded"] != 2 || counts["stored"] != 2 {
+		t.Errorf("Expected 2 loaded and stored filings but got %v", counts)
+	}
+	if spooled, _ := os.ReadDir(spoolDir); len(spooled) > 0 {
+		t.Errorf("Expected the spool to be empty but got %d objects", len(spooled))
+	}
+
+	want := []string{"000000000124000001", "000000000199000001"}
+	fils, err := db.GetFilings(context.Background(), "0000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range want {
+		if fils[id] == nil {
+			t.Errorf("Filing '%s' was not stored", id)
+		}
+	}
+
+	// every filing went through all stages of the pipeline
+	progs, err := db.GetFilingStatuses(context.Background(), &database.FilingFilter{Cik: "0000000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range progs {
+		if p.Status != filing.Archived {
+			t.Errorf("Expected filing '%s' to be archived but it is %s", p.Id, p.Status)
+		}
+	}
+	if len(progs) != len(want) {
+		t.Errorf("Expected %d filings with a status but got %d", len(want), len(progs))
+	}
+
+	// two tables of the main document and one of the exhibit of the 10-K as well as
+	// the text tables of the legacy submission and its exhibit
+	tbls, err := db.GetAllTables(context.Background(), 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tbls) != 5 {
+		t.Errorf("Expected 5 tables but got %d", len(tbls))
+	}
+	factors := 0
+	for _, tbl := range tbls {
+		if len(tbl.Factor) > 0 {
+			factors++
+		}
+	}
+	if factors != 4 {
+		t.Errorf("Expected 4 tables with a factor but got %d", factors)
+	}
+
+	archived := []string{}
+	err = filepath.WalkDir(archDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(archDir, path)
+		archived = append(archived, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(archived)
+	expected := []string{
+		"000000000124000001.htm",
+		"000000000124000001/exmp-ex13.htm",
+		"000000000199000001.txt",
+	}
+	if strings.Join(archived, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected archived objects %v but got %v", expected, archived)
+	}
+
+	// exhibits of types which are not configured are never downloaded and the file list of a
+	// filing is fetched once for all of its documents
+	indexes := make(map[string]int)
+	for _, r := range server.Requests() {
+		if strings.Contains(r, "exmp-ex21.htm") || strings.Contains(r, "logo.gif") || strings.Contains(r, "8k") {
+			t.Errorf("Unexpected request '%s'", r)
+		}
+		if strings.HasSuffix(r, "/index.json") {
+			indexes[r]++
+		}
+	}
+	for r, n := range indexes {
+		if n != 1 {
+			t.Errorf("Expected '%s' to be requested once but got %d requests", r, n)
+		}
+	}
+
+	// the next load only asks whether the submissions changed and a full one reads all of them
+	for _, full := range []bool{false, true} {
+		before := len(server.Requests())
+		_, err = load(
+			ctx,
+			db,
+			c,
+			folder.New(spoolDir),
+			folder.New(archDir),
+			console.New(),
+			[]string{"10-K", "10-Q"},
+			[]string{"EX-13", "EX-27"},
+			pipeline{extract: 1, slice: 1, archive: 1, full: full},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests := server.Requests()[before:]
+		if !full && len(requests) != 1 {
+			t.Errorf("Expected a single request of the incremental load but got %v", requests)
+		}
+		if full && !strings.Contains(strings.Join(requests, ","), "submissions-001.json") {
+			t.Errorf("Expected the older submissions to be requested by the full load but got %v", requests)
+		}
+	}
+
+	// changed submissions which still list the last filing are enough without the older pages
+	state, err := db.GetSyncState(ctx, "0000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.LastId != "000000000124000002" {
+		t.Errorf("Expected the newest filing to be the last one but got '%s'", state.LastId)
+	}
+	state.ETag = ""
+	if err := db.UpdateSyncState(ctx, state); err != nil {
+		t.Fatal(err)
+	}
+	before := len(server.Requests())
+	_, err = load(ctx, db, c, folder.New(spoolDir), folder.New(archDir), console.New(), []string{"10-K", "10-Q"}, nil, pipeline{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests := server.Requests()[before:]; len(requests) != 1 || strings.Contains(requests[0], "submissions-001.json") {
+		t.Errorf("Expected only the recent submissions to be requested but got %v", requests)
+	}
+}
+
+func TestWatch(t *testing.T) {
+
+	server := edgartest.NewServer("testdata/edgar")
+	defer server.Close()
+
+	db := memory.New()
+	err := db.InsertCompany(context.Background(), &filing.Company{Cik: "0000000001", Name: "Example Corp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the feed is polled a few times until the watch is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	q := buffer.New()
+	c := httpclnt.New(server.URL, server.URL, 0, 10*time.Second)
+	s := extract.New(db, c, folder.New(t.TempDir()), q, console.New(), []string{"10-K"}, nil)
+	err = s.WatchFilings(ctx, 20*time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected the watch to end with its context but got %v", err)
+	}
+
+	// the cursor moved to the newest entry of the feed
+	cursor, err := db.GetCursor(context.Background(), "feed:10-K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 2, 1, 20, 30, 0, 0, time.UTC); !cursor.Equal(want) {
+		t.Errorf("Expected the cursor at %s but got %s", want, cursor)
+	}
+
+	// the entry was loaded once and handed to the next stage
+	if _, err := db.GetFiling(context.Background(), "000000000124000001"); err != nil {
+		t.Errorf("Filing of the feed entry was not stored: %s", err)
+	}
+	msg, err := q.RecvMessage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Ack(context.Background(), msg)
+	if _, err := q.RecvMessage(context.Background()); err != queue.DrainedErr {
+		t.Errorf("Expected a single message for the next stage but got %v", err)
+	}
+
+	// polls after the first one find the filing stored and only the recent submissions are read
+	feeds, subs := 0, 0
+	for _, r := range server.Requests() {
+		if strings.Contains(r, "browse-edgar") && strings.Contains(r, "start=0") {
+			feeds++
+		}
+		if strings.Contains(r, "/submissions/") {
+			subs++
+		}
+		if strings.Contains(r, "submissions-001.json") {
+			t.Errorf("Unexpected request of older submissions '%s'", r)
+		}
+	}
+	if feeds < 2 || subs != 1 {
+		t.Errorf("Expected several polls of the feed and a single request of the submissions but got %d and %d", feeds, subs)
+	}
+}
+
+func TestRetry(t *testing.T) {
+
+	server := edgartest.NewServer("testdata/edgar")
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	db := memory.New()
+	err := db.InsertCompany(ctx, &filing.Company{Cik: "0000000001", Name: "Example Corp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the 10-K failed after it was archived and the legacy submission was never downloaded
+	archived := &filing.Filing{Id: "000000000124000001", Form: "10-K", MainFile: &filing.File{Key: "exmp-10k.htm"}}
+	legacy := &filing.Filing{Id: "000000000199000001", Form: "10-K", MainFile: &filing.File{Key: "0000000001-99-000001.txt"}}
+	for _, fil := range []*filing.Filing{archived, legacy} {
+		if err := db.InsertFiling(ctx, "0000000001", fil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.UpdateFilingStatus(ctx, archived.Id, filing.Failed, "Database error"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the documents of the 10-K are found in the archive by their receipts while the legacy
+	// submission was archived before receipts were kept
+	archDir := t.TempDir()
+	archivedAt := time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC)
+	docs := map[string]string{
+		archived.Id + ".htm":           "exmp-10k.htm",
+		archived.Id + "/exmp-ex13.htm": "exmp-ex13.htm",
+	}
+	for key, name := range docs {
+		doc, err := os.ReadFile("testdata/edgar/Archives/edgar/data/0000000001/000000000124000001/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(archDir, key)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(archDir, key), doc, 0644); err != nil {
+			t.Fatal(err)
+		}
+		err = db.InsertArchivedFile(ctx, &filing.ArchivedFile{FilingId: archived.Id, Key: key, ArchivedAt: archivedAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(archDir, legacy.Id+".htm"), []byte("legacy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = retryFilings(
+		ctx,
+		db,
+		httpclnt.New(server.URL, server.URL, 0, 10*time.Second),
+		folder.New(t.TempDir()),
+		folder.New(archDir),
+		console.New(),
+		[]string{"10-K"},
+		[]string{"EX-13", "EX-27"},
+		database.FilingFilter{Cik: "0000000001"},
+		pipeline{slice: 1, archive: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	progs, err := db.GetFilingStatuses(ctx, &database.FilingFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(progs) != 2 {
+		t.Fatalf("Expected 2 filings but got %d", len(progs))
+	}
+	for _, p := range progs {
+		if p.Status != filing.Archived {
+			t.Errorf("Expected filing '%s' to be archived but it is %s", p.Id, p.Status)
+		}
+		// the main document and the exhibit of the 10-K were restored from the archive
+		if p.Id == archived.Id && p.Tables != 3 {
+			t.Errorf("Expected 3 tables of the archived documents but got %d", p.Tables)
+		}
+	}
+
+	// restored documents are not archived a second time
+	files, err := db.GetArchivedFiles(ctx, &database.FilingFilter{Ids: []string{archived.Id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if !f.ArchivedAt.Equal(archivedAt) {
+			t.Errorf("Expected '%s' to keep its receipt but it was archived again at %s", f.Key, f.ArchivedAt)
+		}
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected 2 archived documents of the 10-K but got %d", len(files))
+	}
+
+	// documents which are still in the archive are not downloaded again
+	downloaded := false
+	for _, r := range server.Requests() {
+		if strings.Contains(r, "exmp-10k.htm") || strings.Contains(r, "exmp-ex13.htm") {
+			t.Errorf("Unexpected request '%s'", r)
+		}
+		if strings.Contains(r, "0000000001-99-000001.txt") {
+			downloaded = true
+		}
+	}
+	if !downloaded {
+		t.Errorf("Expected the legacy submission to be downloaded")
+	}
+}
+
+func TestRestore(t *testing.T) {
+
+	server := edgartest.NewServer("testdata/edgar")
+	defer server.Close()
+	glacier := glaciertest.NewServer()
+	defer glacier.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	db := memory.New()
+	err := db.InsertCompany(ctx, &filing.Company{Cik: "0000000001", Name: "Example Corp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("x", "x", ""),
+	}))
+	arch := vault.New(
+		sess,
+		"filings",
+		0,
+		vault.WithEndpoint(glacier.URL),
+		vault.WithCatalog(db),
+		vault.WithStaging(folder.New(t.TempDir())),
+	)
+
+	_, err = load(
+		ctx,
+		db,
+		httpclnt.New(server.URL, server.URL, 0, 10*time.Second),
+		folder.New(t.TempDir()),
+		arch,
+		console.New(),
+		[]string{"10-K", "10-Q"},
+		[]string{"EX-13", "EX-27"},
+		pipeline{extract: 1, slice: 1, archive: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the documents are pending until their retrieval jobs completed
+	destDir := t.TempDir()
+	restService := restore.New(db, arch, folder.New(destDir), console.New())
+	restored, pending, err := restService.RestoreFilings(ctx, database.FilingFilter{Cik: "0000000001"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 0 || pending < 2 {
+		t.Fatalf("Expected all documents to be pending but got %d restored and %d pending", restored, pending)
+	}
+
+	glacier.CompleteJobs()
+	restored, pending, err = restService.RestoreFilings(ctx, database.FilingFilter{Ids: []string{"000000000124000001"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored < 1 || pending != 0 {
+		t.Fatalf("Expected the documents of the filing to be restored but got %d restored and %d pending", restored, pending)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "000000000124000001.htm")); err != nil {
+		t.Errorf("Expected the main document to be restored: %s", err.Error())
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "000000000199000001.txt")); err == nil {
+		t.Errorf("Expected only the documents of the selected filing to be restored")
+	}
+
+	// the retrieved documents match the checksums glacier returned on upload
+	files, err := db.GetArchivedFiles(ctx, &database.FilingFilter{Cik: "0000000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := verify.New(db, arch, console.New()).VerifyFiles(ctx, database.FilingFilter{Cik: "0000000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Verified != len(files) || rep.Pending > 0 || len(rep.Mismatches) > 0 {
+		t.Errorf("Expected all %d documents to be verified but got %+v", len(files), rep)
+	}
+}
+
+func TestCompress(t *testing.T) {
+
+	server := edgartest.NewServer("testdata/edgar")
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	db := memory.New()
+	err := db.InsertCompany(ctx, &filing.Company{Cik: "0000000001", Name: "Example Corp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = load(
+		ctx,
+		db,
+		httpclnt.New(server.URL, server.URL, 0, 10*time.Second),
+		folder.New(t.TempDir()),
+		folder.New(t.TempDir()),
+		console.New(),
+		[]string{"10-K", "10-Q"},
+		[]string{"EX-13", "EX-27"},
+		pipeline{extract: 1, slice: 1, archive: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a scheduled run after the first one finds every table compressed already
+	l := &recordLogger{}
+	compService := compress.New(db, l)
+	for i, first := range []bool{true, false} {
+		n, err := compService.CompressTables(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first && n < 1 || !first && n != 0 {
+			t.Errorf("Unexpected %d compressed tables in run %d", n, i+1)
+		}
+	}
+	for _, msg := range l.msgs {
+		if strings.Contains(msg, "error") {
+			t.Errorf("Unexpected log '%s'", msg)
+		}
+	}
+}
+
+// logger which keeps the messages for the test
+type recordLogger struct {
+	msgs []string
+}
+
+func (l *recordLogger) Log(msg string) {
+	l.msgs = append(l.msgs, msg)
+}
+
+func TestVerify(t *testing.T) {
+
+	server := edgartest.NewServer("testdata/edgar")
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	db := memory.New()
+	err := db.InsertCompany(ctx, &filing.Company{Cik: "0000000001", Name: "Example Corp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archDir := t.TempDir()
+	_, err = load(
+		ctx,
+		db,
+		httpclnt.New(server.URL, server.URL, 0, 10*time.Second),
+		folder.New(t.TempDir()),
+		folder.New(archDir),
+		console.New(),
+		[]string{"10-K", "10-Q"},
+		[]string{"EX-13", "EX-27"},
+		pipeline{extract: 1, slice: 1, archive: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every archived document has a receipt
+	files, err := db.GetArchivedFiles(ctx, &database.FilingFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived, err := filepath.Glob(filepath.Join(archDir, "*.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < len(archived) || len(archived) < 2 {
+		t.Fatalf("Expected a receipt of every archived document but got %d of %d", len(files), len(archived))
+	}
+
+	verService := verify.New(db, folder.New(archDir), console.New())
+	rep, err := verService.VerifyFiles(ctx, database.FilingFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Verified != len(files) || len(rep.Mismatches) > 0 {
+		t.Fatalf("Expected all %d documents to be verified but got %+v", len(files), rep)
+	}
+
+	// a changed and a missing document are reported
+	err = os.WriteFile(filepath.Join(archDir, "000000000124000001.htm"), []byte("changed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(archDir, "000000000199000001.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err = verService.VerifyFiles(ctx, database.FilingFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Mismatches) != 2 || rep.Verified != len(files)-2 {
+		t.Fatalf("Expected 2 mismatches but got %+v", rep)
+	}
+	for _, m := range rep.Mismatches {
+		if m.File.Key == "000000000124000001.htm" && m.Size != int64(len("changed")) {
+			t.Errorf("Expected the size of the changed document but got %d", m.Size)
+		}
+		if m.File.Key == "000000000199000001.txt" && len(m.Error) < 1 {
+			t.Errorf("Expected the missing document to be reported with an error")
+		}
+	}
+}
+
+func TestS3Archive(t *testing.T) {
+
+	server := edgartest.NewServer("testdata/edgar")
+	defer server.Close()
+	s3 := s3test.NewServer()
+	defer s3.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	db := memory.New()
+	err := db.InsertCompany(ctx, &filing.Company{Cik: "0000000001", Name: "Example Corp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "x")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "x")
+	t.Setenv("REGION", "us-east-1")
+	t.Setenv("BUCKET", "s3")
+	t.Setenv("S3_BUCKET", "filings")
+	t.Setenv("S3_ENDPOINT", s3.URL)
+	t.Setenv("S3_STORAGE_CLASS", "GLACIER_IR")
+	t.Setenv("S3_EXHIBIT_STORAGE_CLASS", "DEEP_ARCHIVE")
+	arch := newArchive(db, time.Minute)
+
+	_, err = load(
+		ctx,
+		db,
+		httpclnt.New(server.URL, server.URL, 0, 10*time.Second),
+		folder.New(t.TempDir()),
+		arch,
+		console.New(),
+		[]string{"10-K", "10-Q"},
+		[]string{"EX-13", "EX-27"},
+		pipeline{extract: 1, slice: 1, archive: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// documents are placed under the company and filing
+	keys := s3.Keys("filings")
+	if len(keys) < 2 {
+		t.Fatalf("Expected the documents of both filings but got %v", keys)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "0000000001/0000000001") {
+			t.Errorf("Expected '%s' to start with the CIK and accession number", key)
+		}
+	}
+	if obj := s3.Object("filings", "0000000001/000000000124000001/exmp-10k.htm"); obj == nil || obj.StorageClass != "GLACIER_IR" {
+		t.Errorf("Expected the main document under its file name in its storage class but got %+v", obj)
+	}
+
+	// main documents are read right away and exhibits once their restore completed
+	verService := verify.New(db, arch, console.New())
+	rep, err := verService.VerifyFiles(ctx, database.FilingFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Verified < 2 || len(rep.Mismatches) > 0 {
+		t.Fatalf("Expected the main documents to be verified but got %+v", rep)
+	}
+	if rep.Pending > 0 {
+		s3.CompleteRestores()
+		rep, err = verService.VerifyFiles(ctx, database.FilingFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Pending > 0 || len(rep.Mismatches) > 0 {
+			t.Fatalf("Expected all documents to be verified but got %+v", rep)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+
+	// the first stage sends until it is stopped and the second one works off the queue
+	q := buffer.New()
+	sent, received := 0, 0
+	stages := []namedStage{
+		{extractStage, func(ctx context.Context) error {
+			defer q.Close()
+			for ctx.Err() == nil {
+				if err := q.SendMessage(ctx, []byte("filing")); err == nil {
+					sent++
+				}
+				time.Sleep(time.Millisecond)
+			}
+			return ctx.Err()
+		}, []queue.Queue{q}},
+		{sliceStage, func(ctx context.Context) error {
+			for {
+				msg, err := q.RecvMessage(ctx)
+				if err == queue.DrainedErr {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				received++
+				q.Ack(ctx, msg)
+			}
+		}, nil},
+	}
+
+	drain := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(drain) })
+	err := runStages(context.Background(), pipeline{drain: drain, timeout: time.Second}, stages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent < 1 || received != sent {
+		t.Errorf("Expected all %d sent messages to be received but got %d", sent, received)
+	}
+
+	// a stage which does not complete in time is cancelled
+	drain = make(chan struct{})
+	close(drain)
+	stages[1].run = func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	err = runStages(context.Background(), pipeline{drain: drain, timeout: 50 * time.Millisecond}, stages)
+	if err == nil {
+		t.Errorf("Expected an error for the expired drain timeout")
+	}
+}
+
+// queue which fails to receive the first times like a database which is unavailable for a moment
+type unavailableQueue struct {
+	queue.Queue
+	failures int
+}
+
+func (q *unavailableQueue) RecvMessage(ctx context.Context) (*queue.Message, error) {
+	if q.failures > 0 {
+		q.failures--
+		return nil, errors.New("connection refused")
+	}
+	return q.Queue.RecvMessage(ctx)
+}
+
+func TestSliceUnavailable(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the stage waits for the queue to come back and completes once the stage before is done
+	cons := &unavailableQueue{Queue: buffer.New(), failures: 1}
+	prod := buffer.New()
+	if err := cons.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err := slice.New(memory.New(), folder.New(t.TempDir()), cons, prod, console.New()).SliceFilings(ctx, 1)
+	if err != nil {
+		t.Fatalf("Expected the stage to retry the queue but got %s", err.Error())
+	}
+	if cons.failures != 0 {
+		t.Errorf("Expected the failed receive to be tried again")
+	}
+	if _, err := prod.RecvMessage(ctx); err != queue.DrainedErr {
+		t.Errorf("Expected the queue of the next stage to be closed but got %v", err)
+	}
+}
+
+// queue which counts how often it was reopened
+type reopenQueue struct {
+	queue.Queue
+	reopened int
+}
+
+func (q *reopenQueue) Reopen(ctx context.Context) error {
+	q.reopened++
+	return nil
+}
+
+func TestReopen(t *testing.T) {
+
+	// only the queues the selected stages send to are reopened before they start
+	first, second := &reopenQueue{Queue: buffer.New()}, &reopenQueue{Queue: buffer.New()}
+	started := func(ctx context.Context) error {
+		if first.reopened+second.reopened < 1 {
+			t.Errorf("Expected the queues to be reopened before the stage started")
+		}
+		return nil
+	}
+	stages := []namedStage{
+		{extractStage, started, []queue.Queue{first}},
+		{sliceStage, started, []queue.Queue{second}},
+		{archiveStage, started, nil},
+	}
+	err := runStages(context.Background(), pipeline{stage: sliceStage}, stages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.reopened != 0 || second.reopened != 1 {
+		t.Errorf("Expected only the queue of the slice stage to be reopened but got %d and %d", first.reopened, second.reopened)
+	}
+	err = runStages(context.Background(), pipeline{}, stages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.reopened != 1 || second.reopened != 2 {
+		t.Errorf("Expected the queues of all stages to be reopened but got %d and %d", first.reopened, second.reopened)
+	}
+}
@@ -1,67 +1,197 @@
 package archive
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/finneas-io/data-pipeline/adapter/bucket"
 	"github.com/finneas-io/data-pipeline/adapter/database"
 	"github.com/finneas-io/data-pipeline/adapter/logger"
 	"github.com/finneas-io/data-pipeline/adapter/queue"
 	"github.com/finneas-io/data-pipeline/domain/filing"
+	"github.com/finneas-io/data-pipeline/service/stage"
 )
 
 type Service struct {
 	db     database.Database
+	spool  bucket.Bucket
 	bucket bucket.Bucket
 	queue  queue.Queue
 	logger logger.Logger
+
+	// deliveries which were stored or failed
+	stored atomic.Int64
+	failed atomic.Int64
 }
 
+// documents are streamed from the spool into the bucket and removed from the spool afterwards
 func New(
 	db database.Database,
+	spool bucket.Bucket,
 	b bucket.Bucket,
 	q queue.Queue,
 	l logger.Logger,
 ) *Service {
-	return &Service{db: db, bucket: b, queue: q, logger: l}
+	return &Service{db: db, spool: spool, bucket: b, queue: q, logger: l}
 }
 
-func (s *Service) StoreFiles() error {
+// documents are stored by several workers at once since archiving mostly waits for the bucket,
+// the workers return once the queue is drained
+func (s *Service) StoreFiles(ctx context.Context, workers int) error {
 
-	for {
+	errs := make(chan error, max(workers, 1))
+	for i := 0; i < max(workers, 1); i++ {
+		go func() {
+			errs <- s.storeFiles(ctx)
+		}()
+	}
+
+	var err error
+	for i := 0; i < max(workers, 1); i++ {
+		if e := <-errs; err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// number of deliveries which were stored and which failed so far, a failed delivery is retried
+// until the queue moves it to the dead letters
+func (s *Service) Processed() (int64, int64) {
+	return s.stored.Load(), s.failed.Load()
+}
 
-		var err error = nil
+// failed messages are rejected so the queue delivers them again or moves them to the dead letters
+func (s *Service) storeFiles(ctx context.Context) error {
 
-		msg, err := s.queue.RecvMessage()
+	for {
+
+		msg, err := s.queue.RecvMessage(ctx)
+		if err == queue.DrainedErr {
+			// the stage before is done and every filing it sent is stored
+			return nil
+		}
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// the queue might be unavailable for a moment so we wait before trying again
 			s.logger.Log(fmt.Sprintf("Queue error: %s", err.Error()))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second):
+			}
 			continue
 		}
 
-		fil := &filing.Filing{}
-		err = json.Unmarshal(msg, fil)
+		err = s.StoreFiling(ctx, msg.Body)
 		if err != nil {
-			s.logger.Log(fmt.Sprintf("Serialization error: %s", err.Error()))
-			continue
+			s.logger.Log(err.Error())
+			s.failed.Add(1)
+			err = s.queue.Nack(ctx, msg, err)
+		} else {
+			s.stored.Add(1)
+			err = s.queue.Ack(ctx, msg)
 		}
-		if fil.MainFile == nil {
-			s.logger.Log(fmt.Sprintf("Serialization error: %s", errors.New("Main file is nil").Error()))
-			continue
+		if err != nil {
+			s.logger.Log(fmt.Sprintf("Queue error: %s", err.Error()))
 		}
+	}
+}
 
-		err = s.bucket.PutObject(fil.Id+".htm", fil.MainFile.Data)
-		if err != nil {
-			s.logger.Log(fmt.Sprintf("Bucket error: %s", err.Error()))
+// stores the documents of the filing message and marks the filing as fully stored
+func (s *Service) StoreFiling(ctx context.Context, body []byte) (err error) {
+
+	defer func() {
+		if err == nil {
+			stage.SetMessageStatus(ctx, s.db, s.logger, body, filing.Archived, nil)
+		} else if ctx.Err() == nil {
+			stage.SetMessageStatus(ctx, s.db, s.logger, body, filing.Failed, err)
+		}
+	}()
+
+	fil, ref, err := stage.FetchFiling(ctx, s.spool, body)
+	if err != nil {
+		return err
+	}
+
+	// documents stored by an earlier delivery or restored from the archive by a retry are not
+	// stored twice since some buckets keep every upload as a separate archive
+	files, err := s.db.GetArchivedFiles(ctx, &database.FilingFilter{Ids: []string{fil.Id}})
+	if err != nil {
+		return fmt.Errorf("Database error: %s", err.Error())
+	}
+	stored := make(map[string]bool)
+	for _, f := range files {
+		stored[f.Key] = true
+	}
+
+	// exhibits are stored next to the main file, those of old filings were split out of the full
+	// submission text file which already contains them
+	archived := []*filing.File{fil.MainFile}
+	if !fil.IsLegacy() {
+		archived = append(archived, fil.Files...)
+	}
+	for _, f := range archived {
+		key := fil.ArchiveKey(f)
+		if stored[key] {
 			continue
 		}
+		err = s.storeFile(ctx, fil, f, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	// if everything went well we can assume that the filing is fully processed
+	err = s.db.UpdateStoredFiling(ctx, fil.Id)
+	if err != nil {
+		return fmt.Errorf("Database error: %s", err.Error())
+	}
 
-		// if everything went well we can assume that the filing is fully processed
-		err = s.db.UpdateStoredFiling(fil.Id)
+	// the spooled documents and the manifest are not needed anymore once the filing is stored
+	keys := []string{}
+	for _, f := range append([]*filing.File{fil.MainFile}, fil.Files...) {
+		keys = append(keys, fil.StoreKey(f))
+	}
+	if len(ref) > 0 {
+		keys = append(keys, ref)
+	}
+	for _, key := range keys {
+		err = s.spool.DeleteObject(ctx, key)
 		if err != nil {
-			s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
-			continue
+			s.logger.Log(fmt.Sprintf("Bucket error: %s", err.Error()))
 		}
 	}
+
+	return nil
+}
+
+// the receipt of the bucket is kept so the document can be found and verified later
+func (s *Service) storeFile(ctx context.Context, fil *filing.Filing, file *filing.File, key string) error {
+	body, err := s.spool.GetObject(ctx, fil.StoreKey(file))
+	if err != nil {
+		return fmt.Errorf("Bucket error: %s", err.Error())
+	}
+	defer body.Close()
+
+	rec, err := s.bucket.PutObject(ctx, key, body)
+	if err != nil {
+		return fmt.Errorf("Bucket error: %s", err.Error())
+	}
+	err = s.db.InsertArchivedFile(ctx, &filing.ArchivedFile{
+		FilingId:   fil.Id,
+		Key:        key,
+		Location:   rec.Location,
+		TreeHash:   rec.TreeHash,
+		Size:       rec.Size,
+		ArchivedAt: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("Database error: %s", err.Error())
+	}
+	return nil
 }
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -11,8 +12,8 @@ import (
 )
 
 type Service interface {
-	LoginUser(username, password string) (string, error)
-	ValidateSession(token string) (uuid.UUID, error)
+	LoginUser(ctx context.Context, username, password string) (string, error)
+	ValidateSession(ctx context.Context, token string) (uuid.UUID, error)
 }
 
 var InvalidCredsErr error = errors.New("Invalid Credentials")
@@ -27,9 +28,9 @@ func New(db database.Database, l logger.Logger) *service {
 	return &service{db: db, logger: l}
 }
 
-func (s *service) LoginUser(username, password string) (string, error) {
+func (s *service) LoginUser(ctx context.Context, username, password string) (string, error) {
 
-	u, err := s.db.GetUser(username)
+	u, err := s.db.GetUser(ctx, username)
 	if err != nil {
 		if err == database.NotFoundErr {
 			return "", InvalidCredsErr
@@ -59,7 +60,7 @@ func (s *service) LoginUser(username, password string) (string, error) {
 		return "", err
 	}
 
-	err = s.db.InsertSession(&user.Session{
+	err = s.db.InsertSession(ctx, &user.Session{
 		Token:     encToken,
 		User:      u,
 		ExpiresAt: time.Now().AddDate(0, 0, 365),
@@ -72,7 +73,7 @@ func (s *service) LoginUser(username, password string) (string, error) {
 	return token, nil
 }
 
-func (s *service) ValidateSession(token string) (uuid.UUID, error) {
+func (s *service) ValidateSession(ctx context.Context, token string) (uuid.UUID, error) {
 
 	encToken, err := user.EncryptSHA256(token)
 	if err != nil {
@@ -80,7 +81,7 @@ func (s *service) ValidateSession(token string) (uuid.UUID, error) {
 		return uuid.UUID{}, err
 	}
 
-	sess, err := s.db.GetSession(encToken)
+	sess, err := s.db.GetSession(ctx, encToken)
 	if err != nil {
 		if err == database.NotFoundErr {
 			return uuid.UUID{}, ExpiredSessErr
@@ -91,7 +92,7 @@ func (s *service) ValidateSession(token string) (uuid.UUID, error) {
 
 	if sess.ExpiresAt.Before(time.Now()) {
 		// try to delete the expired session
-		err := s.db.DeleteSession(encToken)
+		err := s.db.DeleteSession(ctx, encToken)
 		if err != nil {
 			s.logger.Log(err.Error())
 		}
@@ -100,3 +101,9 @@ func (s *service) ValidateSession(token string) (uuid.UUID, error) {
 
 	return sess.User.Id, nil
 }
+
+// sessions are only deleted when they are used after they expired so the ones which are never
+// used again are removed from time to time, returns the number of removed sessions
+func (s *service) CleanSessions(ctx context.Context) (int, error) {
+	return s.db.DeleteExpiredSessions(ctx)
+}
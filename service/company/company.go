@@ -0,0 +1,219 @@
+package company
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/finneas-io/data-pipeline/adapter/client"
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/logger"
+	"github.com/finneas-io/data-pipeline/domain/filing"
+)
+
+var UnknownTickerErr error = errors.New("Ticker is unknown to the SEC")
+
+type Service struct {
+	db      database.Database
+	client  client.Client
+	bucket  bucket.Bucket
+	logger  logger.Logger
+	tickers map[string]string
+}
+
+func New(db database.Database, c client.Client, b bucket.Bucket, l logger.Logger) *Service {
+	return &Service{db: db, client: c, bucket: b, logger: l}
+}
+
+// companies can be identified by their ticker or their CIK with or without padding, companies
+// which were removed before are tracked again, every company is tried and the error tells how
+// many of them failed
+func (s *Service) AddCompanies(ctx context.Context, ids []string) error {
+
+	failed := 0
+	for _, id := range ids {
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := s.addCompany(ctx, id)
+		if err != nil {
+			s.logger.Log(err.Error())
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d companies could not be added", failed, len(ids))
+	}
+	return nil
+}
+
+func (s *Service) addCompany(ctx context.Context, id string) error {
+
+	cik, err := s.resolve(ctx, id)
+	if err != nil {
+		return fmt.Errorf("Could not resolve '%s': %s", id, err.Error())
+	}
+
+	cmp, err := s.client.GetCompany(ctx, cik)
+	if err != nil {
+		return fmt.Errorf("API Client error: %s", err.Error())
+	}
+
+	err = s.db.InsertCompany(ctx, cmp)
+	if err != nil {
+		return fmt.Errorf("Database error: %s", err.Error())
+	}
+	err = s.db.TrackCompany(ctx, cik)
+	if err != nil {
+		return fmt.Errorf("Database error: %s", err.Error())
+	}
+	return nil
+}
+
+// every company is tried and the error tells how many of them failed
+func (s *Service) RemoveCompanies(ctx context.Context, ids []string) error {
+
+	failed := 0
+	for _, id := range ids {
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		cik, err := s.resolve(ctx, id)
+		if err != nil {
+			s.logger.Log(fmt.Sprintf("Could not resolve '%s': %s", id, err.Error()))
+			failed++
+			continue
+		}
+
+		err = s.db.UntrackCompany(ctx, cik)
+		if err != nil {
+			s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d companies could not be removed", failed, len(ids))
+	}
+	return nil
+}
+
+func (s *Service) ListCompanies(ctx context.Context) ([]*filing.Company, error) {
+	return s.db.GetCompanies(ctx)
+}
+
+// refreshes the fields of all tracked companies and records their changes
+func (s *Service) SyncCompanies(ctx context.Context) (int, error) {
+
+	cmps, err := s.db.GetCompanies(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, c := range cmps {
+
+		if ctx.Err() != nil {
+			return changed, ctx.Err()
+		}
+
+		stored, err := s.db.GetCompany(ctx, c.Cik)
+		if err != nil {
+			s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+			continue
+		}
+
+		fetched, err := s.client.GetCompany(ctx, c.Cik)
+		if err != nil {
+			s.logger.Log(fmt.Sprintf("API Client error: %s", err.Error()))
+			continue
+		}
+
+		if !stored.Differs(fetched) {
+			continue
+		}
+
+		err = s.db.UpdateCompany(ctx, fetched)
+		if err != nil {
+			s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+			continue
+		}
+		s.logger.Log(fmt.Sprintf("Company '%s' has changed", c.Cik))
+		changed++
+	}
+
+	return changed, nil
+}
+
+// imports the members of an index from a CSV file, the tickers are expected in the column
+// named 'Symbol' or 'Ticker' or if there is no such header in the first column
+func (s *Service) ImportCompanies(ctx context.Context, file string) error {
+
+	body, err := s.bucket.GetObject(ctx, file)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) < 1 {
+		return nil
+	}
+
+	col := 0
+	for i, v := range records[0] {
+		h := strings.ToLower(strings.TrimSpace(v))
+		if h == "symbol" || h == "ticker" {
+			col = i
+			records = records[1:]
+			break
+		}
+	}
+
+	ids := []string{}
+	for _, rec := range records {
+		if col < len(rec) && len(strings.TrimSpace(rec[col])) > 0 {
+			ids = append(ids, rec[col])
+		}
+	}
+
+	return s.AddCompanies(ctx, ids)
+}
+
+func (s *Service) resolve(ctx context.Context, id string) (string, error) {
+
+	if cik, ok := filing.PadCik(id); ok {
+		return cik, nil
+	}
+
+	// the ticker list is only fetched once per run
+	if s.tickers == nil {
+		tickers, err := s.client.GetTickers(ctx)
+		if err != nil {
+			return "", err
+		}
+		s.tickers = tickers
+	}
+
+	// index lists write share classes like 'BRK.B' while the SEC uses 'BRK-B'
+	ticker := strings.ToUpper(strings.Replace(strings.TrimSpace(id), ".", "-", -1))
+	cik, ok := s.tickers[ticker]
+	if !ok {
+		return "", UnknownTickerErr
+	}
+
+	return cik, nil
+}
@@ -0,0 +1,177 @@
+package company
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/adapter/bucket/folder"
+	"github.com/finneas-io/data-pipeline/adapter/client/edgartest"
+	"github.com/finneas-io/data-pipeline/adapter/client/httpclnt"
+	"github.com/finneas-io/data-pipeline/adapter/database/memory"
+	"github.com/finneas-io/data-pipeline/adapter/logger/console"
+	"github.com/finneas-io/data-pipeline/domain/filing"
+)
+
+func TestResolve(t *testing.T) {
+
+	// the ticker list is set up front so it is never requested
+	s := &Service{tickers: map[string]string{"AAPL": "0000320193", "BRK-B": "0001067983"}}
+	cases := []struct {
+		id   string
+		want string
+		err  error
+	}{
+		{"AAPL", "0000320193", nil},
+		{" aapl ", "0000320193", nil},
+		{"BRK.B", "0001067983", nil},
+		{"brk-b", "0001067983", nil},
+		{"320193", "0000320193", nil},
+		{"0000320193", "0000320193", nil},
+		{"MSFT", "", UnknownTickerErr},
+	}
+	for _, c := range cases {
+		cik, err := s.resolve(context.Background(), c.id)
+		if cik != c.want || err != c.err {
+			t.Errorf("Expected '%s' to resolve to '%s' (%v) but got '%s' (%v)", c.id, c.want, c.err, cik, err)
+		}
+	}
+}
+
+func TestImportCompanies(t *testing.T) {
+
+	server := edgartest.NewServer("../../testdata/edgar")
+	defer server.Close()
+	c := httpclnt.New(server.URL, server.URL, 0, 10*time.Second)
+
+	cases := []struct {
+		name   string
+		csv    string
+		want   int
+		failed bool
+	}{
+		{"symbol column", "Name,Symbol\nExample Corp,EXMP\n", 1, false},
+		{"ticker column", "Ticker,Name\nexmp,Example Corp\n", 1, false},
+		{"first column without header", "EXMP,Example Corp\n", 1, false},
+		{"CIK instead of ticker", "Symbol\n1\n", 1, false},
+		{"unknown ticker", "Symbol\nNOPE\n", 0, true},
+		{"unknown and known ticker", "Symbol\nNOPE\nEXMP\n", 1, true},
+		{"empty cells", "Name,Symbol\nExample Corp,\nOther Corp\n", 0, false},
+		{"empty file", "", 0, false},
+	}
+	for _, test := range cases {
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, "index.csv"), []byte(test.csv), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db := memory.New()
+		err = New(db, c, folder.New(dir), console.New()).ImportCompanies(context.Background(), "index.csv")
+		if (err != nil) != test.failed {
+			t.Fatalf("%s: expected failure %t but got %v", test.name, test.failed, err)
+		}
+		cmps, err := db.GetCompanies(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cmps) != test.want {
+			t.Errorf("%s: expected %d companies but got %d", test.name, test.want, len(cmps))
+		}
+		for _, cmp := range cmps {
+			if cmp.Cik != "0000000001" || cmp.Name != "Example Corp" {
+				t.Errorf("%s: unexpected company '%s' named '%s'", test.name, cmp.Cik, cmp.Name)
+			}
+		}
+	}
+}
+
+func TestAddCompanies(t *testing.T) {
+
+	server := edgartest.NewServer("../../testdata/edgar")
+	defer server.Close()
+	c := httpclnt.New(server.URL, server.URL, 0, 10*time.Second)
+
+	ctx := context.Background()
+	db := memory.New()
+	s := New(db, c, folder.New(t.TempDir()), console.New())
+
+	tracked := func() int {
+		cmps, err := db.GetCompanies(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(cmps)
+	}
+
+	// every company is tried even if others fail
+	err := s.AddCompanies(ctx, []string{"NOPE", "1"})
+	if err == nil {
+		t.Errorf("Expected an error for the unknown ticker")
+	}
+	if tracked() != 1 {
+		t.Fatalf("Expected the known company to be added")
+	}
+
+	err = s.RemoveCompanies(ctx, []string{"1", "NOPE"})
+	if err == nil {
+		t.Errorf("Expected an error for the unknown ticker")
+	}
+	if tracked() != 0 {
+		t.Fatalf("Expected the company to be removed")
+	}
+
+	// inserting the company again like the init command does keeps it removed
+	err = db.InsertCompany(ctx, &filing.Company{Cik: "0000000001", Name: "Example Corp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracked() != 0 {
+		t.Errorf("Expected the removed company to stay removed")
+	}
+
+	// only adding it on purpose tracks it again
+	err = s.AddCompanies(ctx, []string{"EXMP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracked() != 1 {
+		t.Errorf("Expected the company to be tracked again")
+	}
+}
+
+func TestSyncCompanies(t *testing.T) {
+
+	server := edgartest.NewServer("../../testdata/edgar")
+	defer server.Close()
+	c := httpclnt.New(server.URL, server.URL, 0, 10*time.Second)
+
+	db := memory.New()
+	err := db.InsertCompany(context.Background(), &filing.Company{Cik: "0000000001", Name: "Example Inc", Forms: []string{"10-K"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(db, c, folder.New(t.TempDir()), console.New())
+
+	// only the first sync finds the company changed
+	for i, want := range []int{1, 0} {
+		n, err := s.SyncCompanies(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("Expected %d changed companies after sync %d but got %d", want, i+1, n)
+		}
+	}
+
+	// the fields of the SEC are taken over while the configured forms are kept
+	cmp, err := db.GetCompany(context.Background(), "0000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmp.Name != "Example Corp" || cmp.Sic != "3571" || len(cmp.Forms) != 1 {
+		t.Errorf("Unexpected company '%s' with industry '%s' and forms %v", cmp.Name, cmp.Sic, cmp.Forms)
+	}
+}
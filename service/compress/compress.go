@@ -1,6 +1,7 @@
 package compress
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/finneas-io/data-pipeline/adapter/database"
@@ -16,14 +17,21 @@ func New(db database.Database, l logger.Logger) *Service {
 	return &Service{db: db, logger: l}
 }
 
-func (s *Service) CompressTables() error {
+// returns the number of tables which were compressed, tables which were compressed by an earlier
+// run are skipped so runs on a schedule only count the new ones
+func (s *Service) CompressTables(ctx context.Context) (int, error) {
 	count := 0
+	compressed := 0
 
 	for {
 
-		tables, err := s.db.GetAllTables(100, count)
+		if ctx.Err() != nil {
+			return compressed, ctx.Err()
+		}
+
+		tables, err := s.db.GetAllTables(ctx, 100, count)
 		if err != nil {
-			s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+			return compressed, fmt.Errorf("Database error: %s", err.Error())
 		}
 		if len(tables) < 1 {
 			break
@@ -40,12 +48,24 @@ func (s *Service) CompressTables() error {
 				s.logger.Log(fmt.Sprintf("Serialization error: %s", err.Error()))
 				continue
 			}
-			err = s.db.InsertCompTable(tbl, d)
+			err = s.db.InsertCompTable(ctx, tbl, d)
+			if err == database.DuplicateErr {
+				continue
+			}
 			if err != nil {
 				s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+				continue
 			}
+			compressed++
 		}
 	}
 
-	return nil
+	// filings whose tables could not all be compressed stay archived
+	n, err := s.db.UpdateCompressedFilings(ctx)
+	if err != nil {
+		return compressed, fmt.Errorf("Database error: %s", err.Error())
+	}
+	s.logger.Log(fmt.Sprintf("%d filings are fully compressed", n))
+
+	return compressed, nil
 }
@@ -1,6 +1,7 @@
 package create
 
 import (
+	"context"
 	"github.com/finneas-io/data-pipeline/adapter/database"
 	"github.com/finneas-io/data-pipeline/adapter/logger"
 	"github.com/finneas-io/data-pipeline/domain/user"
@@ -16,7 +17,7 @@ func New(db database.Database, l logger.Logger) *service {
 	return &service{db: db, logger: l}
 }
 
-func (s *service) CreateUser(username string) error {
+func (s *service) CreateUser(ctx context.Context, username string) error {
 
 	id, err := uuid.NewV7()
 	if err != nil {
@@ -24,7 +25,7 @@ func (s *service) CreateUser(username string) error {
 	}
 
 	u := &user.User{Username: username, Id: id}
-	err = s.db.InsertUser(u)
+	err = s.db.InsertUser(ctx, u)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/logger"
+	"github.com/finneas-io/data-pipeline/domain/job"
+)
+
+// does the work of a job and returns what it counted
+type Task func(ctx context.Context) (map[string]int64, error)
+
+type Job struct {
+	Name     string
+	Schedule *job.Schedule
+	Task     Task
+}
+
+type Service struct {
+	db     database.Database
+	jobs   []*Job
+	logger logger.Logger
+}
+
+func New(db database.Database, jobs []*Job, l logger.Logger) *Service {
+	return &Service{db: db, jobs: jobs, logger: l}
+}
+
+// runs every job at the times of its schedule until the context is cancelled or the drain is
+// closed, runs which are still going are waited for before it returns
+func (s *Service) Run(ctx context.Context, drain <-chan struct{}) error {
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	next := make([]time.Time, len(s.jobs))
+	for i, j := range s.jobs {
+		next[i] = j.Schedule.Next(time.Now())
+		s.logger.Log(fmt.Sprintf("Job '%s' runs next at %s", j.Name, next[i].Format(time.RFC3339)))
+	}
+
+	for {
+
+		// jobs whose schedule never matches again have the zero time
+		due := -1
+		for i := range s.jobs {
+			if !next[i].IsZero() && (due < 0 || next[i].Before(next[due])) {
+				due = i
+			}
+		}
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if due >= 0 {
+			timer = time.NewTimer(time.Until(next[due]))
+			fire = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			stop(timer)
+			return ctx.Err()
+		case <-drain:
+			stop(timer)
+			return nil
+		case <-fire:
+		}
+
+		j := s.jobs[due]
+		next[due] = j.Schedule.Next(time.Now())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.RunJob(ctx, j)
+		}()
+	}
+}
+
+// runs the job unless a run of it is still going in this or another process and records
+// the run, the returned error is the one of the job
+func (s *Service) RunJob(ctx context.Context, j *Job) error {
+
+	unlock, err := s.db.TryLock(ctx, "job_"+j.Name)
+	if err == database.LockedErr {
+		s.logger.Log(fmt.Sprintf("Job '%s' is still running, the run is skipped", j.Name))
+		return err
+	}
+	if err != nil {
+		s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+		return err
+	}
+	defer unlock()
+
+	run := &job.Run{Job: j.Name, StartedAt: time.Now(), Outcome: job.Running}
+	err = s.db.InsertJobRun(ctx, run)
+	if err != nil {
+		s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+	}
+
+	counts, err := j.Task(ctx)
+	run.FinishedAt = time.Now()
+	run.Counts = counts
+	run.Outcome = job.Succeeded
+	if err != nil {
+		run.Outcome = job.Failed
+		run.Error = err.Error()
+		s.logger.Log(fmt.Sprintf("Job '%s' failed: %s", j.Name, err.Error()))
+	}
+
+	// the run is recorded even if the job was cancelled
+	if run.Id > 0 {
+		uerr := s.db.UpdateJobRun(context.Background(), run)
+		if uerr != nil {
+			s.logger.Log(fmt.Sprintf("Database error: %s", uerr.Error()))
+		}
+	}
+	return err
+}
+
+func stop(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
@@ -0,0 +1,68 @@
+package deadletter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/logger"
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+)
+
+// processes the body of a message like the consumer of a queue would
+type Handler func(ctx context.Context, body []byte) error
+
+type Service struct {
+	db       database.Database
+	handlers map[string]Handler
+	logger   logger.Logger
+}
+
+// handlers are looked up by the name of the queue the dead letter comes from
+func New(db database.Database, handlers map[string]Handler, l logger.Logger) *Service {
+	return &Service{db: db, handlers: handlers, logger: l}
+}
+
+// an empty queue name lists the dead letters of all queues
+func (s *Service) ListDeadLetters(ctx context.Context, name string) ([]*queue.DeadLetter, error) {
+	return s.db.GetDeadLetters(ctx, name)
+}
+
+// processes the dead letters again and removes the ones which succeed, returns the
+// number of replayed dead letters
+func (s *Service) ReplayDeadLetters(ctx context.Context, name string) (int, error) {
+
+	dls, err := s.db.GetDeadLetters(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, dl := range dls {
+
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+
+		handle, ok := s.handlers[dl.Queue]
+		if !ok {
+			s.logger.Log(fmt.Sprintf("No handler for dead letter '%s' of queue '%s'", dl.Id, dl.Queue))
+			continue
+		}
+
+		err = handle(ctx, dl.Body)
+		if err != nil {
+			s.logger.Log(fmt.Sprintf("Replay of dead letter '%s' failed: %s", dl.Id, err.Error()))
+			continue
+		}
+
+		err = s.db.DeleteDeadLetter(ctx, dl.Id)
+		if err != nil {
+			s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+			continue
+		}
+		count++
+	}
+
+	return count, nil
+}
@@ -1,93 +1,413 @@
 package extract
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
 	"github.com/finneas-io/data-pipeline/adapter/client"
 	"github.com/finneas-io/data-pipeline/adapter/database"
 	"github.com/finneas-io/data-pipeline/adapter/logger"
 	"github.com/finneas-io/data-pipeline/adapter/queue"
 	"github.com/finneas-io/data-pipeline/domain/filing"
+	"github.com/finneas-io/data-pipeline/service/stage"
 )
 
 type Service struct {
 	db     database.Database
 	client client.Client
+	spool  bucket.Bucket
 	queue  queue.Queue
 	logger logger.Logger
+	forms  []string
+	exhibs []string
+
+	// filings which were loaded or failed to load
+	loaded atomic.Int64
+	failed atomic.Int64
 }
 
+// forms are accepted for companies which have no forms configured themselves and
+// documents of the exhibit types are loaded in addition to the main document, the
+// documents are streamed into the spool from where the following stages read them
 func New(
 	db database.Database,
 	c client.Client,
+	spool bucket.Bucket,
 	q queue.Queue,
 	l logger.Logger,
+	forms []string,
+	exhibits []string,
 ) *Service {
-	return &Service{db: db, client: c, queue: q, logger: l}
+	return &Service{db: db, client: c, spool: spool, queue: q, logger: l, forms: forms, exhibs: exhibits}
 }
 
-func (s *Service) LoadFilings() error {
+// companies are distributed over the workers so all filings of a company are loaded by the
+// same worker, the queue is closed once every worker is done even if the load was cancelled
+// so the following stages can finish the filings which were loaded until then, only the
+// filings since the last load are requested unless a full comparison is asked for
+func (s *Service) LoadFilings(ctx context.Context, workers int, full bool) error {
 
-	cmps, err := s.db.GetCompanies()
+	cmps, err := s.db.GetCompanies(ctx)
 	if err != nil {
 		return err
 	}
 
-	for _, cmp := range cmps {
+	shard := make(chan *filing.Company)
+	go func() {
+		defer close(shard)
+		for _, cmp := range cmps {
+			select {
+			case shard <- cmp:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
-		// filings in the database returned as look up map
-		got, err := s.db.GetFilings(cmp.Cik)
-		if err != nil {
-			s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cmp := range shard {
+				s.loadCompany(ctx, cmp, full)
+			}
+		}()
+	}
+	wg.Wait()
+
+	err = s.queue.Close()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// number of filings which were loaded and which failed to load so far
+func (s *Service) Processed() (int64, int64) {
+	return s.loaded.Load(), s.failed.Load()
+}
+
+func (s *Service) loadCompany(ctx context.Context, cmp *filing.Company, full bool) {
+
+	// filings in the database returned as look up map
+	got, err := s.db.GetFilings(ctx, cmp.Cik)
+	if err != nil {
+		s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+		s.failed.Add(1)
+		return
+	}
+
+	// companies which were never loaded are compared against all of their filings
+	state, err := s.db.GetSyncState(ctx, cmp.Cik)
+	if err != nil && err != database.NotFoundErr {
+		s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+		s.failed.Add(1)
+		return
+	}
+	if full {
+		state = nil
+	}
+
+	all, next, err := s.listFilings(ctx, cmp.Cik, state)
+	if err == client.NotModifiedErr {
+		return
+	}
+	if err != nil {
+		s.logger.Log(fmt.Sprintf("API Client error: %s", err.Error()))
+		s.failed.Add(1)
+		return
+	}
+
+	complete := true
+	for _, v := range all {
+
+		// check if filing is already in database
+		if got[v.Id] != nil || !cmp.Accepts(v.Form, s.forms) {
 			continue
 		}
 
-		// all possible filings received from the API
-		all, err := s.client.GetFilings(cmp.Cik)
+		err = s.loadFiling(ctx, cmp.Cik, v)
 		if err != nil {
-			s.logger.Log(fmt.Sprintf("API Client error: %s", err.Error()))
+			if ctx.Err() != nil {
+				return
+			}
+			s.logger.Log(err.Error())
+			complete = false
 			continue
 		}
+	}
 
-		want := []*filing.Filing{}
-		for _, v := range all {
+	// the position only moves once nothing is left behind so the next load sees failed filings again
+	if !complete {
+		return
+	}
+	err = s.db.UpdateSyncState(ctx, next)
+	if err != nil {
+		s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+	}
+}
 
-			// check if filing is already in database
-			if got[v.Id] != nil {
-				continue
-			}
+// filings which might be new since the last load, the recent submissions are enough as long as
+// they still list the newest filing of the last load otherwise all pages of the submissions
+// are requested, the returned state is the position after the filings are loaded
+func (s *Service) listFilings(ctx context.Context, cik string, state *filing.SyncState) ([]*filing.Filing, *filing.SyncState, error) {
 
-			v.MainFile, err = s.client.GetFile(cmp.Cik, v.Id, v.MainFile.Key)
-			if err != nil {
-				s.logger.Log(fmt.Sprintf("API Client error: %s", err.Error()))
-				continue
-			}
+	etag := ""
+	if state != nil {
+		etag = state.ETag
+	}
+	subs, err := s.client.GetRecentFilings(ctx, cik, etag)
+	if err != nil {
+		return nil, nil, err
+	}
 
-			want = append(want, v)
+	next := &filing.SyncState{Cik: cik, ETag: subs.ETag, SyncedAt: time.Now()}
+	seen := false
+	for _, v := range subs.Filings {
+		if v.FilingDate.After(next.LastFilingDate) || len(next.LastId) < 1 {
+			next.LastId = v.Id
+			next.LastFilingDate = v.FilingDate
+		}
+		if state != nil && v.Id == state.LastId {
+			seen = true
 		}
+	}
 
-		// load missing filings into database and queue
-		for _, v := range want {
+	if seen {
+		// amendments have to be linked before filtering in case the original form is not accepted
+		filing.LinkAmendments(subs.Filings)
 
-			err = s.db.InsertFiling(cmp.Cik, v)
-			if err != nil {
-				s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
-				continue
+		// filings of the same day as the last one might have been added after the last load
+		fils := []*filing.Filing{}
+		for _, v := range subs.Filings {
+			if !v.FilingDate.Before(state.LastFilingDate) {
+				fils = append(fils, v)
 			}
+		}
+		return fils, next, nil
+	}
 
-			b, err := json.Marshal(v)
-			if err != nil {
-				s.logger.Log(fmt.Sprintf("Serialization error: %s", err.Error()))
-				continue
-			}
-			err = s.queue.SendMessage(b)
-			if err != nil {
-				s.logger.Log(fmt.Sprintf("Queue error: %s", err.Error()))
-				continue
-			}
+	all, err := s.client.GetFilings(ctx, cik)
+	if err != nil {
+		return nil, nil, err
+	}
+	filing.LinkAmendments(all)
+	return all, next, nil
+}
+
+// inserts the filing into the database before its files are downloaded so a failed download
+// is recorded on the filing, the filing is sent to the queue once everything is in the spool
+func (s *Service) loadFiling(ctx context.Context, cik string, fil *filing.Filing) (err error) {
+
+	// filings which were interrupted by a cancellation did not fail
+	defer func() {
+		if err == nil {
+			s.loaded.Add(1)
+		} else if ctx.Err() == nil {
+			s.failed.Add(1)
+		}
+	}()
+
+	err = s.db.InsertFiling(ctx, cik, fil)
+	if err != nil {
+		return fmt.Errorf("Database error: %s", err.Error())
+	}
+
+	defer func() {
+		if err != nil && ctx.Err() == nil {
+			stage.SetStatus(ctx, s.db, s.logger, fil.Id, filing.Failed, err)
+		}
+	}()
+
+	err = s.DownloadFiling(ctx, cik, fil)
+	if err != nil {
+		return err
+	}
+	stage.SetStatus(ctx, s.db, s.logger, fil.Id, filing.Downloaded, nil)
+
+	b, err := json.Marshal(&queue.FilMessage{Cik: cik, Id: fil.Id, Ref: fil.ManifestKey(), Date: fil.FilingDate})
+	if err != nil {
+		return fmt.Errorf("Serialization error: %s", err.Error())
+	}
+	err = s.queue.SendMessage(ctx, b)
+	if err != nil {
+		return fmt.Errorf("Queue error: %s", err.Error())
+	}
+
+	return nil
+}
+
+// streams the documents of the filing into the spool and puts its manifest next to them
+func (s *Service) DownloadFiling(ctx context.Context, cik string, fil *filing.Filing) (err error) {
+
+	// the file list is fetched once for the main document and its exhibits, old filings carry
+	// their exhibits inside of the full submission text file and need no list
+	listed := []*filing.File{}
+	if len(s.exhibs) > 0 && !fil.IsLegacy() {
+		listed, err = s.client.GetFiles(ctx, cik, fil.Id)
+		if err != nil {
+			return fmt.Errorf("API Client error: %s", err.Error())
+		}
+	}
+
+	// the main document is only looked up on its own if there is no list
+	i := slices.IndexFunc(listed, func(f *filing.File) bool { return f.Key == fil.MainFile.Key })
+	if i < 0 {
+		fil.MainFile, err = s.spoolMainFile(ctx, cik, fil)
+	} else {
+		fil.MainFile = listed[i]
+		err = s.spoolFile(ctx, cik, fil, fil.MainFile)
+	}
+	if err != nil {
+		return err
+	}
+	fil.MainFile.Type = fil.Form
+
+	fil.Files, err = s.loadExhibits(ctx, cik, fil, listed)
+	if err != nil {
+		return err
+	}
+
+	// the manifest is stored once and the following stages fetch it by the reference in the message
+	b, err := json.Marshal(fil)
+	if err != nil {
+		return fmt.Errorf("Serialization error: %s", err.Error())
+	}
+	_, err = s.spool.PutObject(ctx, fil.ManifestKey(), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("Bucket error: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *Service) loadExhibits(ctx context.Context, cik string, fil *filing.Filing, listed []*filing.File) ([]*filing.File, error) {
+
+	if len(s.exhibs) < 1 {
+		return nil, nil
+	}
+
+	// exhibits of old filings are documents inside of the full submission text file
+	if fil.IsLegacy() {
+		return s.splitExhibits(ctx, fil)
+	}
+
+	files := []*filing.File{}
+	for _, v := range listed {
+
+		if v.Key == fil.MainFile.Key || !v.IsType(s.exhibs) {
+			continue
+		}
+		// exhibits can also be images or PDF files which contain no tables we could read
+		if !strings.HasSuffix(v.Key, ".htm") && !strings.HasSuffix(v.Key, ".html") {
+			continue
+		}
+
+		err := s.spoolFile(ctx, cik, fil, v)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, v)
+	}
+
+	return files, nil
+}
+
+// legacy submissions are small enough to be split in memory
+func (s *Service) splitExhibits(ctx context.Context, fil *filing.Filing) ([]*filing.File, error) {
+
+	body, err := s.spool.GetObject(ctx, fil.StoreKey(fil.MainFile))
+	if err != nil {
+		return nil, fmt.Errorf("Bucket error: %s", err.Error())
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("Bucket error: %s", err.Error())
+	}
+	if !filing.IsSubmission(data) {
+		return nil, nil
+	}
+
+	docs, err := filing.SplitSubmission(data)
+	if err != nil {
+		return nil, fmt.Errorf("Domain error: %s", err.Error())
+	}
+	if len(docs) < 1 {
+		return nil, errors.New("Domain error: No documents found in submission")
+	}
+	files := []*filing.File{}
+	for _, d := range docs[1:] {
+		if !d.IsType(s.exhibs) {
+			continue
+		}
+		_, err = s.spool.PutObject(ctx, fil.StoreKey(d), bytes.NewReader(d.Data))
+		if err != nil {
+			return nil, fmt.Errorf("Bucket error: %s", err.Error())
 		}
+		d.Data = nil
+		files = append(files, d)
+	}
+	return files, nil
+}
+
+// streams a listed document of the filing into the spool
+func (s *Service) spoolFile(ctx context.Context, cik string, fil *filing.Filing, file *filing.File) error {
+
+	body, err := s.client.OpenDocument(ctx, cik, fil.Id, file.Key)
+	if err != nil {
+		return fmt.Errorf("API Client error: %s", err.Error())
+	}
+	defer body.Close()
+
+	_, err = s.spool.PutObject(ctx, fil.StoreKey(file), body)
+	if err != nil {
+		return fmt.Errorf("Bucket error: %s", err.Error())
+	}
+	return nil
+}
+
+// streams the main document into the spool after looking it up, the returned file carries no data
+func (s *Service) spoolMainFile(ctx context.Context, cik string, fil *filing.Filing) (*filing.File, error) {
+
+	file, body, err := s.client.OpenFile(ctx, cik, fil.Id, fil.MainFile.Key)
+	if err != nil {
+		return nil, fmt.Errorf("API Client error: %s", err.Error())
 	}
+	defer body.Close()
 
-	return s.queue.Close()
+	_, err = s.spool.PutObject(ctx, fil.StoreKey(file), body)
+	if err != nil {
+		return nil, fmt.Errorf("Bucket error: %s", err.Error())
+	}
+	return file, nil
+}
+
+// priority of a filing message for queues which deliver the newest filings first
+func NewestFirst(msg []byte) int64 {
+	m := &queue.FilMessage{}
+	if err := json.Unmarshal(msg, m); err != nil {
+		return 0
+	}
+	return m.Date.Unix()
+}
+
+// attributes of a filing message for queues which can show or filter messages without their body
+func Attributes(msg []byte) map[string]string {
+	m := &queue.FilMessage{}
+	if err := json.Unmarshal(msg, m); err != nil {
+		return nil
+	}
+	return map[string]string{"cik": m.Cik, "id": m.Id}
 }
@@ -0,0 +1,163 @@
+package extract
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/adapter/client"
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/domain/filing"
+)
+
+// the submissions API lags behind the feed a little, entries which can't be resolved
+// after this period are skipped to not block the cursor forever
+const resolveGrace = time.Hour
+
+var unresolvedErr error = errors.New("Filing not yet listed in submissions")
+
+// the queue is closed once the watch is cancelled so the following stages can finish the
+// filings which were loaded until then
+func (s *Service) WatchFilings(ctx context.Context, interval time.Duration) error {
+
+	defer s.queue.Close()
+
+	for {
+
+		cmps, err := s.db.GetCompanies(ctx)
+		if err != nil {
+			s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
+			if !sleep(ctx, interval) {
+				return ctx.Err()
+			}
+			continue
+		}
+		// the feed is requested for every form which is accepted by at least one company
+		tracked := make(map[string]*filing.Company)
+		forms := []string{}
+		seen := make(map[string]bool)
+		for _, c := range cmps {
+			tracked[c.Cik] = c
+			fs := c.Forms
+			if len(fs) < 1 {
+				fs = s.forms
+			}
+			for _, f := range fs {
+				if !seen[f] {
+					seen[f] = true
+					forms = append(forms, f)
+				}
+			}
+		}
+
+		for _, form := range forms {
+			err = s.pollFeed(ctx, form, tracked)
+			if err != nil {
+				s.logger.Log(err.Error())
+			}
+		}
+
+		if !sleep(ctx, interval) {
+			return ctx.Err()
+		}
+	}
+}
+
+// returns false if the context is done before the duration has passed
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// every form type has its own cursor because the feed is requested per form type
+func (s *Service) pollFeed(ctx context.Context, form string, tracked map[string]*filing.Company) error {
+
+	name := "feed:" + form
+	since, err := s.db.GetCursor(ctx, name)
+	if err != nil && err != database.NotFoundErr {
+		return fmt.Errorf("Database error: %s", err.Error())
+	}
+
+	entries, err := s.client.GetLatestFilings(ctx, form, since)
+	if err != nil {
+		return fmt.Errorf("API Client error: %s", err.Error())
+	}
+
+	// walk from oldest to newest so the cursor only ever moves forward
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Updated.Before(entries[j].Updated)
+	})
+
+	cursor := since
+	blocked := false
+	for _, e := range entries {
+
+		err = s.loadEntry(ctx, e, form, tracked)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s.logger.Log(err.Error())
+			// entries after a failed one stay behind the cursor and are seen again
+			blocked = true
+			continue
+		}
+
+		if !blocked && e.Updated.After(cursor) {
+			cursor = e.Updated
+		}
+	}
+
+	if !cursor.After(since) {
+		return nil
+	}
+	err = s.db.UpdateCursor(ctx, name, cursor)
+	if err != nil {
+		return fmt.Errorf("Database error: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *Service) loadEntry(ctx context.Context, e *client.FeedEntry, form string, tracked map[string]*filing.Company) error {
+
+	// the feed also returns related forms like amendments for a requested form type
+	cmp := tracked[e.Cik]
+	if e.Form != form || cmp == nil || !cmp.Accepts(e.Form, s.forms) {
+		return nil
+	}
+
+	// filings which are already known were loaded before or by a regular load
+	_, err := s.db.GetFiling(ctx, e.Id)
+	if err == nil {
+		return nil
+	}
+	if err != database.NotFoundErr {
+		return fmt.Errorf("Database error: %s", err.Error())
+	}
+
+	// the feed does not contain the main document so we look it up in the submissions, new
+	// filings are always listed with the recent ones so the older pages are not requested
+	subs, err := s.client.GetRecentFilings(ctx, e.Cik, "")
+	if err != nil {
+		return fmt.Errorf("API Client error: %s", err.Error())
+	}
+	filing.LinkAmendments(subs.Filings)
+	for _, f := range subs.Filings {
+		if f.Id == e.Id {
+			return s.loadFiling(ctx, e.Cik, f)
+		}
+	}
+
+	if time.Since(e.Updated) > resolveGrace {
+		s.logger.Log(fmt.Sprintf("Skipping feed entry '%s': %s", e.Id, unresolvedErr.Error()))
+		return nil
+	}
+	return fmt.Errorf("Feed error: %s '%s'", unresolvedErr.Error(), e.Id)
+}
@@ -1,6 +1,7 @@
 package initial
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -8,6 +9,7 @@ import (
 	"github.com/finneas-io/data-pipeline/adapter/client"
 	"github.com/finneas-io/data-pipeline/adapter/database"
 	"github.com/finneas-io/data-pipeline/adapter/logger"
+	"github.com/finneas-io/data-pipeline/domain/filing"
 )
 
 type Service struct {
@@ -21,35 +23,49 @@ func New(db database.Database, client client.Client, b bucket.Bucket, l logger.L
 	return &Service{db: db, client: client, bucket: b, logger: l}
 }
 
-func (s *Service) InitDatabase() error {
-	return s.db.CreateBaseTables()
+func (s *Service) InitDatabase(ctx context.Context) error {
+	return s.db.CreateBaseTables(ctx)
 }
 
 type wrapper struct {
 	Ciks []string `json:"ciks"`
+	// optional forms per company which replace the globally configured forms
+	Forms map[string][]string `json:"forms"`
 }
 
-func (s *Service) LoadCompanies(file string) error {
+func (s *Service) LoadCompanies(ctx context.Context, file string) error {
 
-	data, err := s.bucket.GetObject(file)
+	body, err := s.bucket.GetObject(ctx, file)
 	if err != nil {
 		return err
 	}
+	defer body.Close()
 
 	ciks := &wrapper{}
-	err = json.Unmarshal(data, ciks)
+	err = json.NewDecoder(body).Decode(ciks)
 	if err != nil {
 		return err
 	}
 
-	for _, cik := range ciks.Ciks {
-		cmp, err := s.client.GetCompany(cik)
+	for _, v := range ciks.Ciks {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		cik, ok := filing.PadCik(v)
+		if !ok {
+			s.logger.Log(fmt.Sprintf("Invalid CIK '%s'", v))
+			continue
+		}
+
+		cmp, err := s.client.GetCompany(ctx, cik)
 		if err != nil {
 			s.logger.Log(fmt.Sprintf("API Client error: %s", err.Error()))
 			continue
 		}
 
-		err = s.db.InsertCompany(cmp)
+		cmp.Forms = ciks.Forms[v]
+
+		err = s.db.InsertCompany(ctx, cmp)
 		if err != nil {
 			s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
 		}
@@ -1,6 +1,7 @@
 package label
 
 import (
+	"context"
 	"errors"
 
 	"github.com/finneas-io/data-pipeline/adapter/database"
@@ -10,8 +11,8 @@ import (
 )
 
 type Service interface {
-	RandomTable(userId uuid.UUID) (*filing.Company, error)
-	CreateLabel(tblId, userId uuid.UUID, label string) error
+	RandomTable(ctx context.Context, userId uuid.UUID) (*filing.Company, error)
+	CreateLabel(ctx context.Context, tblId, userId uuid.UUID, label string) error
 }
 
 var NoTblLeftErr error = errors.New("No tables left")
@@ -31,14 +32,14 @@ func New(db database.Database, l logger.Logger) *service {
 	}
 }
 
-func (s *service) RandomTable(userId uuid.UUID) (*filing.Company, error) {
+func (s *service) RandomTable(ctx context.Context, userId uuid.UUID) (*filing.Company, error) {
 
 	if s.queues[userId] == nil {
 		s.queues[userId] = make(chan *filing.Company, 100)
 	}
 
 	if len(s.queues[userId]) < 1 {
-		tbls, err := s.db.GetRandomTables(userId)
+		tbls, err := s.db.GetRandomTables(ctx, userId)
 		if err != nil {
 			s.logger.Log(err.Error())
 			close(s.queues[userId])
@@ -56,7 +57,7 @@ func (s *service) RandomTable(userId uuid.UUID) (*filing.Company, error) {
 	return <-s.queues[userId], nil
 }
 
-func (s *service) CreateLabel(tblId, userId uuid.UUID, label string) error {
+func (s *service) CreateLabel(ctx context.Context, tblId, userId uuid.UUID, label string) error {
 
 	if label != "cash flow statement" &&
 		label != "balance sheet" &&
@@ -65,7 +66,7 @@ func (s *service) CreateLabel(tblId, userId uuid.UUID, label string) error {
 		return InvalidLabelErr
 	}
 
-	err := s.db.InsertLabel(tblId, userId, label)
+	err := s.db.InsertLabel(ctx, tblId, userId, label)
 	if err != nil {
 		s.logger.Log(err.Error())
 		return err
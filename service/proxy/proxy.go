@@ -1,12 +1,13 @@
 package proxy
 
 import (
+	"context"
 	"github.com/finneas-io/data-pipeline/adapter/client"
 	"github.com/finneas-io/data-pipeline/adapter/logger"
 )
 
 type Service interface {
-	GetFiling(cik, id, key string) ([]byte, error)
+	GetFiling(ctx context.Context, cik, id, key string) ([]byte, error)
 }
 
 type service struct {
@@ -18,8 +19,8 @@ func New(c client.Client, l logger.Logger) *service {
 	return &service{client: c, logger: l}
 }
 
-func (s *service) GetFiling(cik, id, key string) ([]byte, error) {
-	file, err := s.client.GetFile(cik, id, key)
+func (s *service) GetFiling(ctx context.Context, cik, id, key string) ([]byte, error) {
+	file, err := s.client.GetFile(ctx, cik, id, key)
 	if err != nil {
 		s.logger.Log(err.Error())
 		return nil, err
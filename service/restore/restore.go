@@ -0,0 +1,129 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/logger"
+	"github.com/finneas-io/data-pipeline/domain/filing"
+)
+
+type Service struct {
+	db     database.Database
+	bucket bucket.Bucket
+	dest   bucket.Bucket
+	logger logger.Logger
+}
+
+// documents are copied from the archive bucket into the destination bucket under the keys
+// they were archived with
+func New(db database.Database, b bucket.Bucket, dest bucket.Bucket, l logger.Logger) *Service {
+	return &Service{db: db, bucket: b, dest: dest, logger: l}
+}
+
+// restores the documents of all filings which match the filter, documents whose retrieval is
+// not completed yet are pending and tried again after the wait until all of them are restored,
+// without a wait the number of pending documents is returned right away and a later call picks
+// up their retrievals
+func (s *Service) RestoreFilings(ctx context.Context, filter database.FilingFilter, wait time.Duration) (int, int, error) {
+
+	keys, err := s.archivedKeys(ctx, &filter)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	restored := 0
+	for {
+		pending := []string{}
+		for _, key := range keys {
+			err := s.restoreObject(ctx, key)
+			if err == bucket.PendingErr {
+				pending = append(pending, key)
+				continue
+			}
+			if err != nil {
+				return restored, len(pending), err
+			}
+			restored++
+		}
+
+		if len(pending) < 1 || wait <= 0 {
+			return restored, len(pending), nil
+		}
+		s.logger.Log(fmt.Sprintf("%d documents are being retrieved, checking again in %s", len(pending), wait))
+		select {
+		case <-ctx.Done():
+			return restored, len(pending), ctx.Err()
+		case <-time.After(wait):
+		}
+		keys = pending
+	}
+}
+
+// keys are taken from the receipts of the archived documents, filings which were archived before
+// receipts were kept have their main document under the id of the filing and their exhibits in
+// a folder of the id, such exhibits are only found in buckets which can list their keys
+func (s *Service) archivedKeys(ctx context.Context, filter *database.FilingFilter) ([]string, error) {
+
+	files, err := s.db.GetArchivedFiles(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %s", err.Error())
+	}
+	progs, err := s.db.GetFilingStatuses(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %s", err.Error())
+	}
+
+	keys := []string{}
+	received := make(map[string]bool)
+	for _, file := range files {
+		keys = append(keys, file.Key)
+		received[file.FilingId] = true
+	}
+
+	lister, ok := s.bucket.(bucket.Lister)
+	for _, p := range progs {
+		// filings which never made it into the archive have nothing to restore
+		id := p.Id
+		if received[id] || !p.Reached(filing.Archived) {
+			continue
+		}
+		if !ok {
+			keys = append(keys, id+".htm")
+			continue
+		}
+		found, err := lister.ListKeys(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("Bucket error: %s", err.Error())
+		}
+		if len(found) < 1 {
+			s.logger.Log(fmt.Sprintf("No documents of filing '%s' are archived", id))
+		}
+		for _, key := range found {
+			if key == id+".htm" || len(key) > len(id) && key[len(id)] == '/' {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (s *Service) restoreObject(ctx context.Context, key string) error {
+	r, err := s.bucket.GetObject(ctx, key)
+	if err == bucket.PendingErr {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Bucket error: %s", err.Error())
+	}
+	defer r.Close()
+
+	_, err = s.dest.PutObject(ctx, key, r)
+	if err != nil {
+		return fmt.Errorf("Bucket error: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/logger"
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+	"github.com/finneas-io/data-pipeline/domain/filing"
+	"github.com/finneas-io/data-pipeline/service/stage"
+)
+
+// downloads the documents of the filing into the spool and puts its manifest next to them
+type Downloader func(ctx context.Context, cik string, fil *filing.Filing) error
+
+// statuses of filings which did not make it through the pipeline
+var incomplete = []filing.Status{filing.Discovered, filing.Downloaded, filing.Sliced, filing.Failed}
+
+type Service struct {
+	db       database.Database
+	spool    bucket.Bucket
+	bucket   bucket.Bucket
+	download Downloader
+	slice    queue.Queue
+	archive  queue.Queue
+	logger   logger.Logger
+
+	// filings which were sent again or failed to be sent
+	retried atomic.Int64
+	failed  atomic.Int64
+}
+
+// the documents of a filing are taken from the spool or the archive bucket if they are still
+// there and only downloaded again otherwise, filings are sent to the queue of the slice stage
+// or directly to the queue of the archive stage if they were sliced before
+func New(
+	db database.Database,
+	spool bucket.Bucket,
+	b bucket.Bucket,
+	download Downloader,
+	slice queue.Queue,
+	archive queue.Queue,
+	l logger.Logger,
+) *Service {
+	return &Service{db: db, spool: spool, bucket: b, download: download, slice: slice, archive: archive, logger: l}
+}
+
+// sends the incomplete filings which match the filter again, the statuses of the filter are
+// replaced by the incomplete ones, the queue of the slice stage is closed afterwards like
+// the extract stage does so the following stages complete once they worked off their queues
+func (s *Service) RetryFilings(ctx context.Context, filter database.FilingFilter) error {
+
+	filter.Statuses = incomplete
+	progs, err := s.db.GetFilingStatuses(ctx, &filter)
+	if err != nil {
+		s.slice.Close()
+		return err
+	}
+
+	for _, p := range progs {
+		if ctx.Err() != nil {
+			break
+		}
+		err = s.retryFiling(ctx, p)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			s.logger.Log(err.Error())
+			s.failed.Add(1)
+			stage.SetStatus(ctx, s.db, s.logger, p.Id, filing.Failed, err)
+			continue
+		}
+		s.retried.Add(1)
+	}
+
+	err = s.slice.Close()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// number of filings which were sent again and which could not be sent
+func (s *Service) Processed() (int64, int64) {
+	return s.retried.Load(), s.failed.Load()
+}
+
+func (s *Service) retryFiling(ctx context.Context, p *filing.Progress) error {
+
+	// a failed filing continues after the last stage it completed
+	reached := p.Status
+	if reached == filing.Failed {
+		reached = p.LastStatus
+	}
+	// filings loaded before their status was recorded were sliced if they have tables
+	if p.UpdatedAt.IsZero() && p.Tables > 0 {
+		reached = filing.Sliced
+	}
+
+	fil, err := s.db.GetFiling(ctx, p.Id)
+	if err != nil {
+		return fmt.Errorf("Database error: %s", err.Error())
+	}
+
+	// the manifest is only removed from the spool together with the documents
+	spooled := s.spooledFiling(ctx, fil)
+	if spooled != nil {
+		fil = spooled
+	} else {
+		files, err := s.db.GetArchivedFiles(ctx, &database.FilingFilter{Ids: []string{fil.Id}})
+		if err != nil {
+			return fmt.Errorf("Database error: %s", err.Error())
+		}
+		// the archive stage removes the spooled documents only after all of them were stored so
+		// a sliced filing with receipts is complete and just missed its status
+		if reached == filing.Sliced && len(files) > 0 {
+			stage.SetStatus(ctx, s.db, s.logger, p.Id, filing.Archived, nil)
+			return nil
+		}
+		err = s.restoreFiling(ctx, p.Cik, fil, files)
+		if err != nil {
+			return err
+		}
+	}
+
+	next := s.slice
+	if reached == filing.Sliced {
+		next = s.archive
+	} else {
+		stage.SetStatus(ctx, s.db, s.logger, p.Id, filing.Downloaded, nil)
+	}
+
+	b, err := json.Marshal(&queue.FilMessage{Cik: p.Cik, Id: fil.Id, Ref: fil.ManifestKey(), Date: fil.FilingDate})
+	if err != nil {
+		return fmt.Errorf("Serialization error: %s", err.Error())
+	}
+	err = next.SendMessage(ctx, b)
+	if err != nil {
+		return fmt.Errorf("Queue error: %s", err.Error())
+	}
+	return nil
+}
+
+// filing of the manifest in the spool or nil if it is not there anymore
+func (s *Service) spooledFiling(ctx context.Context, fil *filing.Filing) *filing.Filing {
+	r, err := s.spool.GetObject(ctx, fil.ManifestKey())
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	spooled := &filing.Filing{}
+	err = json.NewDecoder(r).Decode(spooled)
+	if err != nil || spooled.MainFile == nil {
+		return nil
+	}
+	return spooled
+}
+
+// brings the documents of the filing back into the spool from the archive by their receipts,
+// filings which were archived before receipts were kept and filings with documents which first
+// have to be retrieved from the archive are downloaded again instead
+func (s *Service) restoreFiling(ctx context.Context, cik string, fil *filing.Filing, files []*filing.ArchivedFile) error {
+
+	if len(files) > 0 {
+		err := s.unarchive(ctx, fil, files)
+		if err == nil {
+			return nil
+		}
+		if err != bucket.PendingErr {
+			s.logger.Log(fmt.Sprintf("Could not restore filing '%s' from the archive: %s", fil.Id, err.Error()))
+		}
+		fil.Files = nil
+	}
+
+	return s.download(ctx, cik, fil)
+}
+
+// main documents are archived under the id of the filing and exhibits in a folder of the id,
+// exhibits of old filings are not archived on their own and stay inside of the main document
+func (s *Service) unarchive(ctx context.Context, fil *filing.Filing, files []*filing.ArchivedFile) error {
+
+	fil.Files = nil
+	main := false
+	for _, f := range files {
+		file := fil.MainFile
+		if key, ok := strings.CutPrefix(f.Key, fil.Id+"/"); ok {
+			file = &filing.File{Key: key}
+			fil.Files = append(fil.Files, file)
+		} else {
+			file.Type = fil.Form
+			main = true
+		}
+
+		r, err := s.bucket.GetObject(ctx, f.Key)
+		if err == bucket.PendingErr {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("Bucket error: %s", err.Error())
+		}
+		_, err = s.spool.PutObject(ctx, fil.StoreKey(file), r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("Bucket error: %s", err.Error())
+		}
+	}
+	if !main {
+		return errors.New("Main document is not archived")
+	}
+
+	b, err := json.Marshal(fil)
+	if err != nil {
+		return fmt.Errorf("Serialization error: %s", err.Error())
+	}
+	_, err = s.spool.PutObject(ctx, fil.ManifestKey(), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("Bucket error: %s", err.Error())
+	}
+	return nil
+}
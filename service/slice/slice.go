@@ -1,74 +1,168 @@
 package slice
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
 	"github.com/finneas-io/data-pipeline/adapter/database"
 	"github.com/finneas-io/data-pipeline/adapter/logger"
 	"github.com/finneas-io/data-pipeline/adapter/queue"
 	"github.com/finneas-io/data-pipeline/domain/filing"
+	"github.com/finneas-io/data-pipeline/service/stage"
 )
 
 type Service struct {
 	db     database.Database
+	spool  bucket.Bucket
 	cons   queue.Queue
 	prod   queue.Queue
 	logger logger.Logger
+
+	// deliveries which were sliced or failed
+	sliced atomic.Int64
+	failed atomic.Int64
 }
 
-func New(db database.Database, cons queue.Queue, prod queue.Queue, l logger.Logger) *Service {
-	return &Service{db: db, cons: cons, prod: prod, logger: l}
+// the documents of the filings are read from the spool where extract has put them
+func New(db database.Database, spool bucket.Bucket, cons queue.Queue, prod queue.Queue, l logger.Logger) *Service {
+	return &Service{db: db, spool: spool, cons: cons, prod: prod, logger: l}
 }
 
-func (s *Service) SliceFilings() error {
+// the workers receive until the queue is drained, the queue of the next stage is closed once
+// every worker is done so the next stage does not stop while filings are still being sliced
+// and it finishes the sliced filings if the stage was cancelled
+func (s *Service) SliceFilings(ctx context.Context, workers int) error {
+
+	errs := make(chan error, max(workers, 1))
+	for i := 0; i < max(workers, 1); i++ {
+		go func() {
+			errs <- s.sliceFilings(ctx)
+		}()
+	}
+
+	// every worker returns the error which stopped it
+	var err error
+	for i := 0; i < max(workers, 1); i++ {
+		if e := <-errs; err == nil {
+			err = e
+		}
+	}
+
+	if cerr := s.prod.Close(); cerr != nil {
+		s.logger.Log(fmt.Sprintf("Queue error: %s", cerr.Error()))
+	}
+	return err
+}
+
+// number of deliveries which were sliced and which failed so far, a failed delivery is retried
+// until the queue moves it to the dead letters
+func (s *Service) Processed() (int64, int64) {
+	return s.sliced.Load(), s.failed.Load()
+}
+
+// failed messages are rejected so the queue delivers them again or moves them to the dead letters
+func (s *Service) sliceFilings(ctx context.Context) error {
 
 	for {
 
-		// we have to declare variables here because we need to check after the whole iteration
-		// if an error was returned and dependendent on that update the fully_stored field in the filing row
-		// if we do not declare variables we have a tautological condition when checking the error for nil
-		var err error
-		var msg []byte
-		msg, err = s.cons.RecvMessage()
-		if err != nil {
-			return err
+		msg, err := s.cons.RecvMessage(ctx)
+		if err == queue.DrainedErr {
+			// the stage before is done and every filing it sent is sliced
+			return nil
 		}
-		fil := &filing.Filing{}
-		err = json.Unmarshal(msg, fil)
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// the queue might be unavailable for a moment so we wait before trying again
 			s.logger.Log(fmt.Sprintf("Queue error: %s", err.Error()))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second):
+			}
 			continue
 		}
 
-		err = fil.LoadTables()
+		err = s.SliceFiling(ctx, msg.Body)
+		if err == nil {
+			// all tables could be inserted into the database
+			err = s.prod.SendMessage(ctx, msg.Body)
+			if err != nil {
+				err = fmt.Errorf("Queue error: %s", err.Error())
+				stage.SetMessageStatus(ctx, s.db, s.logger, msg.Body, filing.Failed, err)
+			}
+		}
 		if err != nil {
-			s.logger.Log(fmt.Sprintf("Domain error: %s", err.Error()))
-			continue
+			s.logger.Log(err.Error())
+			s.failed.Add(1)
+			err = s.cons.Nack(ctx, msg, err)
+		} else {
+			s.sliced.Add(1)
+			err = s.cons.Ack(ctx, msg)
 		}
+		if err != nil {
+			s.logger.Log(fmt.Sprintf("Queue error: %s", err.Error()))
+		}
+	}
+}
 
-		for _, t := range fil.Tables {
-
-			var d []byte
-			d, err = t.Data.Json()
-			if err != nil {
-				s.logger.Log(fmt.Sprintf("Domain error: %s", err.Error()))
-				continue
-			}
+// inserts the tables of all documents of the filing message and records the status of the filing
+func (s *Service) SliceFiling(ctx context.Context, body []byte) (err error) {
 
-			_, err = s.db.InsertTable(fil.Id, t, d)
-			if err != nil && err != database.DuplicateErr {
-				s.logger.Log(fmt.Sprintf("Database error: %s", err.Error()))
-				continue
-			}
+	defer func() {
+		if err == nil {
+			stage.SetMessageStatus(ctx, s.db, s.logger, body, filing.Sliced, nil)
+		} else if ctx.Err() == nil {
+			stage.SetMessageStatus(ctx, s.db, s.logger, body, filing.Failed, err)
 		}
+	}()
 
-		// all tables could be inserted into the database
-		if err == nil {
-			err = s.prod.SendMessage(msg)
-			if err != nil {
-				s.logger.Log(fmt.Sprintf("Queue error: %s", err.Error()))
-			}
+	fil, _, err := stage.FetchFiling(ctx, s.spool, body)
+	if err != nil {
+		return err
+	}
+
+	// tables are inserted one by one as the documents are scanned so a large
+	// document never has to be held in memory as a whole
+	index := 0
+	for _, file := range append([]*filing.File{fil.MainFile}, fil.Files...) {
+		err = s.sliceFile(ctx, fil, file, &index)
+		if err != nil {
+			return err
 		}
 	}
+
+	return nil
+}
+
+func (s *Service) sliceFile(ctx context.Context, fil *filing.Filing, file *filing.File, index *int) error {
+
+	body, err := s.spool.GetObject(ctx, fil.StoreKey(file))
+	if err != nil {
+		return fmt.Errorf("Bucket error: %s", err.Error())
+	}
+	defer body.Close()
+
+	return filing.ScanTables(body, func(t *filing.Table) error {
+
+		// the table index keeps counting across files so it is unique within the filing
+		t.Index = *index
+		t.FileKey = file.Key
+		*index++
+
+		d, err := t.Data.Json()
+		if err != nil {
+			return fmt.Errorf("Domain error: %s", err.Error())
+		}
+
+		_, err = s.db.InsertTable(ctx, fil.Id, t, d)
+		if err != nil && err != database.DuplicateErr {
+			return fmt.Errorf("Database error: %s", err.Error())
+		}
+		return nil
+	})
 }
@@ -0,0 +1,69 @@
+package stage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/logger"
+	"github.com/finneas-io/data-pipeline/adapter/queue"
+	"github.com/finneas-io/data-pipeline/domain/filing"
+)
+
+// the message is a claim check whose reference points to the manifest of the filing in the spool,
+// messages sent before the claim check was introduced carry the whole filing
+func FetchFiling(ctx context.Context, spool bucket.Bucket, body []byte) (*filing.Filing, string, error) {
+
+	msg := &queue.FilMessage{}
+	err := json.Unmarshal(body, msg)
+	if err != nil {
+		return nil, "", fmt.Errorf("Serialization error: %s", err.Error())
+	}
+
+	fil := &filing.Filing{}
+	if len(msg.Ref) < 1 {
+		err = json.Unmarshal(body, fil)
+		if err != nil {
+			return nil, "", fmt.Errorf("Serialization error: %s", err.Error())
+		}
+	} else {
+		r, err := spool.GetObject(ctx, msg.Ref)
+		if err != nil {
+			return nil, "", fmt.Errorf("Bucket error: %s", err.Error())
+		}
+		defer r.Close()
+		err = json.NewDecoder(r).Decode(fil)
+		if err != nil {
+			return nil, "", fmt.Errorf("Serialization error: %s", err.Error())
+		}
+	}
+	if fil.MainFile == nil {
+		return nil, "", errors.New("Serialization error: Main file is nil")
+	}
+
+	return fil, msg.Ref, nil
+}
+
+// failing to record the status does not fail the filing so the error is only logged
+func SetStatus(ctx context.Context, db database.Database, l logger.Logger, id string, status filing.Status, cause error) {
+	msg := ""
+	if cause != nil {
+		msg = cause.Error()
+	}
+	err := db.UpdateFilingStatus(ctx, id, status, msg)
+	if err != nil {
+		l.Log(fmt.Sprintf("Database error: %s", err.Error()))
+	}
+}
+
+// status of the filing the message refers to, messages without the id of a filing are skipped
+func SetMessageStatus(ctx context.Context, db database.Database, l logger.Logger, body []byte, status filing.Status, cause error) {
+	msg := &queue.FilMessage{}
+	if err := json.Unmarshal(body, msg); err != nil || len(msg.Id) < 1 {
+		return
+	}
+	SetStatus(ctx, db, l, msg.Id, status, cause)
+}
@@ -0,0 +1,60 @@
+package status
+
+import (
+	"context"
+	"sort"
+
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/logger"
+	"github.com/finneas-io/data-pipeline/domain/filing"
+)
+
+type Service struct {
+	db     database.Database
+	logger logger.Logger
+}
+
+func New(db database.Database, l logger.Logger) *Service {
+	return &Service{db: db, logger: l}
+}
+
+// number of filings per status in total and per company together with the most recent failures
+type Report struct {
+	Totals    map[filing.Status]int
+	Companies []*CompanyReport
+	Failures  []*filing.Progress
+}
+
+type CompanyReport struct {
+	Cik    string
+	Counts map[filing.Status]int
+}
+
+// companies are ordered by their CIK and failures by the time they happened, at
+// most limit failures are returned and a limit of zero returns all of them
+func (s *Service) Report(ctx context.Context, limit int) (*Report, error) {
+
+	counts, err := s.db.CountFilingStatuses(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &Report{Totals: make(map[filing.Status]int), Companies: []*CompanyReport{}}
+	for cik, c := range counts {
+		for status, n := range c {
+			rep.Totals[status] += n
+		}
+		rep.Companies = append(rep.Companies, &CompanyReport{Cik: cik, Counts: c})
+	}
+	sort.Slice(rep.Companies, func(i, j int) bool { return rep.Companies[i].Cik < rep.Companies[j].Cik })
+
+	rep.Failures, err = s.db.GetFilingStatuses(ctx, &database.FilingFilter{
+		Statuses: []filing.Status{filing.Failed},
+		Limit:    limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rep, nil
+}
@@ -0,0 +1,91 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/finneas-io/data-pipeline/adapter/bucket"
+	"github.com/finneas-io/data-pipeline/adapter/database"
+	"github.com/finneas-io/data-pipeline/adapter/logger"
+	"github.com/finneas-io/data-pipeline/domain/filing"
+)
+
+type Service struct {
+	db     database.Database
+	bucket bucket.Bucket
+	logger logger.Logger
+}
+
+// archived document whose content does not match its receipt anymore or which could not be read
+type Mismatch struct {
+	File     *filing.ArchivedFile
+	TreeHash string
+	Size     int64
+	Error    string
+}
+
+type Report struct {
+	Verified   int
+	Pending    int
+	Mismatches []*Mismatch
+}
+
+func New(db database.Database, b bucket.Bucket, l logger.Logger) *Service {
+	return &Service{db: db, bucket: b, logger: l}
+}
+
+// reads the archived documents of the filings which match the filter and compares their tree
+// hashes and sizes with the receipts of the upload, documents which first have to be retrieved
+// from the archive are counted as pending and verified by a later call
+func (s *Service) VerifyFiles(ctx context.Context, filter database.FilingFilter) (*Report, error) {
+
+	files, err := s.db.GetArchivedFiles(ctx, &filter)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %s", err.Error())
+	}
+
+	rep := &Report{Mismatches: []*Mismatch{}}
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return rep, ctx.Err()
+		}
+
+		hash, err := s.hashObject(ctx, file.Key)
+		if err == bucket.PendingErr {
+			rep.Pending++
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return rep, ctx.Err()
+			}
+			s.logger.Log(fmt.Sprintf("Bucket error: %s", err.Error()))
+			rep.Mismatches = append(rep.Mismatches, &Mismatch{File: file, Error: err.Error()})
+			continue
+		}
+
+		if hash.Sum() != file.TreeHash || hash.Size() != file.Size {
+			rep.Mismatches = append(rep.Mismatches, &Mismatch{File: file, TreeHash: hash.Sum(), Size: hash.Size()})
+			continue
+		}
+		rep.Verified++
+	}
+
+	return rep, nil
+}
+
+func (s *Service) hashObject(ctx context.Context, key string) (*bucket.TreeHash, error) {
+	r, err := s.bucket.GetObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	hash := bucket.NewTreeHash()
+	_, err = io.Copy(hash, r)
+	if err != nil {
+		return nil, err
+	}
+	return hash, nil
+}